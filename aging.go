@@ -0,0 +1,85 @@
+package main
+
+import (
+	"time"
+)
+
+// AgingRebuildInterval is the longest time the heap order of a capped
+// aging policy is kept before it is rebuilt.  Between rebuilds tasks are
+// ordered by their effective priority at the last rebuild.
+const AgingRebuildInterval = time.Second
+
+// AgingPolicy lowers the effective priority of a task linearly with the
+// time it has been queued so long running tasks are not starved by a
+// steady stream of short running tasks.
+type AgingPolicy struct {
+	// Rate is the priority decrease per second of queue wait time.
+	// Max caps the total priority decrease.  Zero means uncapped.
+	Rate float64 `json:"rate"`
+	Max  float64 `json:"max,omitempty"`
+}
+
+// Valid reports whether the rate and cap of the policy are not negative.
+func (p *AgingPolicy) Valid() bool {
+	return p == nil || (p.Rate >= 0 && p.Max >= 0)
+}
+
+// EffectivePriority returns the priority of the task aged by the policy
+// at now.  The original priority is returned if the policy is nil.
+func (p *AgingPolicy) EffectivePriority(t *Task, now time.Time) float64 {
+	if p == nil || p.Rate == 0 || t.EnqueuedAt.IsZero() {
+		return t.Priority
+	}
+	wait := now.Sub(t.EnqueuedAt).Seconds()
+	if wait < 0 {
+		wait = 0
+	}
+	decrease := p.Rate * wait
+	if p.Max > 0 && decrease > p.Max {
+		decrease = p.Max
+	}
+	return t.Priority - decrease
+}
+
+// Configure sets the queue configuration and restores the heap order
+// for the new aging policy.
+func (pq *PriorityQueue) Configure(config QueueConfig) {
+	pq.Config = config
+	pq.agedAt = time.Now()
+	pq.heapify()
+}
+
+// age moves the aging reference time to now and rebuilds the heap.  An
+// uncapped linear aging policy preserves the relative order of tasks
+// over time, so the heap is only rebuilt when the policy is capped, and
+// at most once per AgingRebuildInterval so that heap operations stay
+// logarithmic.
+func (pq *PriorityQueue) age(now time.Time) {
+	policy := pq.Config.Aging
+	if policy == nil || policy.Rate == 0 || policy.Max == 0 {
+		return
+	}
+	if now.Sub(pq.agedAt) < AgingRebuildInterval {
+		return
+	}
+	pq.agedAt = now
+	pq.heapify()
+}
+
+// heapify restores the heap order of all nodes.
+func (pq *PriorityQueue) heapify() {
+	for i := (pq.count / 2) - 1; i >= 0; i-- {
+		pq.minHeapify(i)
+	}
+}
+
+// view returns a copy of the task with the effective priority set if the
+// queue ages tasks.
+func (pq *PriorityQueue) view(t *Task) *Task {
+	task := *t
+	if pq.Config.Aging != nil {
+		priority := pq.Config.Aging.EffectivePriority(t, time.Now())
+		task.EffectivePriority = &priority
+	}
+	return &task
+}
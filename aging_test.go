@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestAgingPolicyEffectivePriority(t *testing.T) {
+	now := time.Now()
+	task := &Task{Priority: 10, EnqueuedAt: now.Add(-time.Minute)}
+	var table = []struct {
+		Policy   *AgingPolicy
+		Expected float64
+	}{
+		{nil, 10},
+		{&AgingPolicy{Rate: 0}, 10},
+		{&AgingPolicy{Rate: 0.1}, 4},
+		{&AgingPolicy{Rate: 0.1, Max: 2}, 8},
+	}
+
+	for _, tt := range table {
+		if priority := tt.Policy.EffectivePriority(task, now); priority != tt.Expected {
+			t.Fatalf("expected effective priority %v, got %v", tt.Expected, priority)
+		}
+	}
+	if priority := (&AgingPolicy{Rate: 1}).EffectivePriority(&Task{Priority: 3}, now); priority != 3 {
+		t.Fatal("expected task without enqueue time to keep its priority")
+	}
+}
+
+func TestPriorityQueueAging(t *testing.T) {
+	now := time.Now()
+	pq := NewPriorityQueue("test")
+	pq.Push(&Task{Id: "long", Priority: 100, EnqueuedAt: now.Add(-time.Hour)})
+	for i := 0; i < 10; i++ {
+		pq.Push(&Task{Id: fmt.Sprint(i), Priority: float64(i + 1), EnqueuedAt: now})
+	}
+	if pq.Peek().Id != "0" {
+		t.Fatal("expected short task to be first without aging")
+	}
+	pq.Configure(QueueConfig{Aging: &AgingPolicy{Rate: 1}})
+	checkHeap(t, pq)
+	if task := pq.Pop(); task.Id != "long" {
+		t.Fatal("expected aged long task to be popped first")
+	}
+	if task := pq.Pop(); task.Id != "0" || task.Priority != 1 {
+		t.Fatal("expected original priority to be preserved")
+	}
+}
+
+func TestPriorityQueueAgingCapped(t *testing.T) {
+	now := time.Now()
+	pq := NewPriorityQueue("test")
+	pq.Configure(QueueConfig{Aging: &AgingPolicy{Rate: 1, Max: 5}})
+	pq.Push(&Task{Id: "a", Priority: 10, EnqueuedAt: now.Add(-time.Hour)})
+	pq.Push(&Task{Id: "b", Priority: 7, EnqueuedAt: now})
+	pq.Push(&Task{Id: "c", Priority: 4, EnqueuedAt: now})
+	if task := pq.Peek(); task.Id != "c" {
+		t.Fatal("expected capped aging to keep task 'c' first")
+	}
+	pq.Pop()
+	pq.age(now.Add(3 * time.Second))
+	checkHeap(t, pq)
+	if task := pq.heap[0]; task.Id != "b" {
+		t.Fatal("expected task 'b' to age past the capped task 'a'")
+	}
+}
+
+func TestPriorityQueueAgingView(t *testing.T) {
+	pq := NewPriorityQueue("test")
+	pq.Configure(QueueConfig{Aging: &AgingPolicy{Rate: 1, Max: 2}})
+	pq.Push(&Task{Id: "a", Priority: 10, EnqueuedAt: time.Now().Add(-time.Hour)})
+	data, err := json.Marshal(pq.Copy())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m struct {
+		Config QueueConfig `json:"config"`
+		Heap   []*Task     `json:"heap"`
+	}
+	if err := json.Unmarshal(data, &m); err != nil {
+		t.Fatal(err)
+	}
+	if m.Heap[0].Priority != 10 || *m.Heap[0].EffectivePriority != 8 {
+		t.Fatal("expected original and effective priority in output")
+	}
+	if m.Config.Aging == nil || m.Config.Aging.Max != 2 {
+		t.Fatal("expected aging policy in output")
+	}
+	restored := new(PriorityQueue)
+	if err := json.Unmarshal(data, restored); err != nil {
+		t.Fatal(err)
+	}
+	if restored.Config.Aging == nil || restored.Config.Aging.Rate != 1 {
+		t.Fatal("expected aging policy to be restored")
+	}
+}
+
+func BenchmarkPriorityQueueAgingCapped(b *testing.B) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	now := time.Now()
+	pq := NewPriorityQueue("bench")
+	pq.Configure(QueueConfig{Aging: &AgingPolicy{Rate: 1, Max: 5}})
+	for i := 0; i < 100000; i++ {
+		pq.Push(&Task{Id: fmt.Sprint(i), Priority: float64(i % 1000), EnqueuedAt: now})
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		pq.Push(pq.Pop())
+	}
+}
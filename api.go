@@ -1,27 +1,78 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/bitwurx/jrpc2"
 )
 
 const (
 	QueueNotFoundCode jrpc2.ErrorCode = -32002 // queue not found json rpc 2.0 error code.
+	DuplicateTaskCode jrpc2.ErrorCode = -32003 // duplicate task json rpc 2.0 error code.
+	LeaseNotFoundCode jrpc2.ErrorCode = -32004 // lease not found json rpc 2.0 error code.
+	StorageErrorCode  jrpc2.ErrorCode = -32005 // storage error json rpc 2.0 error code.
+	ConflictCode      jrpc2.ErrorCode = -32006 // write conflict json rpc 2.0 error code.
+	TimeoutCode       jrpc2.ErrorCode = -32007 // storage timeout json rpc 2.0 error code.
 )
 
 const (
 	QueueNotFoundMsg jrpc2.ErrorMsg = "Queue not found" // queue not found json rpc 2.0 error message.
+	DuplicateTaskMsg jrpc2.ErrorMsg = "Duplicate task"  // duplicate task json rpc 2.0 error message.
+	LeaseNotFoundMsg jrpc2.ErrorMsg = "Lease not found" // lease not found json rpc 2.0 error message.
+	StorageErrorMsg  jrpc2.ErrorMsg = "Storage error"   // storage error json rpc 2.0 error message.
+	ConflictMsg      jrpc2.ErrorMsg = "Write conflict"  // write conflict json rpc 2.0 error message.
+	TimeoutMsg       jrpc2.ErrorMsg = "Storage timeout" // storage timeout json rpc 2.0 error message.
 )
 
+const (
+	SweepInterval  = time.Second     // the interval at which expired leases and tasks are swept.
+	MaxWaitTimeout = 5 * time.Minute // the longest time a popWait call blocks.
+
+	DefaultMaxPayloadSize = 64 * 1024        // the default largest task payload in bytes.
+	DefaultStorageTimeout = 10 * time.Second // the default time budget of the storage calls of a request.
+)
+
+// ApiOptions configures an api instance.  Zero values select the
+// defaults.
+type ApiOptions struct {
+	MaxPayloadSize  int           // the largest task payload in bytes.
+	StorageTimeout  time.Duration // the time budget of the storage calls of a request.
+	Lazy            bool          // load queues on first access instead of at startup.
+	MaxLoadedQueues int           // the most queues loaded at once when lazy, zero for no limit.
+}
+
 // ApiV1 is the version 1 implementation of the rpc methods.
+//
+// Requests are served concurrently.  The queue registry guards the set
+// of queues and each queue is locked for the duration of an operation,
+// so operations on different keys proceed in parallel while operations
+// on the same key are serialized.
 type ApiV1 struct {
 	// model the priority queue database model.
 	// queues is a represetation of priority queues by key.
-	model  Model
-	queues map[string]*PriorityQueue
+	// done stops the background sweeper when closed.
+	// maxPayload is the largest accepted task payload in bytes.
+	// timeout is the time budget of the storage calls of a request.
+	// lazy loads queues on first access instead of at startup.
+	// maxQueues is the number of loaded queues above which idle queues
+	// are unloaded.  Zero keeps all queues loaded.
+	// swept is set once the stored queues that the sweeper must visit
+	// are loaded.
+	model      Model
+	queues     *QueueRegistry
+	done       chan struct{}
+	maxPayload int
+	timeout    time.Duration
+	lazy       bool
+	maxQueues  int
+	swept      atomic.Bool
 }
 
 // GetParams contains the rpc parameters for the Get method.
@@ -42,7 +93,7 @@ func (params *GetParams) FromPositional(args []interface{}) error {
 }
 
 // Get returns a queue by key.  An error is returned if the queue
-//  does not exist.
+// does not exist.
 func (api *ApiV1) Get(params json.RawMessage) (interface{}, *jrpc2.ErrorObject) {
 	p := new(GetParams)
 	if err := jrpc2.ParseParams(params, p); err != nil {
@@ -55,21 +106,48 @@ func (api *ApiV1) Get(params json.RawMessage) (interface{}, *jrpc2.ErrorObject)
 			Data:    "queue key is required",
 		}
 	}
-	queue, ok := api.queues[*p.Key]
-	if !ok {
+	ctx, cancel := api.context()
+	defer cancel()
+	queue, errObj := api.lookup(ctx, *p.Key)
+	if errObj != nil {
+		return nil, errObj
+	}
+	if queue == nil {
 		return nil, &jrpc2.ErrorObject{
 			Code:    QueueNotFoundCode,
 			Message: QueueNotFoundMsg,
 		}
 	}
-	return queue, nil
+	defer queue.Unlock()
+	return queue.Copy(), nil
 }
 
-// GetAll returns all existing queues.
+// GetAll returns all existing queues.  If queues are loaded lazily the
+// stored queues that are not loaded are read without loading them.
 func (api *ApiV1) GetAll(params json.RawMessage) (interface{}, *jrpc2.ErrorObject) {
 	queues := make([]*PriorityQueue, 0)
-	for _, queue := range api.queues {
-		queues = append(queues, queue)
+	if api.lazy {
+		ctx, cancel := api.context()
+		defer cancel()
+		keys, errObj := api.keys(ctx)
+		if errObj != nil {
+			return nil, errObj
+		}
+		for _, key := range keys {
+			queue, errObj := api.copy(ctx, key)
+			if errObj != nil {
+				return nil, errObj
+			}
+			if queue != nil {
+				queues = append(queues, queue)
+			}
+		}
+		return queues, nil
+	}
+	for _, queue := range api.queues.List() {
+		queue.Lock()
+		queues = append(queues, queue.Copy())
+		queue.Unlock()
 	}
 	return queues, nil
 }
@@ -77,23 +155,34 @@ func (api *ApiV1) GetAll(params json.RawMessage) (interface{}, *jrpc2.ErrorObjec
 // PeekParams contains the rpc parameters for the Peek method.
 type PeekParams struct {
 	// Key is the queue key.
-	Key *string `json:"key"`
+	// Selector is the optional labels the task must carry.
+	Key      *string  `json:"key"`
+	Selector Selector `json:"selector"`
 }
 
-// FromPositional parses the key from the positional parameters.
+// FromPositional parses the key and optional selector from the
+// positional parameters.
 func (params *PeekParams) FromPositional(args []interface{}) error {
-	if len(args) != 1 {
+	if len(args) != 1 && len(args) != 2 {
 		return errors.New("key parameter is required")
 	}
 	key := args[0].(string)
 	params.Key = &key
+	if len(args) == 2 {
+		selector, err := parseSelector(args[1])
+		if err != nil {
+			return err
+		}
+		params.Selector = selector
+	}
 
 	return nil
 }
 
-// Peek returns the min node of the queue without deleting it.
+// Peek returns the min eligible node of the queue that matches the
+// optional selector without deleting it.
 func (api *ApiV1) Peek(params json.RawMessage) (interface{}, *jrpc2.ErrorObject) {
-	p := new(PushParams)
+	p := new(PeekParams)
 	if err := jrpc2.ParseParams(params, p); err != nil {
 		return nil, err
 	}
@@ -104,16 +193,21 @@ func (api *ApiV1) Peek(params json.RawMessage) (interface{}, *jrpc2.ErrorObject)
 			Data:    "task key is required",
 		}
 	}
-	queue, ok := api.queues[*p.Key]
-	if !ok {
+	ctx, cancel := api.context()
+	defer cancel()
+	queue, errObj := api.lookup(ctx, *p.Key)
+	if errObj != nil {
+		return nil, errObj
+	}
+	if queue == nil {
 		return nil, &jrpc2.ErrorObject{
 			Code:    QueueNotFoundCode,
 			Message: QueueNotFoundMsg,
 		}
 	}
-	task := queue.Peek()
-	if task != nil {
-		return task, nil
+	defer queue.Unlock()
+	if task := queue.PeekMatching(p.Selector); task != nil {
+		return queue.view(task), nil
 	}
 	return make(map[string]interface{}), nil
 }
@@ -121,22 +215,32 @@ func (api *ApiV1) Peek(params json.RawMessage) (interface{}, *jrpc2.ErrorObject)
 // PopParams contains the rpc parameters for the Pop method.
 type PopParams struct {
 	// Key is the queue key.
-	Key *string `json:"key"`
+	// Selector is the optional labels the task must carry.
+	Key      *string  `json:"key"`
+	Selector Selector `json:"selector"`
 }
 
-// FromPositional parses the key from the positional parameters.
+// FromPositional parses the key and optional selector from the
+// positional parameters.
 func (params *PopParams) FromPositional(args []interface{}) error {
-	if len(args) != 1 {
+	if len(args) != 1 && len(args) != 2 {
 		return errors.New("key parameter is required")
 	}
 	key := args[0].(string)
 	params.Key = &key
+	if len(args) == 2 {
+		selector, err := parseSelector(args[1])
+		if err != nil {
+			return err
+		}
+		params.Selector = selector
+	}
 
 	return nil
 }
 
-// Pop returns the min node of the queue and deletes it from the
-// queue.
+// Pop returns the min eligible node of the queue that matches the
+// optional selector and deletes it from the queue.
 func (api *ApiV1) Pop(params json.RawMessage) (interface{}, *jrpc2.ErrorObject) {
 	p := new(PopParams)
 	if err := jrpc2.ParseParams(params, p); err != nil {
@@ -149,35 +253,277 @@ func (api *ApiV1) Pop(params json.RawMessage) (interface{}, *jrpc2.ErrorObject)
 			Data:    "task key is required",
 		}
 	}
-	queue, ok := api.queues[*p.Key]
-	if !ok {
+	if errObj := reservedKey(*p.Key); errObj != nil {
+		return nil, errObj
+	}
+	ctx, cancel := api.context()
+	defer cancel()
+	queue, errObj := api.lookup(ctx, *p.Key)
+	if errObj != nil {
+		return nil, errObj
+	}
+	if queue == nil {
 		return nil, &jrpc2.ErrorObject{
 			Code:    QueueNotFoundCode,
 			Message: QueueNotFoundMsg,
 		}
 	}
-	task := queue.Pop()
-	if task != nil {
-		queue.Save(api.model)
+	defer queue.Unlock()
+	task := queue.PopMatching(p.Selector)
+	if task == nil {
+		return task, nil
+	}
+	undo := func() { queue.insert(task) }
+	if errObj := api.commit(ctx, queue, undo, PopOps(task)...); errObj != nil {
+		return nil, errObj
+	}
+
+	return queue.view(task), nil
+}
+
+// PopWaitParams contains the rpc parameters for the PopWait method.
+type PopWaitParams struct {
+	// Key is the queue key.
+	// Timeout is the longest time to wait for a task in seconds.
+	Key     *string  `json:"key"`
+	Timeout *float64 `json:"timeout"`
+}
+
+// FromPositional parses the key and timeout from the positional
+// parameters.
+func (params *PopWaitParams) FromPositional(args []interface{}) error {
+	if len(args) != 2 {
+		return errors.New("key, and timeout parameters are required")
+	}
+	key := args[0].(string)
+	timeout := args[1].(float64)
+	params.Key = &key
+	params.Timeout = &timeout
+
+	return nil
+}
+
+// PopWait returns the min eligible node of the queue and deletes it
+// from the queue.  If no task is eligible the call blocks until a task
+// is handed off or the timeout elapses, in which case null is returned.
+// Concurrent callers on the same key are served first come first served.
+// Waiting on a key without a queue does not create the queue, the caller
+// waits for the first task pushed to it.
+func (api *ApiV1) PopWait(params json.RawMessage) (interface{}, *jrpc2.ErrorObject) {
+	p := new(PopWaitParams)
+	if err := jrpc2.ParseParams(params, p); err != nil {
+		return nil, err
+	}
+	if p.Key == nil {
+		return nil, &jrpc2.ErrorObject{
+			Code:    jrpc2.InvalidParamsCode,
+			Message: jrpc2.InvalidParamsMsg,
+			Data:    "task key is required",
+		}
+	}
+	if errObj := reservedKey(*p.Key); errObj != nil {
+		return nil, errObj
+	}
+	if p.Timeout == nil || *p.Timeout < 0 {
+		return nil, &jrpc2.ErrorObject{
+			Code:    jrpc2.InvalidParamsCode,
+			Message: jrpc2.InvalidParamsMsg,
+			Data:    "timeout must not be negative",
+		}
+	}
+	timeout := time.Duration(*p.Timeout * float64(time.Second))
+	if timeout > MaxWaitTimeout {
+		timeout = MaxWaitTimeout
+	}
+
+	w := NewWaiter()
+	if errObj := api.wait(*p.Key, w); errObj != nil {
+		return nil, errObj
+	}
+	if task, done, errObj := api.take(*p.Key, w); done {
+		return task, errObj
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case task := <-w.C:
+			return task, nil
+		case <-w.Wake:
+			if task, done, errObj := api.take(*p.Key, w); done {
+				return task, errObj
+			}
+		case <-timer.C:
+			api.cancelWait(*p.Key, w)
+			return nil, nil
+		}
+	}
+}
+
+// wait registers the waiter with the queue with the provided key, or
+// as a pending waiter of the key if the queue does not exist.
+func (api *ApiV1) wait(key string, w *Waiter) *jrpc2.ErrorObject {
+	ctx, cancel := api.context()
+	defer cancel()
+	for {
+		queue, errObj := api.lookup(ctx, key)
+		if errObj != nil {
+			return errObj
+		}
+		if queue == nil {
+			if api.queues.Wait(key, w) {
+				return nil
+			}
+			// the queue was added meanwhile.
+			continue
+		}
+		queue.Wait(w)
+		queue.Unlock()
+		return nil
+	}
+}
+
+// take takes the next eligible task for the waiter if it is the first
+// waiter of its queue, and persists its removal.  Done is false if the
+// waiter is still waiting, and true with a nil task if the waiter was
+// released because its queue was deleted.
+func (api *ApiV1) take(key string, w *Waiter) (*Task, bool, *jrpc2.ErrorObject) {
+	ctx, cancel := api.context()
+	defer cancel()
+	queue, errObj := api.lookup(ctx, key)
+	if errObj != nil {
+		api.cancelWait(key, w)
+		return nil, true, errObj
+	}
+	if queue == nil {
+		return nil, !api.queues.Waiting(key, w), nil
+	}
+	defer queue.Unlock()
+	task := queue.Take(w)
+	if task == nil {
+		for _, waiter := range queue.waiters {
+			if waiter == w {
+				return nil, false, nil
+			}
+		}
+		return nil, true, nil
+	}
+	undo := func() { queue.insert(task) }
+	if errObj := api.commit(ctx, queue, undo, PopOps(task)...); errObj != nil {
+		api.handoff(ctx, queue)
+		return nil, true, errObj
+	}
+	api.handoff(ctx, queue)
+	return queue.view(task), true, nil
+}
+
+// cancelWait unregisters the waiter from the queue with the provided key
+// or from the pending waiters of the key, and hands eligible tasks to
+// the waiters that were behind it.
+func (api *ApiV1) cancelWait(key string, w *Waiter) {
+	for !api.queues.CancelWait(key, w) {
+		queue, ok := api.queues.Get(key)
+		if !ok {
+			// released by a delete.
+			return
+		}
+		queue.Lock()
+		if queue.evicted {
+			// its waiters became pending again.
+			queue.Unlock()
+			continue
+		}
+		if queue.CancelWait(w) {
+			ctx, cancel := api.context()
+			api.handoff(ctx, queue)
+			cancel()
+		}
+		queue.Unlock()
+		return
 	}
+}
+
+// TaskParams contains the rpc parameters of a pushed task.
+type TaskParams struct {
+	// Id the id of the task.
+	// Priority the task priority value.
+	// NotBefore the optional time before which the task is not eligible
+	// to be dequeued.
+	// ExpiresAt the optional time at which the task is purged.
+	// Ttl the optional number of seconds after which the task is purged.
+	// Payload the optional json document describing the work.
+	// Labels the optional string metadata of the task.
+	Id        *string           `json:"id"`
+	Priority  *float64          `json:"priority"`
+	NotBefore *time.Time        `json:"notBefore"`
+	ExpiresAt *time.Time        `json:"expiresAt"`
+	Ttl       *float64          `json:"ttl"`
+	Payload   json.RawMessage   `json:"payload"`
+	Labels    map[string]string `json:"labels"`
+}
 
-	return task, nil
+// Task validates the parameters and returns the task to push.  Payloads
+// larger than maxPayload bytes are rejected.
+func (params *TaskParams) Task(maxPayload int) (*Task, *jrpc2.ErrorObject) {
+	if params.Id == nil {
+		return nil, &jrpc2.ErrorObject{
+			Code:    jrpc2.InvalidParamsCode,
+			Message: jrpc2.InvalidParamsMsg,
+			Data:    "task id is required",
+		}
+	}
+	if params.Priority == nil {
+		return nil, &jrpc2.ErrorObject{
+			Code:    jrpc2.InvalidParamsCode,
+			Message: jrpc2.InvalidParamsMsg,
+			Data:    "task priority is required",
+		}
+	}
+	payload := params.Payload
+	if string(payload) == "null" {
+		payload = nil
+	}
+	if len(payload) > maxPayload {
+		return nil, &jrpc2.ErrorObject{
+			Code:    jrpc2.InvalidParamsCode,
+			Message: jrpc2.InvalidParamsMsg,
+			Data:    fmt.Sprintf("task payload exceeds %d bytes", maxPayload),
+		}
+	}
+	expiresAt := params.ExpiresAt
+	if params.Ttl != nil {
+		if params.ExpiresAt != nil || *params.Ttl <= 0 {
+			return nil, &jrpc2.ErrorObject{
+				Code:    jrpc2.InvalidParamsCode,
+				Message: jrpc2.InvalidParamsMsg,
+				Data:    "ttl must be positive and exclusive with expiresAt",
+			}
+		}
+		t := time.Now().Add(time.Duration(*params.Ttl * float64(time.Second)))
+		expiresAt = &t
+	}
+	return &Task{
+		Id:        *params.Id,
+		Priority:  *params.Priority,
+		NotBefore: params.NotBefore,
+		ExpiresAt: expiresAt,
+		Payload:   payload,
+		Labels:    params.Labels,
+	}, nil
 }
 
 // PushParams contains the rpc parameters fo the Push method.
 type PushParams struct {
 	// Key The resource key of the task.
-	// Id the id of the task.
-	// Priority the task priority value.
-	Key      *string  `json:"key"`
-	Id       *string  `json:"id"`
-	Priority *float64 `json:"priority"`
+	Key *string `json:"key"`
+	TaskParams
 }
 
-// FromPositional parses the key, id, and priority from the
-// positional parameters.
+// FromPositional parses the key, id, priority, and optional not before
+// and expires at times from the positional parameters.  A null time is
+// treated as omitted.
 func (params *PushParams) FromPositional(args []interface{}) error {
-	if len(args) != 3 {
+	if len(args) < 3 || len(args) > 5 {
 		return errors.New("key, id, and priority parameters are required")
 	}
 	key := args[0].(string)
@@ -186,12 +532,41 @@ func (params *PushParams) FromPositional(args []interface{}) error {
 	params.Key = &key
 	params.Id = &id
 	params.Priority = &priority
+	if len(args) > 3 {
+		notBefore, err := parseTime(args[3])
+		if err != nil {
+			return err
+		}
+		params.NotBefore = notBefore
+	}
+	if len(args) > 4 {
+		expiresAt, err := parseTime(args[4])
+		if err != nil {
+			return err
+		}
+		params.ExpiresAt = expiresAt
+	}
 
 	return nil
 }
 
+// parseTime parses an optional RFC 3339 time positional parameter.
+func parseTime(arg interface{}) (*time.Time, error) {
+	if arg == nil {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, arg.(string))
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
 // Push adds the task to the queue with matching key. If the queue
-// does not exist it will be created for insertion of the task.
+// does not exist it will be created for insertion of the task.  The
+// result reports whether the task was inserted, replaced a queued task
+// with the same id, or was ignored, and an error is returned if the
+// queue rejects duplicate task ids.
 func (api *ApiV1) Push(params json.RawMessage) (interface{}, *jrpc2.ErrorObject) {
 	p := new(PushParams)
 	if err := jrpc2.ParseParams(params, p); err != nil {
@@ -204,32 +579,296 @@ func (api *ApiV1) Push(params json.RawMessage) (interface{}, *jrpc2.ErrorObject)
 			Data:    "task key is required",
 		}
 	}
-	if p.Id == nil {
+	if errObj := reservedKey(*p.Key); errObj != nil {
+		return nil, errObj
+	}
+	task, errObj := p.Task(api.maxPayload)
+	if errObj != nil {
+		return nil, errObj
+	}
+
+	ctx, cancel := api.context()
+	defer cancel()
+	queue, errObj := api.lookupOrCreate(ctx, *p.Key)
+	if errObj != nil {
+		return nil, errObj
+	}
+	defer queue.Unlock()
+	undo := queue.undoPush(task.Id)
+	result, err := queue.Push(task)
+	if err == ErrDuplicateTask {
+		return nil, &jrpc2.ErrorObject{
+			Code:    DuplicateTaskCode,
+			Message: DuplicateTaskMsg,
+			Data:    *p.Id,
+		}
+	}
+	if result != PushIgnored {
+		if errObj := api.commit(ctx, queue, undo, PushOp(task)); errObj != nil {
+			return nil, errObj
+		}
+		api.handoff(ctx, queue)
+	}
+
+	return int(result), nil
+}
+
+// PushManyParams contains the rpc parameters for the PushMany method.
+type PushManyParams struct {
+	// Key The resource key of the tasks.
+	// Tasks the tasks to push.
+	// Atomic pushes either all or none of the tasks.
+	Key    *string       `json:"key"`
+	Tasks  []*TaskParams `json:"tasks"`
+	Atomic bool          `json:"atomic"`
+}
+
+// FromPositional parses the key, tasks, and optional atomic flag from
+// the positional parameters.
+func (params *PushManyParams) FromPositional(args []interface{}) error {
+	if len(args) != 2 && len(args) != 3 {
+		return errors.New("key, and tasks parameters are required")
+	}
+	key := args[0].(string)
+	data, err := json.Marshal(args[1])
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, &params.Tasks); err != nil {
+		return err
+	}
+	params.Key = &key
+	if len(args) == 3 {
+		params.Atomic = args[2].(bool)
+	}
+
+	return nil
+}
+
+// PushManyResult is the outcome of a single task of the PushMany method.
+type PushManyResult struct {
+	// Id the id of the task.
+	// Result the push result if the task was pushed.
+	// Error the reason the task was not pushed.
+	Id     string             `json:"id"`
+	Result *int               `json:"result,omitempty"`
+	Error  *jrpc2.ErrorObject `json:"error,omitempty"`
+}
+
+// PushMany adds the tasks to the queue with matching key and persists
+// the queue once.  The result of each task is returned in order.  If
+// atomic is set and any task is invalid or a rejected duplicate no task
+// is pushed and an error is returned with the results as data.
+func (api *ApiV1) PushMany(params json.RawMessage) (interface{}, *jrpc2.ErrorObject) {
+	p := new(PushManyParams)
+	if err := jrpc2.ParseParams(params, p); err != nil {
+		return nil, err
+	}
+	if p.Key == nil {
 		return nil, &jrpc2.ErrorObject{
 			Code:    jrpc2.InvalidParamsCode,
 			Message: jrpc2.InvalidParamsMsg,
-			Data:    "task id is required",
+			Data:    "task key is required",
 		}
 	}
-	if p.Priority == nil {
+	if errObj := reservedKey(*p.Key); errObj != nil {
+		return nil, errObj
+	}
+
+	results := make([]*PushManyResult, len(p.Tasks))
+	tasks := make([]*Task, len(p.Tasks))
+	var failed *jrpc2.ErrorObject
+	valid := 0
+	for i, params := range p.Tasks {
+		results[i] = new(PushManyResult)
+		if params == nil {
+			params = new(TaskParams)
+		}
+		if params.Id != nil {
+			results[i].Id = *params.Id
+		}
+		tasks[i], results[i].Error = params.Task(api.maxPayload)
+		if results[i].Error == nil {
+			valid++
+		} else if failed == nil {
+			failed = results[i].Error
+		}
+	}
+
+	if p.Atomic && failed != nil {
+		return nil, &jrpc2.ErrorObject{
+			Code:    failed.Code,
+			Message: failed.Message,
+			Data:    results,
+		}
+	}
+
+	if valid == 0 {
+		// nothing to push, so the queue is not created.
+		return results, nil
+	}
+
+	// the queue is only created once the batch is accepted, and a new
+	// queue does not reject duplicates.
+	ctx, cancel := api.context()
+	defer cancel()
+	queue, errObj := api.lookup(ctx, *p.Key)
+	if errObj != nil {
+		return nil, errObj
+	}
+	if queue == nil {
+		if queue, errObj = api.lookupOrCreate(ctx, *p.Key); errObj != nil {
+			return nil, errObj
+		}
+	}
+	defer queue.Unlock()
+
+	if p.Atomic {
+		if queue.Config.Duplicates.rejects() {
+			ids := make(map[string]bool)
+			for i, task := range tasks {
+				if queue.Has(task.Id) || ids[task.Id] {
+					results[i].Error = &jrpc2.ErrorObject{
+						Code:    DuplicateTaskCode,
+						Message: DuplicateTaskMsg,
+						Data:    task.Id,
+					}
+					failed = results[i].Error
+				}
+				ids[task.Id] = true
+			}
+		}
+		if failed != nil {
+			return nil, &jrpc2.ErrorObject{
+				Code:    failed.Code,
+				Message: failed.Message,
+				Data:    results,
+			}
+		}
+	}
+
+	ops := make([]*Op, 0, len(tasks))
+	undos := make([]func(), 0, len(tasks))
+	for i, task := range tasks {
+		if task == nil {
+			continue
+		}
+		undo := queue.undoPush(task.Id)
+		result, err := queue.Push(task)
+		if err == ErrDuplicateTask {
+			results[i].Error = &jrpc2.ErrorObject{
+				Code:    DuplicateTaskCode,
+				Message: DuplicateTaskMsg,
+				Data:    task.Id,
+			}
+			continue
+		}
+		n := int(result)
+		results[i].Result = &n
+		if result != PushIgnored {
+			ops = append(ops, PushOp(task))
+			undos = append(undos, undo)
+		}
+	}
+	if len(ops) > 0 {
+		undo := func() {
+			for i := len(undos) - 1; i >= 0; i-- {
+				undos[i]()
+			}
+		}
+		if errObj := api.commit(ctx, queue, undo, ops...); errObj != nil {
+			return nil, errObj
+		}
+		api.handoff(ctx, queue)
+	}
+
+	return results, nil
+}
+
+// PopManyParams contains the rpc parameters for the PopMany method.
+type PopManyParams struct {
+	// Key is the queue key.
+	// N is the maximum number of tasks to pop.
+	Key *string `json:"key"`
+	N   *int    `json:"n"`
+}
+
+// FromPositional parses the key and n from the positional parameters.
+func (params *PopManyParams) FromPositional(args []interface{}) error {
+	if len(args) != 2 {
+		return errors.New("key, and n parameters are required")
+	}
+	key := args[0].(string)
+	n := int(args[1].(float64))
+	params.Key = &key
+	params.N = &n
+
+	return nil
+}
+
+// PopMany returns up to n min eligible nodes of the queue in priority
+// order, deletes them from the queue, and persists the queue once.
+func (api *ApiV1) PopMany(params json.RawMessage) (interface{}, *jrpc2.ErrorObject) {
+	p := new(PopManyParams)
+	if err := jrpc2.ParseParams(params, p); err != nil {
+		return nil, err
+	}
+	if p.Key == nil {
 		return nil, &jrpc2.ErrorObject{
 			Code:    jrpc2.InvalidParamsCode,
 			Message: jrpc2.InvalidParamsMsg,
-			Data:    "task priority is required",
+			Data:    "task key is required",
 		}
 	}
+	if errObj := reservedKey(*p.Key); errObj != nil {
+		return nil, errObj
+	}
+	if p.N == nil || *p.N <= 0 {
+		return nil, &jrpc2.ErrorObject{
+			Code:    jrpc2.InvalidParamsCode,
+			Message: jrpc2.InvalidParamsMsg,
+			Data:    "positive n is required",
+		}
+	}
+	ctx, cancel := api.context()
+	defer cancel()
+	queue, errObj := api.lookup(ctx, *p.Key)
+	if errObj != nil {
+		return nil, errObj
+	}
+	if queue == nil {
+		return nil, &jrpc2.ErrorObject{
+			Code:    QueueNotFoundCode,
+			Message: QueueNotFoundMsg,
+		}
+	}
+	defer queue.Unlock()
 
-	var queue *PriorityQueue
-	var ok bool
-
-	if queue, ok = api.queues[*p.Key]; !ok {
-		queue = NewPriorityQueue(*p.Key)
-		api.queues[*p.Key] = queue
+	tasks := make([]*Task, 0)
+	for len(tasks) < *p.N {
+		task := queue.Pop()
+		if task == nil {
+			break
+		}
+		tasks = append(tasks, task)
+	}
+	if len(tasks) == 0 {
+		return tasks, nil
+	}
+	undo := func() {
+		for _, task := range tasks {
+			queue.insert(task)
+		}
+	}
+	if errObj := api.commit(ctx, queue, undo, PopOps(tasks...)...); errObj != nil {
+		return nil, errObj
+	}
+	views := make([]*Task, len(tasks))
+	for i, task := range tasks {
+		views[i] = queue.view(task)
 	}
-	queue.Push(&Task{Id: *p.Id, Priority: *p.Priority})
-	queue.Save(api.model)
 
-	return 0, nil
+	return views, nil
 }
 
 // RemoveParams contains the rpc parameters for the Remove method
@@ -267,6 +906,9 @@ func (api *ApiV1) Remove(params json.RawMessage) (interface{}, *jrpc2.ErrorObjec
 			Data:    "task key is required",
 		}
 	}
+	if errObj := reservedKey(*p.Key); errObj != nil {
+		return nil, errObj
+	}
 	if p.Id == nil {
 		return nil, &jrpc2.ErrorObject{
 			Code:    jrpc2.InvalidParamsCode,
@@ -275,38 +917,1096 @@ func (api *ApiV1) Remove(params json.RawMessage) (interface{}, *jrpc2.ErrorObjec
 		}
 	}
 
-	queue, ok := api.queues[*p.Key]
-	if !ok {
+	ctx, cancel := api.context()
+	defer cancel()
+	queue, errObj := api.lookup(ctx, *p.Key)
+	if errObj != nil {
+		return nil, errObj
+	}
+	if queue == nil {
 		return nil, &jrpc2.ErrorObject{
 			Code:    QueueNotFoundCode,
 			Message: QueueNotFoundMsg,
 		}
 	}
+	defer queue.Unlock()
 
-	if err := queue.Remove(*p.Id); err != nil {
+	i, ok := queue.index[*p.Id]
+	if !ok {
 		return -1, nil
 	}
-	queue.Save(api.model)
+	task := queue.heap[i]
+	queue.Remove(*p.Id)
+	undo := func() { queue.insert(task) }
+	if errObj := api.commit(ctx, queue, undo, &Op{Type: OpRemove, Id: *p.Id}); errObj != nil {
+		return nil, errObj
+	}
 	return 0, nil
 }
 
-// NewApiV1 returns a new api version 1 rpc api instance
-func NewApiV1(model Model, s *jrpc2.Server) *ApiV1 {
-	api := &ApiV1{model, make(map[string]*PriorityQueue)}
-	queues, err := model.FetchAll()
-	if err != nil {
-		log.Fatal(err)
-	}
-	for _, queue := range queues {
-		v, _ := queue.(*PriorityQueue)
-		api.queues[v.Key] = v
-	}
-	s.Register("get", jrpc2.Method{Method: api.Get})
-	s.Register("getAll", jrpc2.Method{Method: api.GetAll})
-	s.Register("peek", jrpc2.Method{Method: api.Peek})
-	s.Register("pop", jrpc2.Method{Method: api.Pop})
-	s.Register("push", jrpc2.Method{Method: api.Push})
-	s.Register("remove", jrpc2.Method{Method: api.Remove})
+// UpdateParams contains the rpc parameters for the Update method.
+type UpdateParams struct {
+	// Key is the queue key.
+	// Id the id of the task.
+	// Priority the new task priority value.
+	Key      *string  `json:"key"`
+	Id       *string  `json:"id"`
+	Priority *float64 `json:"priority"`
+}
 
+// FromPositional parses the key, id, and priority from the
+// positional parameters.
+func (params *UpdateParams) FromPositional(args []interface{}) error {
+	if len(args) != 3 {
+		return errors.New("key, id, and priority parameters are required")
+	}
+	key := args[0].(string)
+	id := args[1].(string)
+	priority := args[2].(float64)
+	params.Key = &key
+	params.Id = &id
+	params.Priority = &priority
+
+	return nil
+}
+
+// Update changes the priority of a queued task in place.
+func (api *ApiV1) Update(params json.RawMessage) (interface{}, *jrpc2.ErrorObject) {
+	p := new(UpdateParams)
+	if err := jrpc2.ParseParams(params, p); err != nil {
+		return nil, err
+	}
+	if p.Key == nil {
+		return nil, &jrpc2.ErrorObject{
+			Code:    jrpc2.InvalidParamsCode,
+			Message: jrpc2.InvalidParamsMsg,
+			Data:    "task key is required",
+		}
+	}
+	if errObj := reservedKey(*p.Key); errObj != nil {
+		return nil, errObj
+	}
+	if p.Id == nil {
+		return nil, &jrpc2.ErrorObject{
+			Code:    jrpc2.InvalidParamsCode,
+			Message: jrpc2.InvalidParamsMsg,
+			Data:    "task id is required",
+		}
+	}
+	if p.Priority == nil {
+		return nil, &jrpc2.ErrorObject{
+			Code:    jrpc2.InvalidParamsCode,
+			Message: jrpc2.InvalidParamsMsg,
+			Data:    "task priority is required",
+		}
+	}
+
+	ctx, cancel := api.context()
+	defer cancel()
+	queue, errObj := api.lookup(ctx, *p.Key)
+	if errObj != nil {
+		return nil, errObj
+	}
+	if queue == nil {
+		return nil, &jrpc2.ErrorObject{
+			Code:    QueueNotFoundCode,
+			Message: QueueNotFoundMsg,
+		}
+	}
+	defer queue.Unlock()
+
+	i, ok := queue.index[*p.Id]
+	if !ok {
+		return -1, nil
+	}
+	priority := queue.heap[i].Priority
+	queue.Update(*p.Id, *p.Priority)
+	undo := func() { queue.Update(*p.Id, priority) }
+	if errObj := api.commit(ctx, queue, undo, &Op{Type: OpUpdate, Id: *p.Id, Priority: *p.Priority}); errObj != nil {
+		return nil, errObj
+	}
+	return 0, nil
+}
+
+// ConfigureParams contains the rpc parameters for the Configure method.
+type ConfigureParams struct {
+	// Key is the queue key.
+	// Config is the queue configuration.
+	Key    *string      `json:"key"`
+	Config *QueueConfig `json:"config"`
+}
+
+// FromPositional parses the key and config from the positional
+// parameters.
+func (params *ConfigureParams) FromPositional(args []interface{}) error {
+	if len(args) != 2 {
+		return errors.New("key, and config parameters are required")
+	}
+	key := args[0].(string)
+	data, err := json.Marshal(args[1])
+	if err != nil {
+		return err
+	}
+	config := new(QueueConfig)
+	if err := json.Unmarshal(data, config); err != nil {
+		return err
+	}
+	params.Key = &key
+	params.Config = config
+
+	return nil
+}
+
+// Configure sets the behavior configuration of the queue with matching
+// key.  If the queue does not exist it will be created.
+func (api *ApiV1) Configure(params json.RawMessage) (interface{}, *jrpc2.ErrorObject) {
+	p := new(ConfigureParams)
+	if err := jrpc2.ParseParams(params, p); err != nil {
+		return nil, err
+	}
+	if p.Key == nil {
+		return nil, &jrpc2.ErrorObject{
+			Code:    jrpc2.InvalidParamsCode,
+			Message: jrpc2.InvalidParamsMsg,
+			Data:    "queue key is required",
+		}
+	}
+	if errObj := reservedKey(*p.Key); errObj != nil {
+		return nil, errObj
+	}
+	if p.Config == nil {
+		return nil, &jrpc2.ErrorObject{
+			Code:    jrpc2.InvalidParamsCode,
+			Message: jrpc2.InvalidParamsMsg,
+			Data:    "queue config is required",
+		}
+	}
+	if !p.Config.Duplicates.Valid() {
+		return nil, &jrpc2.ErrorObject{
+			Code:    jrpc2.InvalidParamsCode,
+			Message: jrpc2.InvalidParamsMsg,
+			Data:    "unknown duplicates policy",
+		}
+	}
+	if !p.Config.Aging.Valid() {
+		return nil, &jrpc2.ErrorObject{
+			Code:    jrpc2.InvalidParamsCode,
+			Message: jrpc2.InvalidParamsMsg,
+			Data:    "aging rate and max must not be negative",
+		}
+	}
+	if p.Config.MaxAttempts < 0 {
+		return nil, &jrpc2.ErrorObject{
+			Code:    jrpc2.InvalidParamsCode,
+			Message: jrpc2.InvalidParamsMsg,
+			Data:    "max attempts must not be negative",
+		}
+	}
+	if p.Config.AutoDelete < 0 {
+		return nil, &jrpc2.ErrorObject{
+			Code:    jrpc2.InvalidParamsCode,
+			Message: jrpc2.InvalidParamsMsg,
+			Data:    "auto delete must not be negative",
+		}
+	}
+
+	ctx, cancel := api.context()
+	defer cancel()
+	queue, errObj := api.lookupOrCreate(ctx, *p.Key)
+	if errObj != nil {
+		return nil, errObj
+	}
+	defer queue.Unlock()
+	state := queue.clone()
+	queue.Configure(*p.Config)
+	if errObj := api.save(ctx, queue, state); errObj != nil {
+		return nil, errObj
+	}
+
+	return 0, nil
+}
+
+// LeaseParams contains the rpc parameters for the Lease method.
+type LeaseParams struct {
+	// Key is the queue key.
+	// Ttl is the lease duration in seconds.
+	Key *string  `json:"key"`
+	Ttl *float64 `json:"ttl"`
+}
+
+// FromPositional parses the key and ttl from the positional parameters.
+func (params *LeaseParams) FromPositional(args []interface{}) error {
+	if len(args) != 2 {
+		return errors.New("key, and ttl parameters are required")
+	}
+	key := args[0].(string)
+	ttl := args[1].(float64)
+	params.Key = &key
+	params.Ttl = &ttl
+
+	return nil
+}
+
+// Lease returns the min eligible node of the queue and holds it in
+// flight until it is acknowledged or the lease expires.
+func (api *ApiV1) Lease(params json.RawMessage) (interface{}, *jrpc2.ErrorObject) {
+	p := new(LeaseParams)
+	if err := jrpc2.ParseParams(params, p); err != nil {
+		return nil, err
+	}
+	if p.Key == nil {
+		return nil, &jrpc2.ErrorObject{
+			Code:    jrpc2.InvalidParamsCode,
+			Message: jrpc2.InvalidParamsMsg,
+			Data:    "task key is required",
+		}
+	}
+	if errObj := reservedKey(*p.Key); errObj != nil {
+		return nil, errObj
+	}
+	if p.Ttl == nil || *p.Ttl <= 0 {
+		return nil, &jrpc2.ErrorObject{
+			Code:    jrpc2.InvalidParamsCode,
+			Message: jrpc2.InvalidParamsMsg,
+			Data:    "positive lease ttl is required",
+		}
+	}
+	ctx, cancel := api.context()
+	defer cancel()
+	queue, errObj := api.lookup(ctx, *p.Key)
+	if errObj != nil {
+		return nil, errObj
+	}
+	if queue == nil {
+		return nil, &jrpc2.ErrorObject{
+			Code:    QueueNotFoundCode,
+			Message: QueueNotFoundMsg,
+		}
+	}
+	defer queue.Unlock()
+	ttl := time.Duration(*p.Ttl * float64(time.Second))
+	lease := queue.Lease(time.Now().Add(ttl))
+	if lease == nil {
+		return nil, nil
+	}
+	undo := func() {
+		delete(queue.inflight, lease.Task.Id)
+		lease.Task.Attempts--
+		queue.insert(lease.Task)
+	}
+	if errObj := api.commit(ctx, queue, undo, LeaseOp(lease)); errObj != nil {
+		return nil, errObj
+	}
+
+	return &Lease{Task: queue.view(lease.Task), Expires: lease.Expires}, nil
+}
+
+// AckParams contains the rpc parameters for the Ack method.
+type AckParams struct {
+	// Key is the queue key.
+	// Id the id of the leased task.
+	Key *string `json:"key"`
+	Id  *string `json:"id"`
+}
+
+// FromPositional parses the key and id from the positional
+// parameters.
+func (params *AckParams) FromPositional(args []interface{}) error {
+	if len(args) != 2 {
+		return errors.New("key, and id parameters are required")
+	}
+	key := args[0].(string)
+	id := args[1].(string)
+	params.Key = &key
+	params.Id = &id
+
+	return nil
+}
+
+// Ack completes the lease of a task and discards the task.
+func (api *ApiV1) Ack(params json.RawMessage) (interface{}, *jrpc2.ErrorObject) {
+	p := new(AckParams)
+	if err := jrpc2.ParseParams(params, p); err != nil {
+		return nil, err
+	}
+	return api.release(p.Key, p.Id, func(queue *PriorityQueue, id string) (*Task, error) {
+		return nil, queue.Ack(id)
+	})
+}
+
+// NackParams contains the rpc parameters for the Nack method.
+type NackParams struct {
+	// Key is the queue key.
+	// Id the id of the leased task.
+	Key *string `json:"key"`
+	Id  *string `json:"id"`
+}
+
+// FromPositional parses the key and id from the positional
+// parameters.
+func (params *NackParams) FromPositional(args []interface{}) error {
+	if len(args) != 2 {
+		return errors.New("key, and id parameters are required")
+	}
+	key := args[0].(string)
+	id := args[1].(string)
+	params.Key = &key
+	params.Id = &id
+
+	return nil
+}
+
+// Nack releases the lease of a task and requeues the task with its
+// original priority.  The task is moved to the dead letter queue if it
+// reached the queue max attempts.
+func (api *ApiV1) Nack(params json.RawMessage) (interface{}, *jrpc2.ErrorObject) {
+	p := new(NackParams)
+	if err := jrpc2.ParseParams(params, p); err != nil {
+		return nil, err
+	}
+	return api.release(p.Key, p.Id, (*PriorityQueue).Nack)
+}
+
+// release applies the lease release operation to the leased task with
+// the provided id and dead letters the task returned by the operation.
+// The task is dead lettered before the release is persisted, and dead
+// lettering is undone if the release cannot be persisted, so a failure
+// never leaves the task neither leased nor dead lettered.
+func (api *ApiV1) release(key, id *string, op func(*PriorityQueue, string) (*Task, error)) (interface{}, *jrpc2.ErrorObject) {
+	if key == nil {
+		return nil, &jrpc2.ErrorObject{
+			Code:    jrpc2.InvalidParamsCode,
+			Message: jrpc2.InvalidParamsMsg,
+			Data:    "task key is required",
+		}
+	}
+	if errObj := reservedKey(*key); errObj != nil {
+		return nil, errObj
+	}
+	if id == nil {
+		return nil, &jrpc2.ErrorObject{
+			Code:    jrpc2.InvalidParamsCode,
+			Message: jrpc2.InvalidParamsMsg,
+			Data:    "task id is required",
+		}
+	}
+	ctx, cancel := api.context()
+	defer cancel()
+	queue, errObj := api.lookup(ctx, *key)
+	if errObj != nil {
+		return nil, errObj
+	}
+	if queue == nil {
+		return nil, &jrpc2.ErrorObject{
+			Code:    QueueNotFoundCode,
+			Message: QueueNotFoundMsg,
+		}
+	}
+	defer queue.Unlock()
+
+	state := queue.clone()
+	dead, err := op(queue, *id)
+	if err != nil {
+		return nil, &jrpc2.ErrorObject{
+			Code:    LeaseNotFoundCode,
+			Message: LeaseNotFoundMsg,
+			Data:    *id,
+		}
+	}
+	var dlqState *PriorityQueue
+	if dead != nil {
+		if dlqState, err = api.deadLetter(ctx, queue, []*Task{dead}); err != nil {
+			queue.rollback(state)
+			return nil, storageError(err)
+		}
+	}
+	released := &Op{Type: OpAck, Id: *id}
+	if i, ok := queue.index[*id]; ok {
+		released = NackOp(queue.heap[i])
+	}
+	undo := func() { queue.rollback(state) }
+	if errObj := api.commit(ctx, queue, undo, released); errObj != nil {
+		if dead != nil {
+			api.undoDeadLetter(ctx, queue, dlqState)
+		}
+		return nil, errObj
+	}
+	api.handoff(ctx, queue)
+	return 0, nil
+}
+
+// reservedKey returns an invalid params error if the key is the key of
+// a dead letter queue.  Dead letter queues can be read by key but are
+// only changed through the dead letter methods of their queue.
+func reservedKey(key string) *jrpc2.ErrorObject {
+	if strings.HasSuffix(key, DeadLetterSuffix) {
+		return &jrpc2.ErrorObject{
+			Code:    jrpc2.InvalidParamsCode,
+			Message: jrpc2.InvalidParamsMsg,
+			Data:    "dead letter queue keys are reserved",
+		}
+	}
+	return nil
+}
+
+// ListDeadParams contains the rpc parameters for the ListDead method.
+type ListDeadParams struct {
+	// Key is the queue key.
+	Key *string `json:"key"`
+}
+
+// FromPositional parses the key from the positional parameters.
+func (params *ListDeadParams) FromPositional(args []interface{}) error {
+	if len(args) != 1 {
+		return errors.New("key parameter is required")
+	}
+	key := args[0].(string)
+	params.Key = &key
+
+	return nil
+}
+
+// ListDead returns the dead lettered tasks of a queue in priority order.
+func (api *ApiV1) ListDead(params json.RawMessage) (interface{}, *jrpc2.ErrorObject) {
+	p := new(ListDeadParams)
+	if err := jrpc2.ParseParams(params, p); err != nil {
+		return nil, err
+	}
+	if p.Key == nil {
+		return nil, &jrpc2.ErrorObject{
+			Code:    jrpc2.InvalidParamsCode,
+			Message: jrpc2.InvalidParamsMsg,
+			Data:    "queue key is required",
+		}
+	}
+	if errObj := reservedKey(*p.Key); errObj != nil {
+		return nil, errObj
+	}
+	ctx, cancel := api.context()
+	defer cancel()
+	dlq, errObj := api.lookup(ctx, DeadLetterKey(*p.Key))
+	if errObj != nil {
+		return nil, errObj
+	}
+	if dlq == nil {
+		return make([]*Task, 0), nil
+	}
+	defer dlq.Unlock()
+	return dlq.Copy().Sorted(), nil
+}
+
+// RequeueDeadParams contains the rpc parameters for the RequeueDead
+// method.
+type RequeueDeadParams struct {
+	// Key is the queue key.
+	// Id the id of the dead lettered task.  All tasks are requeued if
+	// the id is omitted.
+	Key *string `json:"key"`
+	Id  *string `json:"id"`
+}
+
+// FromPositional parses the key and optional id from the positional
+// parameters.
+func (params *RequeueDeadParams) FromPositional(args []interface{}) error {
+	if len(args) != 1 && len(args) != 2 {
+		return errors.New("key parameter is required")
+	}
+	key := args[0].(string)
+	params.Key = &key
+	if len(args) == 2 {
+		id := args[1].(string)
+		params.Id = &id
+	}
+
+	return nil
+}
+
+// RequeueDead moves dead lettered tasks back to their queue with the
+// attempts reset.  Tasks whose id is queued again are left dead
+// lettered if the queue rejects duplicates.  The number of requeued
+// tasks is returned.
+func (api *ApiV1) RequeueDead(params json.RawMessage) (interface{}, *jrpc2.ErrorObject) {
+	p := new(RequeueDeadParams)
+	if err := jrpc2.ParseParams(params, p); err != nil {
+		return nil, err
+	}
+	if p.Key == nil {
+		return nil, &jrpc2.ErrorObject{
+			Code:    jrpc2.InvalidParamsCode,
+			Message: jrpc2.InvalidParamsMsg,
+			Data:    "queue key is required",
+		}
+	}
+	if errObj := reservedKey(*p.Key); errObj != nil {
+		return nil, errObj
+	}
+	// the queue is locked before its dead letter queue, so the dead
+	// letter queue is looked up again once the queue is locked.
+	ctx, cancel := api.context()
+	defer cancel()
+	dlq, errObj := api.lookup(ctx, DeadLetterKey(*p.Key))
+	if errObj != nil {
+		return nil, errObj
+	}
+	if dlq == nil {
+		return 0, nil
+	}
+	dlq.Unlock()
+	queue, errObj := api.lookupOrCreate(ctx, *p.Key)
+	if errObj != nil {
+		return nil, errObj
+	}
+	defer queue.Unlock()
+	dlq, errObj = api.lookup(ctx, DeadLetterKey(*p.Key))
+	if errObj != nil {
+		return nil, errObj
+	}
+	if dlq == nil {
+		return 0, nil
+	}
+	defer dlq.Unlock()
+
+	state, dlqState := queue.clone(), dlq.clone()
+	n := 0
+	for _, task := range dlq.Copy().Sorted() {
+		if p.Id != nil && task.Id != *p.Id {
+			continue
+		}
+		task.Attempts = 0
+		task.EffectivePriority = nil
+		if _, err := queue.Push(task); err != nil {
+			continue
+		}
+		dlq.Remove(task.Id)
+		n++
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	if errObj := api.save(ctx, queue, state); errObj != nil {
+		dlq.rollback(dlqState)
+		return nil, errObj
+	}
+	if errObj := api.save(ctx, dlq, dlqState); errObj != nil {
+		// the queue is saved first, so a failure leaves the tasks in
+		// both queues rather than in neither.
+		queue.rollback(state)
+		if errObj := api.save(ctx, queue, nil); errObj != nil {
+			log.Printf("failed to undo requeue of dead lettered tasks of queue [%s], they remain in both queues: %v",
+				queue.Key, errObj.Data)
+		}
+		return nil, errObj
+	}
+	api.handoff(ctx, queue)
+	return n, nil
+}
+
+// PurgeDeadParams contains the rpc parameters for the PurgeDead method.
+type PurgeDeadParams struct {
+	// Key is the queue key.
+	// Id the id of the dead lettered task.  All tasks are purged if the
+	// id is omitted.
+	Key *string `json:"key"`
+	Id  *string `json:"id"`
+}
+
+// FromPositional parses the key and optional id from the positional
+// parameters.
+func (params *PurgeDeadParams) FromPositional(args []interface{}) error {
+	if len(args) != 1 && len(args) != 2 {
+		return errors.New("key parameter is required")
+	}
+	key := args[0].(string)
+	params.Key = &key
+	if len(args) == 2 {
+		id := args[1].(string)
+		params.Id = &id
+	}
+
+	return nil
+}
+
+// PurgeDead discards dead lettered tasks and returns the number of
+// purged tasks.
+func (api *ApiV1) PurgeDead(params json.RawMessage) (interface{}, *jrpc2.ErrorObject) {
+	p := new(PurgeDeadParams)
+	if err := jrpc2.ParseParams(params, p); err != nil {
+		return nil, err
+	}
+	if p.Key == nil {
+		return nil, &jrpc2.ErrorObject{
+			Code:    jrpc2.InvalidParamsCode,
+			Message: jrpc2.InvalidParamsMsg,
+			Data:    "queue key is required",
+		}
+	}
+	if errObj := reservedKey(*p.Key); errObj != nil {
+		return nil, errObj
+	}
+	ctx, cancel := api.context()
+	defer cancel()
+	dlq, errObj := api.lookup(ctx, DeadLetterKey(*p.Key))
+	if errObj != nil {
+		return nil, errObj
+	}
+	if dlq == nil {
+		return 0, nil
+	}
+	defer dlq.Unlock()
+
+	state := dlq.clone()
+	n := 0
+	if p.Id != nil {
+		if err := dlq.Remove(*p.Id); err == nil {
+			n = 1
+		}
+	} else {
+		n = dlq.Clear()
+	}
+	if n > 0 {
+		if errObj := api.save(ctx, dlq, state); errObj != nil {
+			return nil, errObj
+		}
+	}
+	return n, nil
+}
+
+// ClearParams contains the rpc parameters for the Clear method.
+type ClearParams struct {
+	// Key is the queue key.
+	Key *string `json:"key"`
+}
+
+// FromPositional parses the key from the positional parameters.
+func (params *ClearParams) FromPositional(args []interface{}) error {
+	if len(args) != 1 {
+		return errors.New("key parameter is required")
+	}
+	key := args[0].(string)
+	params.Key = &key
+
+	return nil
+}
+
+// Clear discards the queued and leased tasks of the queue and returns
+// the number of discarded tasks.  The configuration and the dead
+// lettered tasks of the queue are kept.
+func (api *ApiV1) Clear(params json.RawMessage) (interface{}, *jrpc2.ErrorObject) {
+	p := new(ClearParams)
+	if err := jrpc2.ParseParams(params, p); err != nil {
+		return nil, err
+	}
+	if p.Key == nil {
+		return nil, &jrpc2.ErrorObject{
+			Code:    jrpc2.InvalidParamsCode,
+			Message: jrpc2.InvalidParamsMsg,
+			Data:    "queue key is required",
+		}
+	}
+	if errObj := reservedKey(*p.Key); errObj != nil {
+		return nil, errObj
+	}
+	ctx, cancel := api.context()
+	defer cancel()
+	queue, errObj := api.lookup(ctx, *p.Key)
+	if errObj != nil {
+		return nil, errObj
+	}
+	if queue == nil {
+		return nil, &jrpc2.ErrorObject{
+			Code:    QueueNotFoundCode,
+			Message: QueueNotFoundMsg,
+		}
+	}
+	defer queue.Unlock()
+
+	state := queue.clone()
+	n := queue.Clear()
+	if n > 0 {
+		undo := func() { queue.rollback(state) }
+		if errObj := api.commit(ctx, queue, undo, &Op{Type: OpClear}); errObj != nil {
+			return nil, errObj
+		}
+	}
+	return n, nil
+}
+
+// DeleteParams contains the rpc parameters for the Delete method.
+type DeleteParams struct {
+	// Key is the queue key.
+	Key *string `json:"key"`
+}
+
+// FromPositional parses the key from the positional parameters.
+func (params *DeleteParams) FromPositional(args []interface{}) error {
+	if len(args) != 1 {
+		return errors.New("key parameter is required")
+	}
+	key := args[0].(string)
+	params.Key = &key
+
+	return nil
+}
+
+// Delete removes the queue and its dead letter queue from memory and
+// storage.  Consumers waiting on the queue are released with no task.
+func (api *ApiV1) Delete(params json.RawMessage) (interface{}, *jrpc2.ErrorObject) {
+	p := new(DeleteParams)
+	if err := jrpc2.ParseParams(params, p); err != nil {
+		return nil, err
+	}
+	if p.Key == nil {
+		return nil, &jrpc2.ErrorObject{
+			Code:    jrpc2.InvalidParamsCode,
+			Message: jrpc2.InvalidParamsMsg,
+			Data:    "queue key is required",
+		}
+	}
+	if errObj := reservedKey(*p.Key); errObj != nil {
+		return nil, errObj
+	}
+	ctx, cancel := api.context()
+	defer cancel()
+	queue, errObj := api.lookup(ctx, *p.Key)
+	if errObj != nil {
+		return nil, errObj
+	}
+	if queue == nil {
+		return nil, &jrpc2.ErrorObject{
+			Code:    QueueNotFoundCode,
+			Message: QueueNotFoundMsg,
+		}
+	}
+	defer queue.Unlock()
+	dlq, errObj := api.lookup(ctx, DeadLetterKey(*p.Key))
+	if errObj != nil {
+		return nil, errObj
+	}
+
+	// the dead letter queue is deleted first, so that a failed delete
+	// leaves the queue in place to be deleted again.
+	if dlq != nil {
+		errObj := api.drop(ctx, dlq)
+		dlq.Unlock()
+		if errObj != nil {
+			return nil, errObj
+		}
+	}
+	if errObj := api.drop(ctx, queue); errObj != nil {
+		return nil, errObj
+	}
+	return 0, nil
+}
+
+// drop deletes the queue from storage and unregisters it.  Waiters of
+// the queue are released with no task.  The caller must hold the queue
+// lock.
+func (api *ApiV1) drop(ctx context.Context, queue *PriorityQueue) *jrpc2.ErrorObject {
+	if err := api.model.Delete(ctx, queue); err != nil {
+		log.Printf("failed to delete queue [%s]: %v", queue.Key, err)
+		if errors.Is(err, ErrConflict) {
+			api.reload(ctx, queue)
+		}
+		return storageError(err)
+	}
+	queue.release()
+	queue.evicted = true
+	api.queues.Remove(queue)
+	log.Printf("deleted queue [%s]", queue.Key)
+	return nil
+}
+
+// deadLetter moves the tasks to the dead letter queue of the queue and
+// returns the state of the dead letter queue before the change.  The
+// caller must hold the queue lock.  If the dead letter queue cannot be
+// saved it is rolled back and the error is returned.
+func (api *ApiV1) deadLetter(ctx context.Context, queue *PriorityQueue, tasks []*Task) (*PriorityQueue, error) {
+	if len(tasks) == 0 {
+		return nil, nil
+	}
+	dlq, err := api.acquire(ctx, DeadLetterKey(queue.Key), true)
+	if err != nil {
+		return nil, err
+	}
+	defer dlq.Unlock()
+	state := dlq.clone()
+	dlq.Config.Duplicates = DuplicateReplace
+	for _, task := range tasks {
+		dlq.Push(task)
+		log.Printf("dead lettered task [%s] from queue [%s]", task.Id, queue.Key)
+	}
+	if _, err := dlq.Save(ctx, api.model); err != nil {
+		dlq.rollback(state)
+		if errors.Is(err, ErrConflict) {
+			api.reload(ctx, dlq)
+		}
+		return nil, err
+	}
+	return state, nil
+}
+
+// undoDeadLetter restores the dead letter queue of the queue to the
+// state returned by deadLetter after the queue could not be saved.  The
+// caller must hold the queue lock.  A failure is only logged, as the
+// tasks are then both in the queue and dead lettered rather than lost.
+func (api *ApiV1) undoDeadLetter(ctx context.Context, queue *PriorityQueue, state *PriorityQueue) {
+	dlq, err := api.acquire(ctx, DeadLetterKey(queue.Key), false)
+	if err != nil {
+		log.Printf("failed to undo dead lettering of queue [%s]: %v", queue.Key, err)
+		return
+	}
+	if dlq == nil {
+		return
+	}
+	defer dlq.Unlock()
+	dlq.rollback(state)
+	if _, err := dlq.Save(ctx, api.model); err != nil {
+		log.Printf("failed to undo dead lettering of queue [%s]: %v", queue.Key, err)
+		if errors.Is(err, ErrConflict) {
+			api.reload(ctx, dlq)
+		}
+	}
+}
+
+// ExpiredParams contains the rpc parameters for the Expired method.
+type ExpiredParams struct {
+	// Key is the queue key.
+	Key *string `json:"key"`
+}
+
+// FromPositional parses the key from the positional parameters.
+func (params *ExpiredParams) FromPositional(args []interface{}) error {
+	if len(args) != 1 {
+		return errors.New("key parameter is required")
+	}
+	key := args[0].(string)
+	params.Key = &key
+
+	return nil
+}
+
+// Expired returns the recorded ids of tasks that expired in the queue,
+// oldest first.
+func (api *ApiV1) Expired(params json.RawMessage) (interface{}, *jrpc2.ErrorObject) {
+	p := new(ExpiredParams)
+	if err := jrpc2.ParseParams(params, p); err != nil {
+		return nil, err
+	}
+	if p.Key == nil {
+		return nil, &jrpc2.ErrorObject{
+			Code:    jrpc2.InvalidParamsCode,
+			Message: jrpc2.InvalidParamsMsg,
+			Data:    "queue key is required",
+		}
+	}
+	ctx, cancel := api.context()
+	defer cancel()
+	queue, errObj := api.lookup(ctx, *p.Key)
+	if errObj != nil {
+		return nil, errObj
+	}
+	if queue == nil {
+		return nil, &jrpc2.ErrorObject{
+			Code:    QueueNotFoundCode,
+			Message: QueueNotFoundMsg,
+		}
+	}
+	defer queue.Unlock()
+	return queue.ExpiredIds(), nil
+}
+
+// Sweep requeues the tasks of leases that expired at or before now,
+// purges the expired tasks, and hands off tasks that became eligible to
+// waiting consumers in every queue.  Tasks that reached the queue max
+// attempts are dead lettered.  If queues are loaded lazily the stored
+// queues that must be swept are loaded first.
+func (api *ApiV1) Sweep(now time.Time) {
+	if api.lazy && !api.swept.Load() {
+		api.loadSwept()
+	}
+	for _, queue := range api.queues.List() {
+		api.sweepQueue(queue, now)
+	}
+	if l, ok := api.model.(OpLog); ok {
+		ctx, cancel := api.context()
+		defer cancel()
+		if err := l.Compact(ctx, api.queues.List); err != nil {
+			log.Printf("failed to compact the operation log: %v", err)
+		}
+	}
+}
+
+// sweepQueue sweeps the queue at now.
+func (api *ApiV1) sweepQueue(queue *PriorityQueue, now time.Time) {
+	queue.Lock()
+	defer queue.Unlock()
+	if queue.evicted {
+		return
+	}
+	ctx, cancel := api.context()
+	defer cancel()
+	ids, dead := queue.RequeueExpired(now)
+	ops := make([]*Op, 0, len(ids)+len(dead))
+	for _, id := range ids {
+		ops = append(ops, NackOp(queue.heap[queue.index[id]]))
+	}
+	// the dead tasks are stored in the dead letter queue before they are
+	// removed from the stored queue, so a failure never loses them.
+	if _, err := api.deadLetter(ctx, queue, dead); err != nil {
+		// keep the tasks rather than lose them, they are dead lettered
+		// again when they are next released.
+		log.Printf("failed to dead letter tasks of queue [%s]: %v", queue.Key, err)
+		for _, task := range dead {
+			queue.put(task)
+			ops = append(ops, NackOp(task))
+		}
+	} else {
+		for _, task := range dead {
+			ops = append(ops, &Op{Type: OpAck, Id: task.Id})
+		}
+	}
+	ops = append(ops, ExpireOps(queue.RemoveExpired(now)...)...)
+	ops = append(ops, PopOps(queue.Handoff()...)...)
+	if len(ops) > 0 {
+		if err := api.persist(ctx, queue, ops...); errors.Is(err, ErrConflict) {
+			// the stored queue still holds the swept tasks, they are
+			// swept again on the next run and replace their dead
+			// lettered copies.
+			api.reload(ctx, queue)
+			return
+		} else if err != nil {
+			log.Printf("failed to persist sweep of queue [%s]: %v", queue.Key, err)
+		}
+	}
+	api.autoDelete(ctx, queue, now)
+}
+
+// autoDelete deletes the queue once it has been found empty for the
+// auto delete duration of its config.  Queues with dead lettered tasks
+// are kept.  The caller must hold the queue lock.
+func (api *ApiV1) autoDelete(ctx context.Context, queue *PriorityQueue, now time.Time) {
+	if queue.Config.AutoDelete <= 0 {
+		return
+	}
+	if queue.count > 0 || len(queue.inflight) > 0 || len(queue.waiters) > 0 {
+		queue.emptyAt = time.Time{}
+		return
+	}
+	if queue.emptyAt.IsZero() {
+		queue.emptyAt = now
+	}
+	if now.Sub(queue.emptyAt) < time.Duration(queue.Config.AutoDelete*float64(time.Second)) {
+		return
+	}
+	dlq, err := api.acquire(ctx, DeadLetterKey(queue.Key), false)
+	if err != nil {
+		log.Printf("failed to auto delete queue [%s]: %v", queue.Key, err)
+		return
+	}
+	if dlq != nil {
+		defer dlq.Unlock()
+		if dlq.count > 0 || api.drop(ctx, dlq) != nil {
+			return
+		}
+	}
+	api.drop(ctx, queue)
+}
+
+// Close stops the background sweeper.
+func (api *ApiV1) Close() {
+	close(api.done)
+}
+
+// sweep runs Sweep at every sweep interval until the api is closed.
+func (api *ApiV1) sweep() {
+	ticker := time.NewTicker(SweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			api.Sweep(now)
+		case <-api.done:
+			return
+		}
+	}
+}
+
+// NewApiV1 returns a new api version 1 rpc api instance with the default
+// options.  It panics if the queues cannot be loaded, callers that must
+// handle the error use NewApiV1WithOptions.
+func NewApiV1(model Model, s *jrpc2.Server) *ApiV1 {
+	api, err := NewApiV1WithOptions(model, s, ApiOptions{})
+	if err != nil {
+		panic(err)
+	}
+	return api
+}
+
+// NewApiV1WithOptions returns a new api version 1 rpc api instance
+// configured by opts.  All queues are loaded at startup unless opts
+// selects lazy loading, and an error is returned if they cannot be
+// loaded or migrated.
+func NewApiV1WithOptions(model Model, s *jrpc2.Server, opts ApiOptions) (*ApiV1, error) {
+	api := newApiV1(model, opts)
+	if !api.lazy {
+		queues, err := model.FetchAll(context.Background())
+		if err != nil {
+			return nil, fmt.Errorf("failed to load queues: %w", err)
+		}
+		for _, queue := range queues {
+			v, _ := queue.(*PriorityQueue)
+			api.queues.Add(v)
+		}
+		if _, err := Migrate(context.Background(), model, api.queues.List()); err != nil {
+			return nil, fmt.Errorf("failed to migrate queues: %w", err)
+		}
+	}
+	api.register(s)
+	return api, nil
+}
+
+// newApiV1 returns an api instance configured by opts without loaded
+// queues.
+func newApiV1(model Model, opts ApiOptions) *ApiV1 {
+	api := &ApiV1{
+		model:      model,
+		queues:     NewQueueRegistry(),
+		done:       make(chan struct{}),
+		maxPayload: DefaultMaxPayloadSize,
+		timeout:    DefaultStorageTimeout,
+		lazy:       opts.Lazy,
+		maxQueues:  opts.MaxLoadedQueues,
+	}
+	if opts.MaxPayloadSize > 0 {
+		api.maxPayload = opts.MaxPayloadSize
+	}
+	if opts.StorageTimeout > 0 {
+		api.timeout = opts.StorageTimeout
+	}
 	return api
 }
+
+// register registers the rpc methods of the api and starts the sweeper.
+func (api *ApiV1) register(s *jrpc2.Server) {
+	s.Register("configure", jrpc2.Method{Method: api.retryConflicts(api.Configure)})
+	s.Register("ack", jrpc2.Method{Method: api.retryConflicts(api.Ack)})
+	s.Register("clear", jrpc2.Method{Method: api.retryConflicts(api.Clear)})
+	s.Register("delete", jrpc2.Method{Method: api.retryConflicts(api.Delete)})
+	s.Register("expired", jrpc2.Method{Method: api.Expired})
+	s.Register("get", jrpc2.Method{Method: api.Get})
+	s.Register("getAll", jrpc2.Method{Method: api.GetAll})
+	s.Register("lease", jrpc2.Method{Method: api.retryConflicts(api.Lease)})
+	s.Register("listDead", jrpc2.Method{Method: api.ListDead})
+	s.Register("nack", jrpc2.Method{Method: api.retryConflicts(api.Nack)})
+	s.Register("peek", jrpc2.Method{Method: api.Peek})
+	s.Register("pop", jrpc2.Method{Method: api.retryConflicts(api.Pop)})
+	s.Register("popMany", jrpc2.Method{Method: api.retryConflicts(api.PopMany)})
+	s.Register("popWait", jrpc2.Method{Method: api.retryConflicts(api.PopWait)})
+	s.Register("purgeDead", jrpc2.Method{Method: api.retryConflicts(api.PurgeDead)})
+	s.Register("push", jrpc2.Method{Method: api.retryConflicts(api.Push)})
+	s.Register("pushMany", jrpc2.Method{Method: api.retryConflicts(api.PushMany)})
+	s.Register("remove", jrpc2.Method{Method: api.retryConflicts(api.Remove)})
+	s.Register("requeueDead", jrpc2.Method{Method: api.retryConflicts(api.RequeueDead)})
+	s.Register("update", jrpc2.Method{Method: api.retryConflicts(api.Update)})
+	go api.sweep()
+}
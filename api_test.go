@@ -1,8 +1,13 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/bitwurx/jrpc2"
 )
@@ -93,7 +98,8 @@ func TestApiV1Peek(t *testing.T) {
 	if task["priority"].(float64) != 0.5 {
 		t.Fatal("expected task priority to be 0.5")
 	}
-	api.queues["abc"].Pop()
+	queue, _ := api.queues.Get("abc")
+	queue.Pop()
 }
 
 func TestApiV1Pop(t *testing.T) {
@@ -122,6 +128,121 @@ func TestApiV1Pop(t *testing.T) {
 	}
 }
 
+func TestApiV1PopWait(t *testing.T) {
+	api := NewApiV1(&MockModel{}, jrpc2.NewServer("", ""))
+	defer api.Close()
+	result, errObj := api.PopWait([]byte(`{"key": "wait", "timeout": 0.05}`))
+	if errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	if result != nil {
+		t.Fatal("expected timeout to return nil")
+	}
+	api.Push([]byte(`{"key": "wait", "id": "ready", "priority": 1.5}`))
+	result, _ = api.PopWait([]byte(`["wait", 1]`))
+	if task := result.(*Task); task.Id != "ready" {
+		t.Fatal("expected queued task to be returned immediately")
+	}
+
+	results := make([]chan interface{}, 3)
+	for i := range results {
+		results[i] = make(chan interface{}, 1)
+		go func(ch chan interface{}) {
+			result, _ := api.PopWait([]byte(`{"key": "wait", "timeout": 5}`))
+			ch <- result
+		}(results[i])
+		// wait for the waiter to register so the order is deterministic.
+		for {
+			queue, _ := api.queues.Get("wait")
+			queue.Lock()
+			n := len(queue.waiters)
+			queue.Unlock()
+			if n == i+1 {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	for i := range results {
+		api.Push([]byte(fmt.Sprintf(`{"key": "wait", "id": "%d", "priority": %d}`, i, 10-i)))
+	}
+	for i, ch := range results {
+		select {
+		case result := <-ch:
+			if task := result.(*Task); task.Id != fmt.Sprint(i) {
+				t.Fatalf("expected waiter %d to receive task [%d], got [%s]", i, i, task.Id)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("expected waiter to be woken by push")
+		}
+	}
+}
+
+func TestApiV1PopWaitMissingQueue(t *testing.T) {
+	api := NewApiV1(&MockModel{}, jrpc2.NewServer("", ""))
+	defer api.Close()
+	result, _ := api.PopWait([]byte(`{"key": "missing", "timeout": 0.01}`))
+	if result != nil {
+		t.Fatal("expected timeout to return nil")
+	}
+	if _, ok := api.queues.Get("missing"); ok {
+		t.Fatal("expected popWait not to create the queue")
+	}
+	if api.queues.Waiting("missing", nil) || len(api.queues.pending) != 0 {
+		t.Fatal("expected timed out waiter to be unregistered")
+	}
+
+	done := make(chan interface{}, 1)
+	go func() {
+		result, _ := api.PopWait([]byte(`{"key": "missing", "timeout": 5}`))
+		done <- result
+	}()
+	for {
+		api.queues.mu.RLock()
+		n := len(api.queues.pending["missing"])
+		api.queues.mu.RUnlock()
+		if n > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	api.Push([]byte(`{"key": "missing", "id": "a", "priority": 1.5}`))
+	select {
+	case result := <-done:
+		if task, ok := result.(*Task); !ok || task.Id != "a" {
+			t.Fatal("expected waiter to receive the pushed task")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected waiter to be woken by push")
+	}
+	queue, _ := api.queues.Get("missing")
+	if queue.count != 0 {
+		t.Fatal("expected handed off task to be removed")
+	}
+}
+
+func TestApiV1PopWaitTimedOut(t *testing.T) {
+	api := NewApiV1(&MockModel{}, jrpc2.NewServer("", ""))
+	defer api.Close()
+	api.Push([]byte(`{"key": "gone", "id": "a", "priority": 1.5}`))
+	api.Pop([]byte(`["gone"]`))
+	queue, _ := api.queues.Get("gone")
+	w := NewWaiter()
+	queue.Lock()
+	queue.Wait(w)
+	queue.Unlock()
+	// the waiter is registered but no longer receiving.
+	api.Push([]byte(`{"key": "gone", "id": "b", "priority": 1.5}`))
+	if queue.count != 1 {
+		t.Fatal("expected task to stay queued for a waiter that is not receiving")
+	}
+	api.cancelWait("gone", w)
+	result, _ := api.Pop([]byte(`["gone"]`))
+	if task, ok := result.(*Task); !ok || task.Id != "b" {
+		t.Fatal("expected task to be popped after the waiter left")
+	}
+}
+
 func TestApiV1Push(t *testing.T) {
 	api := NewApiV1(&MockModel{}, jrpc2.NewServer("", ""))
 	result, err := api.Push([]byte(`{"key": "test1", "id": "abc123", "priority": 2.3}`))
@@ -133,6 +254,151 @@ func TestApiV1Push(t *testing.T) {
 	}
 }
 
+func TestApiV1PushPayload(t *testing.T) {
+	api, _ := NewApiV1WithOptions(&MockModel{}, jrpc2.NewServer("", ""), ApiOptions{MaxPayloadSize: 32})
+	defer api.Close()
+	_, errObj := api.Push([]byte(`{"key": "payload", "id": "a", "priority": 1,
+		"payload": {"args": ["a", "b"]}, "labels": {"team": "x"}}`))
+	if errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	_, errObj = api.Push([]byte(`{"key": "payload", "id": "b", "priority": 1,
+		"payload": {"args": ["a very long argument to exceed the limit"]}}`))
+	if errObj == nil || errObj.Code != jrpc2.InvalidParamsCode {
+		t.Fatal("expected oversized payload to be rejected")
+	}
+	_, errObj = api.Push([]byte(`{"key": "payload", "id": "c", "priority": 1, "labels": {"n": 1}}`))
+	if errObj == nil {
+		t.Fatal("expected non string label to be rejected")
+	}
+	result, _ := api.Pop([]byte(`{"key": "payload"}`))
+	data, _ := json.Marshal(result)
+	if string(data) != `{"_key":"a","priority":1,"seq":0,"attempts":0,"enqueuedAt":"`+
+		result.(*Task).EnqueuedAt.Format(time.RFC3339Nano)+`","payload":{"args":["a","b"]},"labels":{"team":"x"}}` {
+		t.Fatalf("expected popped task to carry payload and labels, got %s", data)
+	}
+}
+
+func TestApiV1Selector(t *testing.T) {
+	api := NewApiV1(&MockModel{}, jrpc2.NewServer("", ""))
+	defer api.Close()
+	api.Push([]byte(`{"key": "select", "id": "gpu", "priority": 1, "labels": {"gpu": "true"}}`))
+	api.Push([]byte(`{"key": "select", "id": "cpu", "priority": 2, "labels": {"gpu": "false", "region": "eu"}}`))
+
+	result, _ := api.Peek([]byte(`["select", {"gpu": "false"}]`))
+	if task := result.(*Task); task.Id != "cpu" {
+		t.Fatal("expected peek to return the matching task")
+	}
+	if _, errObj := api.Peek([]byte(`["select", {"gpu": false}]`)); errObj == nil {
+		t.Fatal("expected non string selector value to be rejected")
+	}
+	result, _ = api.Pop([]byte(`{"key": "select", "selector": {"region": "us"}}`))
+	if result.(*Task) != nil {
+		t.Fatal("expected pop without a matching task to return nil")
+	}
+	result, _ = api.Pop([]byte(`{"key": "select", "selector": {"gpu": "false", "region": "eu"}}`))
+	if task := result.(*Task); task.Id != "cpu" {
+		t.Fatal("expected pop to remove the matching task")
+	}
+	result, _ = api.Pop([]byte(`["select", null]`))
+	if task := result.(*Task); task.Id != "gpu" {
+		t.Fatal("expected null selector to match any task")
+	}
+}
+
+func TestApiV1PushMany(t *testing.T) {
+	api := NewApiV1(&MockModel{}, jrpc2.NewServer("", ""))
+	defer api.Close()
+	api.Configure([]byte(`{"key": "batch", "config": {"duplicates": "reject"}}`))
+	api.Push([]byte(`{"key": "batch", "id": "a", "priority": 1}`))
+
+	_, errObj := api.PushMany([]byte(`{"key": "batch", "atomic": true, "tasks": [
+		{"id": "b", "priority": 2}, {"id": "a", "priority": 3}]}`))
+	if errObj == nil || errObj.Code != DuplicateTaskCode {
+		t.Fatal("expected atomic batch with duplicate to be rejected")
+	}
+	results := errObj.Data.([]*PushManyResult)
+	if results[0].Error != nil || results[1].Error == nil {
+		t.Fatal("expected only the duplicate task to be reported")
+	}
+	_, errObj = api.PushMany([]byte(`{"key": "batch", "atomic": true, "tasks": [
+		{"id": "b", "priority": 2}, {"id": "b", "priority": 3}]}`))
+	if errObj == nil || errObj.Code != DuplicateTaskCode {
+		t.Fatal("expected atomic batch with repeated id to be rejected")
+	}
+	_, errObj = api.PushMany([]byte(`["batch", [{"id": "b", "priority": 2}, {"id": "c"}], true]`))
+	if errObj == nil || errObj.Code != jrpc2.InvalidParamsCode {
+		t.Fatal("expected atomic batch with invalid task to be rejected")
+	}
+	if queue, _ := api.queues.Get("batch"); queue.count != 1 {
+		t.Fatal("expected rejected atomic batches to push no tasks")
+	}
+
+	result, errObj := api.PushMany([]byte(`{"key": "batch", "tasks": [
+		{"id": "b", "priority": 2}, {"id": "a", "priority": 3}, {"priority": 4}]}`))
+	if errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	results = result.([]*PushManyResult)
+	if results[0].Result == nil || *results[0].Result != int(PushInserted) {
+		t.Fatal("expected task [b] to be inserted")
+	}
+	if results[1].Error == nil || results[1].Error.Code != DuplicateTaskCode {
+		t.Fatal("expected task [a] to be reported as a duplicate")
+	}
+	if results[2].Error == nil || results[2].Error.Code != jrpc2.InvalidParamsCode {
+		t.Fatal("expected task without id to be reported as invalid")
+	}
+	if queue, _ := api.queues.Get("batch"); queue.count != 2 {
+		t.Fatal("expected valid tasks of the batch to be pushed")
+	}
+
+	_, errObj = api.PushMany([]byte(`["new", [{"id": "a", "priority": 1}, {"id": "b"}], true]`))
+	if errObj == nil || errObj.Code != jrpc2.InvalidParamsCode {
+		t.Fatal("expected atomic batch with invalid task to be rejected")
+	}
+	if _, ok := api.queues.Get("new"); ok {
+		t.Fatal("expected rejected atomic batch not to create the queue")
+	}
+	for _, batch := range []string{`["new", [{"id": "a"}, {"priority": 1}]]`, `["new", []]`} {
+		result, errObj := api.PushMany([]byte(batch))
+		if errObj != nil {
+			t.Fatal(errObj.Message)
+		}
+		if results := result.([]*PushManyResult); len(results) > 0 && results[0].Error == nil {
+			t.Fatal("expected invalid tasks to be reported")
+		}
+		if _, ok := api.queues.Get("new"); ok {
+			t.Fatal("expected batch without valid tasks not to create the queue")
+		}
+	}
+}
+
+func TestApiV1PopMany(t *testing.T) {
+	api := NewApiV1(&MockModel{}, jrpc2.NewServer("", ""))
+	defer api.Close()
+	if _, errObj := api.PopMany([]byte(`["many", 2]`)); errObj == nil || errObj.Code != QueueNotFoundCode {
+		t.Fatal("expected queue not found error")
+	}
+	api.PushMany([]byte(`{"key": "many", "tasks": [{"id": "a", "priority": 3},
+		{"id": "b", "priority": 1}, {"id": "c", "priority": 2}]}`))
+	if _, errObj := api.PopMany([]byte(`["many", 0]`)); errObj == nil || errObj.Code != jrpc2.InvalidParamsCode {
+		t.Fatal("expected non positive n to be rejected")
+	}
+	result, errObj := api.PopMany([]byte(`{"key": "many", "n": 2}`))
+	if errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	tasks := result.([]*Task)
+	if len(tasks) != 2 || tasks[0].Id != "b" || tasks[1].Id != "c" {
+		t.Fatal("expected the two min tasks in priority order")
+	}
+	result, _ = api.PopMany([]byte(`["many", 5]`))
+	if tasks := result.([]*Task); len(tasks) != 1 || tasks[0].Id != "a" {
+		t.Fatal("expected the remaining task")
+	}
+}
+
 func TestApiV1Remove(t *testing.T) {
 	api := NewApiV1(&MockModel{}, jrpc2.NewServer("", ""))
 	result, errObj := api.Push([]byte(`{"key": "test1", "id": "abc123", "priority": 1.3}`))
@@ -170,9 +436,460 @@ func TestApiV1Remove(t *testing.T) {
 	if result != 0 {
 		t.Fatal("expected result to be -1")
 	}
-	for _, task := range api.queues["test1"].List() {
+	queue, _ := api.queues.Get("test1")
+	for _, task := range queue.List() {
 		if task.Id == "abc321" {
 			t.Fatal("expected task with id 'abc321' to be removed")
 		}
 	}
 }
+
+func TestApiV1PushNotBefore(t *testing.T) {
+	api := NewApiV1(&MockModel{}, jrpc2.NewServer("", ""))
+	defer api.Close()
+	future := time.Now().Add(time.Hour).Format(time.RFC3339)
+	push := fmt.Sprintf(`{"key": "delay", "id": "a", "priority": 1.5, "notBefore": "%s"}`, future)
+	if _, errObj := api.Push([]byte(push)); errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	push = fmt.Sprintf(`["delay", "b", 2.5, "%s"]`, time.Now().Format(time.RFC3339))
+	if _, errObj := api.Push([]byte(push)); errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	result, errObj := api.Pop([]byte(`{"key": "delay"}`))
+	if errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	if task := result.(*Task); task.Id != "b" {
+		t.Fatal("expected delayed task 'a' to be skipped")
+	}
+	result, _ = api.Pop([]byte(`{"key": "delay"}`))
+	if result.(*Task) != nil {
+		t.Fatal("expected no eligible task")
+	}
+}
+
+func TestApiV1Expired(t *testing.T) {
+	api := NewApiV1(&MockModel{}, jrpc2.NewServer("", ""))
+	defer api.Close()
+	api.Configure([]byte(`{"key": "ttl", "config": {"recordExpired": true}}`))
+	if _, errObj := api.Push([]byte(`{"key": "ttl", "id": "a", "priority": 1.5, "ttl": 10}`)); errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	expiresAt := time.Now().Add(time.Minute).Format(time.RFC3339)
+	push := fmt.Sprintf(`["ttl", "b", 2.5, null, "%s"]`, expiresAt)
+	if _, errObj := api.Push([]byte(push)); errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	api.Push([]byte(`{"key": "ttl", "id": "c", "priority": 3.5}`))
+	_, errObj := api.Push([]byte(`{"key": "ttl", "id": "d", "priority": 1.5, "ttl": -1}`))
+	if errObj == nil || errObj.Code != jrpc2.InvalidParamsCode {
+		t.Fatal("expected invalid params error")
+	}
+	api.Sweep(time.Now().Add(20 * time.Second))
+	result, errObj := api.Expired([]byte(`["ttl"]`))
+	if errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	if ids := result.([]string); len(ids) != 1 || ids[0] != "a" {
+		t.Fatal("expected task 'a' to be expired")
+	}
+	api.Sweep(time.Now().Add(2 * time.Minute))
+	result, _ = api.Expired([]byte(`{"key": "ttl"}`))
+	if ids := result.([]string); len(ids) != 2 || ids[1] != "b" {
+		t.Fatal("expected task 'b' to be expired")
+	}
+	queue, _ := api.queues.Get("ttl")
+	if queue.count != 1 || queue.Peek().Id != "c" {
+		t.Fatal("expected task 'c' to remain queued")
+	}
+}
+
+func TestApiV1Aging(t *testing.T) {
+	api := NewApiV1(&MockModel{}, jrpc2.NewServer("", ""))
+	defer api.Close()
+	api.Push([]byte(`{"key": "aging", "id": "a", "priority": 5.5}`))
+	_, errObj := api.Configure([]byte(`{"key": "aging", "config": {"aging": {"rate": -1}}}`))
+	if errObj == nil || errObj.Code != jrpc2.InvalidParamsCode {
+		t.Fatal("expected invalid params error")
+	}
+	if _, errObj := api.Configure([]byte(`{"key": "aging", "config": {"aging": {"rate": 1, "max": 2}}}`)); errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	result, errObj := api.Peek([]byte(`{"key": "aging"}`))
+	if errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	task := result.(*Task)
+	if task.Priority != 5.5 || task.EffectivePriority == nil || *task.EffectivePriority > 5.5 {
+		t.Fatal("expected peek to report the original and effective priority")
+	}
+}
+
+func TestApiV1Update(t *testing.T) {
+	api := NewApiV1(&MockModel{}, jrpc2.NewServer("", ""))
+	api.Push([]byte(`{"key": "update", "id": "a", "priority": 1.5}`))
+	api.Push([]byte(`{"key": "update", "id": "b", "priority": 4.5}`))
+	result, errObj := api.Update([]byte(`{"key": "update", "id": "missing", "priority": 0.5}`))
+	if errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	if result != -1 {
+		t.Fatal("expected result to be -1")
+	}
+	result, errObj = api.Update([]byte(`["update", "b", 0.5]`))
+	if errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	if result != 0 {
+		t.Fatal("expected result to be 0")
+	}
+	queue, _ := api.queues.Get("update")
+	if queue.Peek().Id != "b" {
+		t.Fatal("expected task 'b' to be at the front of the queue")
+	}
+	_, errObj = api.Update([]byte(`{"key": "nope", "id": "b", "priority": 0.5}`))
+	if errObj == nil || errObj.Code != QueueNotFoundCode {
+		t.Fatal("expected queue not found error")
+	}
+}
+
+func TestApiV1PushDuplicate(t *testing.T) {
+	api := NewApiV1(&MockModel{}, jrpc2.NewServer("", ""))
+	api.Push([]byte(`{"key": "dup", "id": "a", "priority": 4.5}`))
+	result, errObj := api.Push([]byte(`{"key": "dup", "id": "a", "priority": 3.5}`))
+	if errObj != nil || result != int(PushReplaced) {
+		t.Fatal("expected push to replace the queued task by default")
+	}
+	api.Configure([]byte(`["dup", {"duplicates": "reject"}]`))
+	_, errObj = api.Push([]byte(`{"key": "dup", "id": "a", "priority": 2.5}`))
+	if errObj == nil || errObj.Code != DuplicateTaskCode {
+		t.Fatal("expected duplicate task error")
+	}
+	result, errObj = api.Configure([]byte(`["dup", {"duplicates": "min"}]`))
+	if errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	if result != 0 {
+		t.Fatal("expected result to be 0")
+	}
+	result, errObj = api.Push([]byte(`{"key": "dup", "id": "a", "priority": 6.5}`))
+	if errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	if result != int(PushIgnored) {
+		t.Fatal("expected push to be ignored")
+	}
+	result, errObj = api.Push([]byte(`{"key": "dup", "id": "a", "priority": 2.5}`))
+	if errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	if result != int(PushReplaced) {
+		t.Fatal("expected push to replace the queued task")
+	}
+	queue, _ := api.queues.Get("dup")
+	if queue.count != 1 || queue.Peek().Priority != 2.5 {
+		t.Fatal("expected a single task with priority 2.5")
+	}
+	_, errObj = api.Configure([]byte(`{"key": "dup", "config": {"duplicates": "bogus"}}`))
+	if errObj == nil || errObj.Code != jrpc2.InvalidParamsCode {
+		t.Fatal("expected invalid params error")
+	}
+}
+
+func TestApiV1Lease(t *testing.T) {
+	api := NewApiV1(&MockModel{}, jrpc2.NewServer("", ""))
+	defer api.Close()
+	api.Push([]byte(`{"key": "lease", "id": "a", "priority": 1.5}`))
+	api.Push([]byte(`{"key": "lease", "id": "b", "priority": 2.5}`))
+	_, errObj := api.Lease([]byte(`{"key": "lease", "ttl": 0}`))
+	if errObj == nil || errObj.Code != jrpc2.InvalidParamsCode {
+		t.Fatal("expected invalid params error")
+	}
+	result, errObj := api.Lease([]byte(`["lease", 30]`))
+	if errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	if lease := result.(*Lease); lease.Task.Id != "a" {
+		t.Fatal("expected lease of task 'a'")
+	}
+	result, errObj = api.Lease([]byte(`{"key": "lease", "ttl": 30}`))
+	if errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	if lease := result.(*Lease); lease.Task.Id != "b" {
+		t.Fatal("expected lease of task 'b'")
+	}
+	result, errObj = api.Lease([]byte(`{"key": "lease", "ttl": 30}`))
+	if errObj != nil || result != nil {
+		t.Fatal("expected lease of empty queue to return nil")
+	}
+	result, errObj = api.Ack([]byte(`{"key": "lease", "id": "a"}`))
+	if errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	if result != 0 {
+		t.Fatal("expected result to be 0")
+	}
+	_, errObj = api.Ack([]byte(`{"key": "lease", "id": "a"}`))
+	if errObj == nil || errObj.Code != LeaseNotFoundCode {
+		t.Fatal("expected lease not found error")
+	}
+	result, errObj = api.Nack([]byte(`["lease", "b"]`))
+	if errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	if result != 0 {
+		t.Fatal("expected result to be 0")
+	}
+	queue, _ := api.queues.Get("lease")
+	if queue.Peek().Id != "b" {
+		t.Fatal("expected nacked task to be requeued")
+	}
+}
+
+func TestApiV1Sweep(t *testing.T) {
+	api := NewApiV1(&MockModel{}, jrpc2.NewServer("", ""))
+	defer api.Close()
+	api.Push([]byte(`{"key": "sweep", "id": "a", "priority": 1.5}`))
+	api.Lease([]byte(`{"key": "sweep", "ttl": 10}`))
+	api.Sweep(time.Now())
+	queue, _ := api.queues.Get("sweep")
+	queue.Lock()
+	if queue.count != 0 {
+		t.Fatal("expected lease to be held")
+	}
+	queue.Unlock()
+	api.Sweep(time.Now().Add(time.Minute))
+	queue.Lock()
+	defer queue.Unlock()
+	if queue.count != 1 || len(queue.inflight) != 0 {
+		t.Fatal("expected expired lease to be requeued")
+	}
+}
+
+func TestApiV1DeadLetter(t *testing.T) {
+	api := NewApiV1(&MockModel{}, jrpc2.NewServer("", ""))
+	defer api.Close()
+	api.Configure([]byte(`{"key": "dl", "config": {"maxAttempts": 1}}`))
+	api.Push([]byte(`{"key": "dl", "id": "a", "priority": 1.5}`))
+	api.Push([]byte(`{"key": "dl", "id": "b", "priority": 2.5}`))
+	api.Lease([]byte(`{"key": "dl", "ttl": 30}`))
+	api.Lease([]byte(`{"key": "dl", "ttl": 30}`))
+	if _, errObj := api.Nack([]byte(`{"key": "dl", "id": "a"}`)); errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	api.Sweep(time.Now().Add(time.Minute))
+	result, errObj := api.ListDead([]byte(`["dl"]`))
+	if errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	dead := result.([]*Task)
+	if len(dead) != 2 || dead[0].Id != "a" || dead[1].Id != "b" {
+		t.Fatal("expected tasks 'a' and 'b' to be dead lettered")
+	}
+	if _, errObj := api.Get([]byte(`{"key": "dl.dlq"}`)); errObj != nil {
+		t.Fatal("expected dead letter queue to be visible through get")
+	}
+	for _, call := range []func(json.RawMessage) (interface{}, *jrpc2.ErrorObject){api.Push, api.Lease, api.Delete, api.ListDead} {
+		_, errObj := call([]byte(`{"key": "dl.dlq", "id": "c", "priority": 1, "ttl": 30}`))
+		if errObj == nil || errObj.Code != jrpc2.InvalidParamsCode {
+			t.Fatal("expected dead letter queue key to be rejected")
+		}
+	}
+	result, errObj = api.RequeueDead([]byte(`{"key": "dl", "id": "a"}`))
+	if errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	if result != 1 {
+		t.Fatal("expected 1 task to be requeued")
+	}
+	queue, _ := api.queues.Get("dl")
+	if task := queue.Peek(); task == nil || task.Id != "a" || task.Attempts != 0 {
+		t.Fatal("expected task 'a' to be requeued with attempts reset")
+	}
+	result, errObj = api.PurgeDead([]byte(`["dl"]`))
+	if errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	if result != 1 {
+		t.Fatal("expected 1 task to be purged")
+	}
+	result, _ = api.ListDead([]byte(`["dl"]`))
+	if len(result.([]*Task)) != 0 {
+		t.Fatal("expected dead letter queue to be empty")
+	}
+}
+
+func TestApiV1Clear(t *testing.T) {
+	api := NewApiV1(&MockModel{}, jrpc2.NewServer("", ""))
+	defer api.Close()
+	if _, errObj := api.Clear([]byte(`["clear"]`)); errObj == nil || errObj.Code != QueueNotFoundCode {
+		t.Fatal("expected queue not found error")
+	}
+	api.Configure([]byte(`{"key": "clear", "config": {"maxAttempts": 2}}`))
+	api.Push([]byte(`{"key": "clear", "id": "a", "priority": 1.5}`))
+	api.Push([]byte(`{"key": "clear", "id": "b", "priority": 2.5}`))
+	api.Lease([]byte(`{"key": "clear", "ttl": 30}`))
+	result, errObj := api.Clear([]byte(`["clear"]`))
+	if errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	if result != 2 {
+		t.Fatal("expected queued and leased tasks to be cleared")
+	}
+	queue, _ := api.queues.Get("clear")
+	if queue.count != 0 || len(queue.inflight) != 0 || queue.Config.MaxAttempts != 2 {
+		t.Fatal("expected empty queue with its config kept")
+	}
+}
+
+func TestApiV1Delete(t *testing.T) {
+	model := NewMemoryModel()
+	api := NewApiV1(model, jrpc2.NewServer("", ""))
+	defer api.Close()
+	if _, errObj := api.Delete([]byte(`["del"]`)); errObj == nil || errObj.Code != QueueNotFoundCode {
+		t.Fatal("expected queue not found error")
+	}
+	api.Configure([]byte(`{"key": "del", "config": {"maxAttempts": 1}}`))
+	api.Push([]byte(`{"key": "del", "id": "a", "priority": 1.5}`))
+	api.Lease([]byte(`{"key": "del", "ttl": 30}`))
+	api.Nack([]byte(`{"key": "del", "id": "a"}`))
+	done := make(chan interface{})
+	go func() {
+		result, _ := api.PopWait([]byte(`{"key": "del", "timeout": 10}`))
+		done <- result
+	}()
+	for {
+		queue, _ := api.queues.Get("del")
+		queue.Lock()
+		n := len(queue.waiters)
+		queue.Unlock()
+		if n > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	result, errObj := api.Delete([]byte(`["del"]`))
+	if errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	if result != 0 {
+		t.Fatal("expected result to be 0")
+	}
+	select {
+	case task := <-done:
+		if task.(*Task) != nil {
+			t.Fatal("expected waiter to be released with no task")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected waiter to be released")
+	}
+	for _, key := range []string{"del", "del.dlq"} {
+		if _, ok := api.queues.Get(key); ok {
+			t.Fatalf("expected queue [%s] to be unregistered", key)
+		}
+		if v, _ := model.Fetch(context.Background(), key); v != nil {
+			t.Fatalf("expected queue [%s] to be deleted from storage", key)
+		}
+	}
+	api.Push([]byte(`{"key": "del", "id": "b", "priority": 1.5}`))
+	if queue, _ := api.queues.Get("del"); queue.count != 1 || queue.Config.MaxAttempts != 0 {
+		t.Fatal("expected a new queue to be created after delete")
+	}
+}
+
+func TestApiV1AutoDelete(t *testing.T) {
+	model := NewMemoryModel()
+	api := NewApiV1(model, jrpc2.NewServer("", ""))
+	defer api.Close()
+	if _, errObj := api.Configure([]byte(`{"key": "auto", "config": {"autoDelete": -1}}`)); errObj == nil {
+		t.Fatal("expected negative auto delete to be rejected")
+	}
+	api.Configure([]byte(`{"key": "auto", "config": {"autoDelete": 60}}`))
+	api.Push([]byte(`{"key": "auto", "id": "a", "priority": 1.5}`))
+	now := time.Now()
+	api.Sweep(now.Add(2 * time.Minute))
+	if _, ok := api.queues.Get("auto"); !ok {
+		t.Fatal("expected queue with tasks to be kept")
+	}
+	api.Pop([]byte(`["auto"]`))
+	api.Sweep(now)
+	api.Sweep(now.Add(30 * time.Second))
+	if _, ok := api.queues.Get("auto"); !ok {
+		t.Fatal("expected queue to be kept until the auto delete duration elapses")
+	}
+	// a queue drained between sweeps is in use and must be kept.
+	api.Push([]byte(`{"key": "auto", "id": "b", "priority": 1.5}`))
+	api.Pop([]byte(`["auto"]`))
+	api.Sweep(now.Add(2 * time.Minute))
+	if _, ok := api.queues.Get("auto"); !ok {
+		t.Fatal("expected queue drained between sweeps to be kept")
+	}
+	api.Sweep(now.Add(4 * time.Minute))
+	if _, ok := api.queues.Get("auto"); ok {
+		t.Fatal("expected empty queue to be auto deleted")
+	}
+	if v, _ := model.Fetch(context.Background(), "auto"); v != nil {
+		t.Fatal("expected auto deleted queue to be deleted from storage")
+	}
+}
+
+// unavailableModel is a model whose queues cannot be fetched.
+type unavailableModel struct {
+	MockModel
+}
+
+func (m unavailableModel) FetchAll(context.Context) ([]interface{}, error) {
+	return nil, errors.New("storage unavailable")
+}
+
+func TestNewApiV1WithOptionsError(t *testing.T) {
+	api, err := NewApiV1WithOptions(unavailableModel{}, jrpc2.NewServer("", ""), ApiOptions{})
+	if err == nil || api != nil {
+		t.Fatal("expected load error to be returned")
+	}
+	api, err = NewApiV1WithOptions(unavailableModel{}, jrpc2.NewServer("", ""), ApiOptions{Lazy: true})
+	if err != nil {
+		t.Fatal("expected lazy api to not load the queues")
+	}
+	api.Close()
+}
+
+func TestApiV1Concurrent(t *testing.T) {
+	api := NewApiV1(&MockModel{}, jrpc2.NewServer("", ""))
+	defer api.Close()
+	keys := []string{"c1", "c2", "c3", "c4"}
+	var wg sync.WaitGroup
+	for w := 0; w < 16; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			key := keys[w%len(keys)]
+			for i := 0; i < 50; i++ {
+				id := fmt.Sprintf("%d-%d", w, i)
+				push := fmt.Sprintf(`{"key": "%s", "id": "%s", "priority": %d}`, key, id, (w*i)%17)
+				if _, errObj := api.Push([]byte(push)); errObj != nil {
+					t.Error(errObj.Message)
+					return
+				}
+				api.Peek([]byte(fmt.Sprintf(`{"key": "%s"}`, key)))
+				api.Get([]byte(fmt.Sprintf(`{"key": "%s"}`, key)))
+				api.GetAll([]byte(`{}`))
+				if i%3 == 0 {
+					api.Remove([]byte(fmt.Sprintf(`{"key": "%s", "id": "%s"}`, key, id)))
+				} else if i%3 == 1 {
+					api.Pop([]byte(fmt.Sprintf(`{"key": "%s"}`, key)))
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	for _, key := range keys {
+		queue, ok := api.queues.Get(key)
+		if !ok {
+			t.Fatalf("expected queue '%s' to exist", key)
+		}
+		checkHeap(t, queue)
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Duration is a time.Duration that is configured as a duration string
+// such as "1m30s".
+type Duration time.Duration
+
+// UnmarshalJSON parses the duration string.
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return errors.New("duration must be a string such as \"30s\"")
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// MarshalJSON formats the duration string.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// CollectionNames is the names of the database collections.
+type CollectionNames struct {
+	// Queues is the collection of queue documents.
+	// Quarantine is the collection of quarantined documents.
+	// TaskQueues is the collection of queue documents of the task layout.
+	// Tasks is the collection of task documents of the task layout.
+	Queues     string `json:"queues"`
+	Quarantine string `json:"quarantine"`
+	TaskQueues string `json:"taskQueues"`
+	Tasks      string `json:"tasks"`
+}
+
+// StartupPolicy determines how long the startup waits for the database
+// to become reachable.
+type StartupPolicy struct {
+	// Backoff is the delay before the first retry.  It doubles after
+	// each retry.
+	// MaxBackoff caps the delay between retries.
+	// MaxWait is the longest time to wait before the startup fails.
+	Backoff    Duration `json:"backoff"`
+	MaxBackoff Duration `json:"maxBackoff"`
+	MaxWait    Duration `json:"maxWait"`
+}
+
+// DatabaseConfig is the configuration of the arangodb database
+// connection.  It is loaded from a json file, then overridden by the
+// environment, then by command line flags.
+type DatabaseConfig struct {
+	// Endpoints is the urls of the database servers.
+	// User is the user name.
+	// Password is the password of the user.
+	// CACert is the path of the PEM encoded certificate authorities
+	// trusted for https endpoints.  The system pool is used if empty.
+	// Database is the name of the database.
+	// Collections is the names of the collections.
+	// Startup is the startup policy.
+	Endpoints   []string        `json:"endpoints"`
+	User        string          `json:"user"`
+	Password    string          `json:"password"`
+	CACert      string          `json:"caCert"`
+	Database    string          `json:"database"`
+	Collections CollectionNames `json:"collections"`
+	Startup     StartupPolicy   `json:"startup"`
+}
+
+// DefaultDatabaseConfig returns the configuration used for the values
+// that are not configured.
+func DefaultDatabaseConfig() *DatabaseConfig {
+	return &DatabaseConfig{
+		Endpoints: []string{"http://localhost:8529"},
+		Collections: CollectionNames{
+			Queues:     "priority_queues",
+			Quarantine: "priority_queues_quarantine",
+			TaskQueues: "task_queues",
+			Tasks:      "tasks",
+		},
+		Startup: StartupPolicy{
+			Backoff:    Duration(time.Second),
+			MaxBackoff: Duration(30 * time.Second),
+			MaxWait:    Duration(5 * time.Minute),
+		},
+	}
+}
+
+// LoadDatabaseConfig loads the configuration from the file named by the
+// -config flag or the CONFIG_FILE environment variable, the ARANGODB_*
+// environment variables, and the command line arguments.
+func LoadDatabaseConfig(args []string) (*DatabaseConfig, error) {
+	return loadDatabaseConfig(args, os.Getenv)
+}
+
+// loadDatabaseConfig loads the configuration reading the environment
+// with getenv.
+func loadDatabaseConfig(args []string, getenv func(string) string) (*DatabaseConfig, error) {
+	fs := flag.NewFlagSet("concord-pq", flag.ContinueOnError)
+	path := fs.String("config", getenv("CONFIG_FILE"), "path of the json configuration file")
+	endpoints := fs.String("arangodb-host", "", "comma separated database endpoints")
+	user := fs.String("arangodb-user", "", "database user")
+	caCert := fs.String("arangodb-ca-cert", "", "path of the PEM encoded certificate authorities")
+	database := fs.String("arangodb-name", "", "database name")
+	maxWait := fs.Duration("startup-max-wait", 0, "longest time to wait for the database")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	cfg := DefaultDatabaseConfig()
+	if *path != "" {
+		data, err := os.ReadFile(*path)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, cfg); err != nil {
+			return nil, fmt.Errorf("config file [%s]: %w", *path, err)
+		}
+	}
+
+	for name, field := range map[string]*string{
+		"ARANGODB_USER":                  &cfg.User,
+		"ARANGODB_PASS":                  &cfg.Password,
+		"ARANGODB_CA_CERT":               &cfg.CACert,
+		"ARANGODB_NAME":                  &cfg.Database,
+		"ARANGODB_COLLECTION_QUEUES":     &cfg.Collections.Queues,
+		"ARANGODB_COLLECTION_QUARANTINE": &cfg.Collections.Quarantine,
+		"ARANGODB_COLLECTION_TASKQUEUES": &cfg.Collections.TaskQueues,
+		"ARANGODB_COLLECTION_TASKS":      &cfg.Collections.Tasks,
+	} {
+		if v := getenv(name); v != "" {
+			*field = v
+		}
+	}
+	if v := getenv("ARANGODB_HOST"); v != "" {
+		cfg.Endpoints = strings.Split(v, ",")
+	}
+	if v := getenv("STARTUP_MAX_WAIT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("STARTUP_MAX_WAIT: %w", err)
+		}
+		cfg.Startup.MaxWait = Duration(d)
+	}
+
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "arangodb-host":
+			cfg.Endpoints = strings.Split(*endpoints, ",")
+		case "arangodb-user":
+			cfg.User = *user
+		case "arangodb-ca-cert":
+			cfg.CACert = *caCert
+		case "arangodb-name":
+			cfg.Database = *database
+		case "startup-max-wait":
+			cfg.Startup.MaxWait = Duration(*maxWait)
+		}
+	})
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Validate checks that the configuration is usable.
+func (cfg *DatabaseConfig) Validate() error {
+	if len(cfg.Endpoints) == 0 {
+		return errors.New("at least one database endpoint is required")
+	}
+	for _, endpoint := range cfg.Endpoints {
+		if endpoint == "" {
+			return errors.New("database endpoints must not be empty")
+		}
+	}
+	if cfg.Database == "" {
+		return errors.New("database name is required")
+	}
+	c := cfg.Collections
+	if c.Queues == "" || c.Quarantine == "" || c.TaskQueues == "" || c.Tasks == "" {
+		return errors.New("collection names must not be empty")
+	}
+	s := cfg.Startup
+	if s.Backoff <= 0 || s.MaxBackoff < s.Backoff {
+		return errors.New("startup backoff must be positive and not above the max backoff")
+	}
+	if s.MaxWait <= 0 {
+		return errors.New("startup max wait must be positive")
+	}
+	return nil
+}
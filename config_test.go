@@ -0,0 +1,97 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadDatabaseConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	data := `{
+		"endpoints": ["http://file:8529"],
+		"user": "file-user",
+		"database": "file-db",
+		"collections": {"queues": "file_queues"},
+		"startup": {"backoff": "2s", "maxWait": "1m"}
+	}`
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	env := map[string]string{
+		"CONFIG_FILE":   path,
+		"ARANGODB_HOST": "http://a:8529,http://b:8529",
+		"ARANGODB_USER": "env-user",
+		"ARANGODB_PASS": "secret",
+	}
+	getenv := func(name string) string { return env[name] }
+	cfg, err := loadDatabaseConfig([]string{"-arangodb-user", "flag-user", "-startup-max-wait", "30s"}, getenv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Endpoints) != 2 || cfg.Endpoints[1] != "http://b:8529" {
+		t.Fatal("expected environment endpoints to override the file")
+	}
+	if cfg.User != "flag-user" || cfg.Password != "secret" {
+		t.Fatal("expected flags to override the environment")
+	}
+	if cfg.Database != "file-db" || cfg.Collections.Queues != "file_queues" {
+		t.Fatal("expected file values to be used")
+	}
+	if cfg.Collections.Tasks != "tasks" {
+		t.Fatal("expected defaults for values that are not configured")
+	}
+	s := cfg.Startup
+	if time.Duration(s.Backoff) != 2*time.Second || time.Duration(s.MaxWait) != 30*time.Second {
+		t.Fatal("expected startup policy to be configured")
+	}
+	if time.Duration(s.MaxBackoff) != 30*time.Second {
+		t.Fatal("expected default max backoff")
+	}
+}
+
+func TestLoadDatabaseConfigInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	for _, data := range []string{
+		`{"database": "db", "startup": {"maxWait": 60}}`,
+		`{"database": "db", "startup": {"maxWait": "0s"}}`,
+		`{"database": "db", "collections": {"tasks": ""}}`,
+		`{"database": ""}`,
+		`{"database": "db", "endpoints": []}`,
+		`{"database": "db", "unknown": true`,
+	} {
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		getenv := func(string) string { return "" }
+		if _, err := loadDatabaseConfig([]string{"-config", path}, getenv); err == nil {
+			t.Fatalf("expected %s to be rejected", data)
+		}
+	}
+	if _, err := loadDatabaseConfig([]string{"-unknown"}, func(string) string { return "" }); err == nil {
+		t.Fatal("expected unknown flag to be rejected")
+	}
+}
+
+func TestInitDatabaseUnreachable(t *testing.T) {
+	cfg := DefaultDatabaseConfig()
+	cfg.Endpoints = []string{"http://127.0.0.1:1"}
+	cfg.Database = "unreachable"
+	cfg.Startup = StartupPolicy{
+		Backoff:    Duration(10 * time.Millisecond),
+		MaxBackoff: Duration(20 * time.Millisecond),
+		MaxWait:    Duration(100 * time.Millisecond),
+	}
+	start := time.Now()
+	if err := InitDatabase(cfg); err == nil {
+		t.Fatal("expected unreachable database to be reported")
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Fatal("expected startup to give up after the max wait")
+	}
+	cfg.CACert = filepath.Join(t.TempDir(), "missing.pem")
+	if err := InitDatabase(cfg); err == nil {
+		t.Fatal("expected missing ca certificate to be reported")
+	}
+}
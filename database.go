@@ -1,8 +1,13 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
 	"os"
 	"time"
 
@@ -10,135 +15,381 @@ import (
 	arangohttp "github.com/arangodb/go-driver/http"
 )
 
+// The collection names are set from the configuration by InitDatabase.
+var (
+	CollectionPriorityQueues = "priority_queues"            // the name of the priority queues database collection.
+	CollectionQuarantine     = "priority_queues_quarantine" // the name of the quarantined documents database collection.
+)
+
+// QuarantineMode determines how stored priority queue documents that
+// cannot be decoded are handled when they are fetched.
+type QuarantineMode string
+
 const (
-	CollectionPriorityQueues = "priority_queues" // the name of the priority queues database collection.
+	QuarantineSkip QuarantineMode = "skip" // log and skip the document.
+	QuarantineMove QuarantineMode = "move" // move the document to the quarantine collection.
+	QuarantineFail QuarantineMode = "fail" // fail the fetch with the decode error.
 )
 
+// Valid reports whether the mode is a known quarantine mode.  The empty
+// mode is valid and behaves as QuarantineSkip.
+func (m QuarantineMode) Valid() bool {
+	switch m {
+	case "", QuarantineSkip, QuarantineMove, QuarantineFail:
+		return true
+	}
+	return false
+}
+
 var db arango.Database // package local arango database instance.
 
+// ErrConflict is returned by Save when the stored queue was changed by
+// another writer since it was fetched or last saved.
+var ErrConflict = errors.New("queue was changed by another writer")
+
 // DocumentMeta contains meta data for an arango document
 type DocumentMeta struct {
-	Id arango.DocumentID
+	Id  arango.DocumentID
+	Rev string
 }
 
 // Model contains methods for interacting with database collections.
+// Calls give up with the context error once the context is done.  Fetch
+// returns nil if no queue is stored with the key, and Delete of a queue
+// that is not stored does nothing.
 type Model interface {
-	Create() error
-	FetchAll() ([]interface{}, error)
-	Save(interface{}) (DocumentMeta, error)
+	Create(ctx context.Context) error
+	FetchAll(ctx context.Context) ([]interface{}, error)
+	Fetch(ctx context.Context, key string) (interface{}, error)
+	Keys(ctx context.Context) ([]string, error)
+	Save(ctx context.Context, pq interface{}) (DocumentMeta, error)
+	Delete(ctx context.Context, pq interface{}) error
 }
 
 // PriorityQueueModel represents a priority queue collection model.
-type PriorityQueueModel struct{}
+type PriorityQueueModel struct {
+	// Quarantine is the handling of undecodable documents.  The empty
+	// mode behaves as QuarantineSkip.
+	Quarantine QuarantineMode
+}
 
-// Create creates the priority queues collection in the arangodb database.
-func (model *PriorityQueueModel) Create() error {
-	_, err := db.CreateCollection(nil, CollectionPriorityQueues, nil)
-	if err != nil && arango.IsConflict(err) {
-		return nil
+// Create creates the priority queues and quarantine collections in the
+// arangodb database.
+func (model *PriorityQueueModel) Create(ctx context.Context) error {
+	for _, name := range []string{CollectionPriorityQueues, CollectionQuarantine} {
+		_, err := db.CreateCollection(ctx, name, nil)
+		if err != nil && !arango.IsConflict(err) {
+			return err
+		}
 	}
-	return err
+	return nil
 }
 
 // FetchAll gets all documents from the priority queues collection.
-func (model *PriorityQueueModel) FetchAll() ([]interface{}, error) {
+// Documents that cannot be decoded are handled by the quarantine mode.
+func (model *PriorityQueueModel) FetchAll(ctx context.Context) ([]interface{}, error) {
 	queues := make([]interface{}, 0)
 	query := fmt.Sprintf("FOR q IN %s RETURN q", CollectionPriorityQueues)
-	cursor, err := db.Query(nil, query, nil)
+	cursor, err := db.Query(ctx, query, nil)
 	if err != nil {
 		return nil, err
 	}
 	defer cursor.Close()
 	for {
-		q := new(PriorityQueue)
-		_, err := cursor.ReadDocument(nil, q)
+		var raw json.RawMessage
+		meta, err := cursor.ReadDocument(ctx, &raw)
 		if arango.IsNoMoreDocuments(err) {
 			break
 		} else if err != nil {
 			return nil, err
 		}
+		q := new(PriorityQueue)
+		if err := json.Unmarshal(raw, q); err != nil {
+			if err := model.quarantine(ctx, meta.Key, raw, err); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		q.rev = meta.Rev
 		queues = append(queues, q)
 	}
 	return queues, nil
 }
 
-// Query runs the AQL query against the priority queues model collection.
-func (model *PriorityQueueModel) Save(pq interface{}) (DocumentMeta, error) {
+// Fetch gets the document of the queue with the provided key.  A
+// document that cannot be decoded is handled by the quarantine mode.  It
+// is treated as not stored once it is moved to quarantine, otherwise the
+// decode error is returned, as the queue must not be recreated over the
+// stored document.
+func (model *PriorityQueueModel) Fetch(ctx context.Context, key string) (interface{}, error) {
+	col, err := db.Collection(ctx, CollectionPriorityQueues)
+	if err != nil {
+		return nil, err
+	}
+	var raw json.RawMessage
+	meta, err := col.ReadDocument(ctx, key, &raw)
+	if arango.IsNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	q := new(PriorityQueue)
+	if err := json.Unmarshal(raw, q); err != nil {
+		if qerr := model.quarantine(ctx, key, raw, err); qerr != nil || model.Quarantine == QuarantineMove {
+			return nil, qerr
+		}
+		return nil, fmt.Errorf("%s document [%s]: %w", CollectionPriorityQueues, key, err)
+	}
+	q.rev = meta.Rev
+	return q, nil
+}
+
+// Keys returns the keys of the documents in the priority queues
+// collection.
+func (model *PriorityQueueModel) Keys(ctx context.Context) ([]string, error) {
+	query := fmt.Sprintf("FOR q IN %s RETURN q._key", CollectionPriorityQueues)
+	return queryStrings(ctx, query, nil)
+}
+
+// queryStrings runs the AQL query returning strings.
+func queryStrings(ctx context.Context, query string, bindVars map[string]interface{}) ([]string, error) {
+	cursor, err := db.Query(ctx, query, bindVars)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+	values := make([]string, 0)
+	for {
+		var v string
+		_, err := cursor.ReadDocument(ctx, &v)
+		if arango.IsNoMoreDocuments(err) {
+			return values, nil
+		} else if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+}
+
+// quarantine handles the undecodable document with the provided key
+// according to the quarantine mode of the model.
+func (model *PriorityQueueModel) quarantine(ctx context.Context, key string, raw json.RawMessage, cause error) error {
+	return quarantineDocument(ctx, model.Quarantine, CollectionPriorityQueues, key, raw, cause)
+}
+
+// quarantineDocument handles the undecodable document with the provided
+// key of the collection according to the quarantine mode.
+func quarantineDocument(ctx context.Context, mode QuarantineMode, collection, key string, raw json.RawMessage, cause error) error {
+	switch mode {
+	case QuarantineFail:
+		return fmt.Errorf("%s document [%s]: %w", collection, key, cause)
+	case QuarantineMove:
+		col, err := db.Collection(ctx, CollectionQuarantine)
+		if err != nil {
+			return err
+		}
+		doc := map[string]interface{}{
+			"_key":          key,
+			"collection":    collection,
+			"document":      raw,
+			"error":         cause.Error(),
+			"quarantinedAt": time.Now(),
+		}
+		if _, err := col.CreateDocument(ctx, doc); arango.IsConflict(err) {
+			if _, err := col.ReplaceDocument(ctx, key, doc); err != nil {
+				return err
+			}
+		} else if err != nil {
+			return err
+		}
+		col, err = db.Collection(ctx, collection)
+		if err != nil {
+			return err
+		}
+		if _, err := col.RemoveDocument(ctx, key); err != nil && !arango.IsNotFound(err) {
+			return err
+		}
+		log.Printf("moved %s document [%s] to quarantine: %v", collection, key, cause)
+	default:
+		log.Printf("skipped %s document [%s]: %v", collection, key, cause)
+	}
+	return nil
+}
+
+// Save creates the queue document, or updates it if the queue has been
+// fetched or saved before.  Updates are conditional on the revision the
+// queue was last fetched or saved at, so that concurrent writers cannot
+// overwrite each other.  ErrConflict is returned if the document was
+// created, changed, or removed by another writer.
+func (model *PriorityQueueModel) Save(ctx context.Context, pq interface{}) (DocumentMeta, error) {
 	var meta arango.DocumentMeta
 	var doc struct {
-		Key   string      `json:"_key"`
-		Count int         `json:"count"`
-		Heap  interface{} `json:"heap"`
+		Key      string          `json:"_key"`
+		Version  int             `json:"version"`
+		Lsn      uint64          `json:"lsn"`
+		Config   json.RawMessage `json:"config"`
+		Count    int             `json:"count"`
+		Seq      uint64          `json:"seq"`
+		Heap     json.RawMessage `json:"heap"`
+		Inflight json.RawMessage `json:"inflight"`
+		Expired  json.RawMessage `json:"expired"`
 	}
-	col, err := db.Collection(nil, CollectionPriorityQueues)
+	col, err := db.Collection(ctx, CollectionPriorityQueues)
 	if err != nil {
 		return DocumentMeta{}, err
 	}
-	data, err := json.Marshal(pq.(*PriorityQueue))
+	q := pq.(*PriorityQueue)
+	data, err := json.Marshal(q)
 	if err != nil {
 		return DocumentMeta{}, err
 	}
 	if err := json.Unmarshal(data, &doc); err != nil {
 		return DocumentMeta{}, err
 	}
-	meta, err = col.CreateDocument(nil, doc)
-	if arango.IsConflict(err) {
+	if q.rev == "" {
+		meta, err = col.CreateDocument(ctx, doc)
+		if arango.IsConflict(err) {
+			return DocumentMeta{}, ErrConflict
+		} else if err != nil {
+			return DocumentMeta{}, err
+		}
+	} else {
 		patch := map[string]interface{}{
-			"count": doc.Count,
-			"heap":  doc.Heap,
+			"version":  doc.Version,
+			"lsn":      doc.Lsn,
+			"config":   doc.Config,
+			"count":    doc.Count,
+			"seq":      doc.Seq,
+			"heap":     doc.Heap,
+			"inflight": doc.Inflight,
+			"expired":  doc.Expired,
 		}
-		meta, err = col.UpdateDocument(nil, doc.Key, patch)
-		if err != nil {
+		ctx := arango.WithRevision(ctx, q.rev)
+		meta, err = col.UpdateDocument(ctx, doc.Key, patch)
+		if arango.IsPreconditionFailed(err) || arango.IsNotFound(err) {
+			return DocumentMeta{}, ErrConflict
+		} else if err != nil {
 			return DocumentMeta{}, err
 		}
-	} else if err != nil {
-		return DocumentMeta{}, err
 	}
-	return DocumentMeta{Id: meta.ID}, nil
+	q.rev = meta.Rev
+	return DocumentMeta{Id: meta.ID, Rev: meta.Rev}, nil
 }
 
-// InitDatabase connects to the arangodb and creates the collections from the
-// provided models.
-func InitDatabase() {
-	host := os.Getenv("ARANGODB_HOST")
-	name := os.Getenv("ARANGODB_NAME")
-	user := os.Getenv("ARANGODB_USER")
-	pass := os.Getenv("ARANGODB_PASS")
-
-	conn, err := arangohttp.NewConnection(
-		arangohttp.ConnectionConfig{Endpoints: []string{host}},
-	)
+// Delete removes the queue document.  The removal is conditional on the
+// revision the queue was last fetched or saved at, and ErrConflict is
+// returned if the document was changed by another writer.
+func (model *PriorityQueueModel) Delete(ctx context.Context, pq interface{}) error {
+	col, err := db.Collection(ctx, CollectionPriorityQueues)
 	if err != nil {
-		panic(err)
+		return err
 	}
-	client, err := arango.NewClient(arango.ClientConfig{
-		Connection:     conn,
-		Authentication: arango.BasicAuthentication(user, pass),
-	})
+	q := pq.(*PriorityQueue)
+	if q.rev != "" {
+		ctx = arango.WithRevision(ctx, q.rev)
+	}
+	_, err = col.RemoveDocument(ctx, q.Key)
+	if arango.IsPreconditionFailed(err) {
+		return ErrConflict
+	} else if err != nil && !arango.IsNotFound(err) {
+		return err
+	}
+	q.rev = ""
+	return nil
+}
+
+// InitDatabase connects to the arangodb database of the configuration,
+// creating it if needed, and creates the collections of the priority
+// queue model.  Unreachable databases are retried with exponential
+// backoff until the startup max wait elapses, while rejected credentials
+// fail at once.
+func InitDatabase(cfg *DatabaseConfig) error {
+	client, err := connect(cfg)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
-	for {
-		if exists, err := client.DatabaseExists(nil, name); err == nil {
-			if !exists {
-				db, err = client.CreateDatabase(nil, name, nil)
-			} else {
-				db, err = client.Database(nil, name)
-			}
-			if err == nil {
-				break
-			}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.Startup.MaxWait))
+	defer cancel()
+	backoff := time.Duration(cfg.Startup.Backoff)
+	var d arango.Database
+	for attempt := 1; ; attempt++ {
+		d, err = openDatabase(ctx, client, cfg.Database)
+		if err == nil {
+			break
+		}
+		if arango.IsUnauthorized(err) {
+			return fmt.Errorf("database [%s] rejected the credentials of user [%s]: %w", cfg.Database, cfg.User, err)
+		}
+		if ctx.Err() != nil {
+			return fmt.Errorf("database [%s] not ready after %v: %w", cfg.Database, time.Duration(cfg.Startup.MaxWait), err)
+		}
+		log.Printf("database [%s] not ready (attempt %d), retrying in %v: %v", cfg.Database, attempt, backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return fmt.Errorf("database [%s] not ready after %v: %w", cfg.Database, time.Duration(cfg.Startup.MaxWait), err)
+		}
+		backoff *= 2
+		if max := time.Duration(cfg.Startup.MaxBackoff); backoff > max {
+			backoff = max
 		}
-		time.Sleep(time.Second * 1)
 	}
+	log.Printf("connected to database [%s]", cfg.Database)
+	db = d
+	CollectionPriorityQueues = cfg.Collections.Queues
+	CollectionQuarantine = cfg.Collections.Quarantine
+	CollectionTaskQueues = cfg.Collections.TaskQueues
+	CollectionTasks = cfg.Collections.Tasks
 
 	models := []Model{
 		&PriorityQueueModel{},
 	}
 	for _, model := range models {
-		if err := model.Create(); err != nil {
-			panic(err)
+		if err := model.Create(ctx); err != nil {
+			return fmt.Errorf("failed to create collections: %w", err)
+		}
+	}
+	return nil
+}
+
+// connect returns a client of the database servers of the configuration.
+func connect(cfg *DatabaseConfig) (arango.Client, error) {
+	connCfg := arangohttp.ConnectionConfig{Endpoints: cfg.Endpoints}
+	if cfg.CACert != "" {
+		pem, err := os.ReadFile(cfg.CACert)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in [%s]", cfg.CACert)
+		}
+		connCfg.TLSConfig = &tls.Config{RootCAs: pool}
+	}
+	conn, err := arangohttp.NewConnection(connCfg)
+	if err != nil {
+		return nil, err
+	}
+	return arango.NewClient(arango.ClientConfig{
+		Connection:     conn,
+		Authentication: arango.BasicAuthentication(cfg.User, cfg.Password),
+	})
+}
+
+// openDatabase opens the database with the provided name, creating it if
+// it does not exist.
+func openDatabase(ctx context.Context, client arango.Client, name string) (arango.Database, error) {
+	exists, err := client.DatabaseExists(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		created, err := client.CreateDatabase(ctx, name, nil)
+		if arango.IsConflict(err) {
+			return client.Database(ctx, name)
 		}
+		return created, err
 	}
+	return client.Database(ctx, name)
 }
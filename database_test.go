@@ -1,18 +1,27 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"flag"
+	"fmt"
 	"os"
 	"testing"
+	"time"
 
-	arango "github.com/arangodb/go-driver"
-	arangohttp "github.com/arangodb/go-driver/http"
+	"github.com/bitwurx/jrpc2"
 )
 
 func TestMain(m *testing.M) {
 	flag.Parse()
 	if !testing.Short() {
-		InitDatabase()
+		cfg, err := LoadDatabaseConfig(nil)
+		if err != nil {
+			panic(err)
+		}
+		if err := InitDatabase(cfg); err != nil {
+			panic(err)
+		}
 	}
 	result := m.Run()
 	if !testing.Short() {
@@ -22,52 +31,152 @@ func TestMain(m *testing.M) {
 }
 
 func tearDownDatabase() {
-	host := os.Getenv("ARANGODB_HOST")
-	name := os.Getenv("ARANGODB_NAME")
-	user := os.Getenv("ARANGODB_USER")
-	pass := os.Getenv("ARANGODB_PASS")
-	conn, err := arangohttp.NewConnection(
-		arangohttp.ConnectionConfig{Endpoints: []string{host}},
-	)
-	if err != nil {
-		panic(err)
-	}
-	client, err := arango.NewClient(arango.ClientConfig{
-		Connection:     conn,
-		Authentication: arango.BasicAuthentication(user, pass),
-	})
-	if err != nil {
+	if err := db.Remove(nil); err != nil {
 		panic(err)
 	}
-	if db, err := client.Database(nil, name); err != nil {
-		panic(err)
-	} else {
-		if err = db.Remove(nil); err != nil {
-			panic(err)
-		}
-	}
 }
 
 type MockModel struct{}
 
-func (m MockModel) Create() error {
+func (m MockModel) Create(ctx context.Context) error {
 	return nil
 }
 
-func (m MockModel) FetchAll() ([]interface{}, error) {
+func (m MockModel) FetchAll(ctx context.Context) ([]interface{}, error) {
 	return make([]interface{}, 0), nil
 }
 
-func (m MockModel) Save(interface{}) (DocumentMeta, error) {
+func (m MockModel) Fetch(ctx context.Context, key string) (interface{}, error) {
+	return nil, nil
+}
+
+func (m MockModel) Keys(ctx context.Context) ([]string, error) {
+	return make([]string, 0), nil
+}
+
+func (m MockModel) Save(context.Context, interface{}) (DocumentMeta, error) {
 	return DocumentMeta{}, nil
 }
 
+func (m MockModel) Delete(context.Context, interface{}) error {
+	return nil
+}
+
+// testModel runs the test suite every Model implementation must pass,
+// storing a queue with the provided key.  Models that accept any queue
+// key are run with a key that is not a valid document key.
+func testModel(t *testing.T, model Model, key string) {
+	if err := model.Create(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := model.Create(context.Background()); err != nil {
+		t.Fatal("expected create to be idempotent")
+	}
+	pq := NewPriorityQueue(key)
+	pq.Config.MaxAttempts = 3
+	if _, err := model.Save(context.Background(), pq); err != nil {
+		t.Fatal(err)
+	}
+	pq.Push(&Task{Id: "abc", Priority: 2.34, Labels: map[string]string{"a": "b"}})
+	pq.Push(&Task{Id: "xyz", Priority: 1.5, Payload: json.RawMessage(`{"n":1}`)})
+	pq.Lease(time.Now().Add(time.Minute))
+	if _, err := model.Save(context.Background(), pq); err != nil {
+		t.Fatal(err)
+	}
+	other := NewPriorityQueue("suite-other")
+	if _, err := model.Save(context.Background(), other); err != nil {
+		t.Fatal(err)
+	}
+
+	queues, err := model.FetchAll(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fetched *PriorityQueue
+	found := 0
+	for _, q := range queues {
+		switch q.(*PriorityQueue).Key {
+		case pq.Key:
+			fetched = q.(*PriorityQueue)
+			found++
+		case other.Key:
+			found++
+		}
+	}
+	if found != 2 || fetched == nil {
+		t.Fatal("expected both saved queues to be fetched once")
+	}
+	if fetched.Config.MaxAttempts != 3 {
+		t.Fatal("expected config to be stored")
+	}
+	if task := fetched.Peek(); task == nil || task.Id != "abc" || task.Priority != 2.34 || task.Labels["a"] != "b" {
+		t.Fatal("expected queued task to be stored")
+	}
+	if lease := fetched.inflight["xyz"]; lease == nil || string(lease.Task.Payload) != `{"n":1}` {
+		t.Fatal("expected leased task to be stored")
+	}
+
+	v, err := model.Fetch(context.Background(), pq.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q, ok := v.(*PriorityQueue); !ok || q.count != 1 || q.inflight["xyz"] == nil {
+		t.Fatal("expected queue to be fetched by key")
+	}
+	if v, err := model.Fetch(context.Background(), "suite-missing"); err != nil || v != nil {
+		t.Fatal("expected fetch of a missing queue to return nil")
+	}
+	keys, err := model.Keys(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	found = 0
+	for _, key := range keys {
+		if key == pq.Key || key == other.Key {
+			found++
+		}
+	}
+	if found != 2 {
+		t.Fatal("expected keys of both saved queues")
+	}
+
+	if err := model.Delete(context.Background(), fetched); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := model.Fetch(context.Background(), pq.Key); err != nil || v != nil {
+		t.Fatal("expected deleted queue to not be stored")
+	}
+	if err := model.Delete(context.Background(), fetched); err != nil {
+		t.Fatal("expected delete of a missing queue to do nothing")
+	}
+}
+
+func TestQuarantineModeValid(t *testing.T) {
+	for _, mode := range []QuarantineMode{"", QuarantineSkip, QuarantineMove, QuarantineFail} {
+		if !mode.Valid() {
+			t.Fatalf("expected quarantine mode %q to be valid", mode)
+		}
+	}
+	for _, mode := range []QuarantineMode{"Move", "drop"} {
+		if mode.Valid() {
+			t.Fatalf("expected quarantine mode %q to be invalid", mode)
+		}
+	}
+}
+
+func TestPriorityQueueModelSuite(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+	testModel(t, new(PriorityQueueModel), "suite:key")
+}
+
 func TestPriorityQueueModelCreate(t *testing.T) {
 	if testing.Short() {
 		t.Skip("skipping integration test")
 	}
 	model := new(PriorityQueueModel)
-	if err := model.Create(); err != nil {
+	if err := model.Create(context.Background()); err != nil {
 		t.Fatal(err)
 	}
 }
@@ -78,10 +187,10 @@ func TestPriorityQueueModelFetchAll(t *testing.T) {
 	}
 	pq := NewPriorityQueue("test")
 	model := new(PriorityQueueModel)
-	if _, err := model.Save(pq); err != nil {
+	if _, err := model.Save(context.Background(), pq); err != nil {
 		t.Fatal(err)
 	}
-	queues, err := model.FetchAll()
+	queues, err := model.FetchAll(context.Background())
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -90,18 +199,120 @@ func TestPriorityQueueModelFetchAll(t *testing.T) {
 	}
 }
 
+func TestPriorityQueueModelQuarantine(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+	col, err := db.Collection(nil, CollectionPriorityQueues)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad := map[string]interface{}{"_key": "bad", "heap": "not a heap"}
+	if _, err := col.CreateDocument(nil, bad); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (&PriorityQueueModel{Quarantine: QuarantineFail}).FetchAll(context.Background()); err == nil {
+		t.Fatal("expected fail mode to return the decode error")
+	}
+	if _, err := (&PriorityQueueModel{}).FetchAll(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (&PriorityQueueModel{Quarantine: QuarantineMove}).FetchAll(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if exists, _ := col.DocumentExists(nil, "bad"); exists {
+		t.Fatal("expected bad document to be moved")
+	}
+	quarantine, err := db.Collection(nil, CollectionQuarantine)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exists, _ := quarantine.DocumentExists(nil, "bad"); !exists {
+		t.Fatal("expected bad document to be quarantined")
+	}
+}
+
 func TestPriorityQueueModelSave(t *testing.T) {
 	if testing.Short() {
 		t.Skip("skipping integration test")
 	}
-	pq := NewPriorityQueue("test")
+	pq := NewPriorityQueue("save")
 	model := new(PriorityQueueModel)
-	if _, err := model.Save(pq); err != nil {
+	if _, err := model.Save(context.Background(), pq); err != nil {
 		t.Fatal(err)
 	}
 	pq.Push(&Task{Id: "abc", Priority: 1.5})
 	pq.Push(&Task{Id: "xyz", Priority: 2.5})
-	if _, err := model.Save(pq); err != nil {
+	if _, err := model.Save(context.Background(), pq); err != nil {
 		t.Fatal(err)
 	}
 }
+
+func TestPriorityQueueModelConflict(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+	model := new(PriorityQueueModel)
+	if _, err := model.Save(context.Background(), NewPriorityQueue("conflict")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := model.Save(context.Background(), NewPriorityQueue("conflict")); err != ErrConflict {
+		t.Fatal("expected create of a stored queue to conflict")
+	}
+	fetch := func() *PriorityQueue {
+		queues, err := model.FetchAll(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, q := range queues {
+			if q := q.(*PriorityQueue); q.Key == "conflict" {
+				return q
+			}
+		}
+		t.Fatal("expected queue to be fetched")
+		return nil
+	}
+	first, second := fetch(), fetch()
+	first.Push(&Task{Id: "a", Priority: 1.5})
+	if _, err := model.Save(context.Background(), first); err != nil {
+		t.Fatal(err)
+	}
+	second.Push(&Task{Id: "b", Priority: 2.5})
+	if _, err := model.Save(context.Background(), second); err != ErrConflict {
+		t.Fatal("expected save of an outdated queue to conflict")
+	}
+	first.Push(&Task{Id: "c", Priority: 3.5})
+	if _, err := model.Save(context.Background(), first); err != nil {
+		t.Fatal("expected saved queue to be saved again")
+	}
+	if q := fetch(); q.count != 2 || q.Has("b") {
+		t.Fatal("expected conflicting save to be rejected")
+	}
+}
+
+func TestApiV1ConflictIntegration(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+	a := NewApiV1(new(PriorityQueueModel), jrpc2.NewServer("", ""))
+	defer a.Close()
+	b := NewApiV1(new(PriorityQueueModel), jrpc2.NewServer("", ""))
+	defer b.Close()
+	for j := 0; j < 20; j++ {
+		for i, api := range []*ApiV1{a, b} {
+			params := fmt.Sprintf(`{"key": "writers", "id": "%d-%d", "priority": 1.5}`, i, j)
+			if _, errObj := api.retryConflicts(api.Push)([]byte(params)); errObj != nil {
+				t.Fatal(errObj.Message)
+			}
+		}
+	}
+	queues, err := new(PriorityQueueModel).FetchAll(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, q := range queues {
+		if q := q.(*PriorityQueue); q.Key == "writers" && q.count != 40 {
+			t.Fatalf("expected pushes of both writers to be stored, got %d", q.count)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+const (
+	MaxExpiredRecords = 1000 // the number of expired task ids recorded per queue.
+)
+
+// Expired reports whether the task expiration time is at or before now.
+func (t *Task) Expired(now time.Time) bool {
+	return t.ExpiresAt != nil && !t.ExpiresAt.After(now)
+}
+
+// RemoveExpired removes all tasks that expired at or before now from
+// the heap and returns their ids.  The ids are recorded if the queue
+// records expired tasks.
+func (pq *PriorityQueue) RemoveExpired(now time.Time) []string {
+	ids := make([]string, 0)
+	for _, node := range pq.heap {
+		if node.Expired(now) {
+			ids = append(ids, node.Id)
+		}
+	}
+	for _, id := range ids {
+		pq.removeAt(pq.index[id])
+		log.Printf("task [%s] in queue [%s] expired", id, pq.Key)
+	}
+	pq.recordExpired(ids)
+	return ids
+}
+
+// recordExpired records the ids of expired tasks if the queue records
+// expired tasks, keeping the MaxExpiredRecords most recent ids.
+func (pq *PriorityQueue) recordExpired(ids []string) {
+	if pq.Config.RecordExpired && len(ids) > 0 {
+		pq.expired = append(pq.expired, ids...)
+		if n := len(pq.expired) - MaxExpiredRecords; n > 0 {
+			pq.expired = append([]string(nil), pq.expired[n:]...)
+		}
+	}
+}
+
+// ExpiredIds returns the recorded ids of expired tasks, oldest first.
+func (pq *PriorityQueue) ExpiredIds() []string {
+	ids := make([]string, len(pq.expired))
+	copy(ids, pq.expired)
+	return ids
+}
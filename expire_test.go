@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestPriorityQueueRemoveExpired(t *testing.T) {
+	now := time.Now()
+	past := now.Add(-time.Second)
+	future := now.Add(time.Hour)
+	pq := NewPriorityQueue("test")
+	for i := 0; i < 10; i++ {
+		expiresAt := future
+		if i%2 == 0 {
+			expiresAt = past
+		}
+		pq.Push(&Task{Id: fmt.Sprint(i), Priority: float64(i), ExpiresAt: &expiresAt})
+	}
+	pq.Push(&Task{Id: "x", Priority: 0.5})
+	if task := pq.Peek(); task.Id != "x" {
+		t.Fatal("expected expired tasks to be skipped")
+	}
+	ids := pq.RemoveExpired(now)
+	if len(ids) != 5 {
+		t.Fatalf("got unexpected expired ids %v", ids)
+	}
+	for _, id := range ids {
+		if _, ok := pq.index[id]; ok {
+			t.Fatalf("expected expired task [%s] to be removed", id)
+		}
+	}
+	checkHeap(t, pq)
+	if pq.count != 6 {
+		t.Fatal("expected 6 tasks to remain queued")
+	}
+	if len(pq.ExpiredIds()) != 0 {
+		t.Fatal("expected expired ids to not be recorded")
+	}
+}
+
+func TestPriorityQueueRecordExpired(t *testing.T) {
+	now := time.Now()
+	pq := NewPriorityQueue("test")
+	pq.Config.RecordExpired = true
+	for i := 0; i < MaxExpiredRecords+10; i++ {
+		pq.Push(&Task{Id: fmt.Sprint(i), Priority: float64(i), ExpiresAt: &now})
+	}
+	pq.RemoveExpired(now)
+	ids := pq.ExpiredIds()
+	if len(ids) != MaxExpiredRecords {
+		t.Fatalf("expected %d recorded ids, got %d", MaxExpiredRecords, len(ids))
+	}
+	data, err := json.Marshal(pq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := new(PriorityQueue)
+	if err := json.Unmarshal(data, restored); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(restored.ExpiredIds()) != fmt.Sprint(ids) {
+		t.Fatal("expected expired ids to be restored")
+	}
+	if !restored.Config.RecordExpired {
+		t.Fatal("expected record expired config to be restored")
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	arango "github.com/arangodb/go-driver"
+)
+
+const (
+	FileExt           = ".json"      // the extension of stored priority queue files.
+	FileQuarantineDir = "quarantine" // the sub directory of quarantined priority queue files.
+)
+
+// FileModel is a priority queue model that stores each queue as a json
+// file in a directory on the local disk.  Files are replaced atomically
+// so a crash during a save leaves the previous version of the queue.
+type FileModel struct {
+	// Dir is the directory the queue files are stored in.
+	// Quarantine is the handling of undecodable files.  The empty mode
+	// behaves as QuarantineSkip.
+	Dir        string
+	Quarantine QuarantineMode
+}
+
+// Create creates the queue and quarantine directories.
+func (model *FileModel) Create(ctx context.Context) error {
+	return os.MkdirAll(filepath.Join(model.Dir, FileQuarantineDir), 0755)
+}
+
+// FetchAll reads all queue files from the directory.  Files that cannot
+// be decoded are handled by the quarantine mode.  The context is checked
+// before each file is read.
+func (model *FileModel) FetchAll(ctx context.Context) ([]interface{}, error) {
+	queues := make([]interface{}, 0)
+	entries, err := os.ReadDir(model.Dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != FileExt {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		data, err := os.ReadFile(filepath.Join(model.Dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		q := new(PriorityQueue)
+		if err := json.Unmarshal(data, q); err != nil {
+			if err := model.quarantine(entry.Name(), err); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		queues = append(queues, q)
+	}
+	return queues, nil
+}
+
+// Fetch reads the file of the queue with the provided key.  A file that
+// cannot be decoded is handled by the quarantine mode.  It is treated as
+// not stored once it is moved to quarantine, otherwise the decode error
+// is returned.
+func (model *FileModel) Fetch(ctx context.Context, key string) (interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	name := fileName(key)
+	data, err := os.ReadFile(filepath.Join(model.Dir, name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	q := new(PriorityQueue)
+	if err := json.Unmarshal(data, q); err != nil {
+		if qerr := model.quarantine(name, err); qerr != nil || model.Quarantine == QuarantineMove {
+			return nil, qerr
+		}
+		return nil, fmt.Errorf("priority queue file [%s]: %w", name, err)
+	}
+	return q, nil
+}
+
+// Keys returns the keys of the queue files in the directory.
+func (model *FileModel) Keys(ctx context.Context) ([]string, error) {
+	entries, err := os.ReadDir(model.Dir)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != FileExt {
+			continue
+		}
+		key, err := hex.DecodeString(strings.TrimSuffix(entry.Name(), FileExt))
+		if err != nil {
+			continue
+		}
+		keys = append(keys, string(key))
+	}
+	return keys, nil
+}
+
+// Save atomically replaces the file of the priority queue.  The context
+// is checked before the file is written, as file writes cannot be
+// cancelled.
+func (model *FileModel) Save(ctx context.Context, pq interface{}) (DocumentMeta, error) {
+	q, ok := pq.(*PriorityQueue)
+	if !ok {
+		return DocumentMeta{}, errors.New("file model can only save priority queues")
+	}
+	if err := ctx.Err(); err != nil {
+		return DocumentMeta{}, err
+	}
+	data, err := json.Marshal(q)
+	if err != nil {
+		return DocumentMeta{}, err
+	}
+	name := fileName(q.Key)
+	if err := writeFileAtomic(filepath.Join(model.Dir, name), data); err != nil {
+		return DocumentMeta{}, err
+	}
+	id := CollectionPriorityQueues + "/" + strings.TrimSuffix(name, FileExt)
+	return DocumentMeta{Id: arango.DocumentID(id)}, nil
+}
+
+// Delete removes the file of the priority queue.
+func (model *FileModel) Delete(ctx context.Context, pq interface{}) error {
+	q, ok := pq.(*PriorityQueue)
+	if !ok {
+		return errors.New("file model can only delete priority queues")
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	err := os.Remove(filepath.Join(model.Dir, fileName(q.Key)))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// quarantine handles the undecodable file with the provided name
+// according to the quarantine mode of the model.
+func (model *FileModel) quarantine(name string, cause error) error {
+	switch model.Quarantine {
+	case QuarantineFail:
+		return fmt.Errorf("priority queue file [%s]: %w", name, cause)
+	case QuarantineMove:
+		err := os.Rename(
+			filepath.Join(model.Dir, name),
+			filepath.Join(model.Dir, FileQuarantineDir, name),
+		)
+		if err != nil {
+			return err
+		}
+		log.Printf("moved priority queue file [%s] to quarantine: %v", name, cause)
+	default:
+		log.Printf("skipped priority queue file [%s]: %v", name, cause)
+	}
+	return nil
+}
+
+// fileName returns the file name of the queue with the provided key.
+// Keys are hex encoded so that any key maps to a valid, distinct name.
+func fileName(key string) string {
+	return hex.EncodeToString([]byte(key)) + FileExt
+}
+
+// writeFileAtomic writes the data to a temporary file in the directory
+// of path, syncs it, and renames it over path.
+func writeFileAtomic(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	f, err := os.CreateTemp(dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return err
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
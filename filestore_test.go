@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileModel(t *testing.T) {
+	testModel(t, &FileModel{Dir: t.TempDir()}, `suite/"key"`)
+}
+
+func TestFileModelQuarantine(t *testing.T) {
+	dir := t.TempDir()
+	model := &FileModel{Dir: dir}
+	if err := model.Create(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	model.Save(context.Background(), NewPriorityQueue("good"))
+	bad := filepath.Join(dir, fileName("bad"))
+	if err := os.WriteFile(bad, []byte(`{"_key": "bad", "heap": "not a heap"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := (&FileModel{Dir: dir, Quarantine: QuarantineFail}).FetchAll(context.Background()); err == nil {
+		t.Fatal("expected fail mode to return the decode error")
+	}
+	if queues, err := model.FetchAll(context.Background()); err != nil || len(queues) != 1 {
+		t.Fatal("expected skip mode to return the good queue")
+	}
+	if _, err := model.Fetch(context.Background(), "bad"); err == nil {
+		t.Fatal("expected skip mode fetch by key to return the decode error")
+	}
+	move := &FileModel{Dir: dir, Quarantine: QuarantineMove}
+	if v, err := move.Fetch(context.Background(), "bad"); err != nil || v != nil {
+		t.Fatal("expected move mode fetch by key to treat the moved file as not stored")
+	}
+	if _, err := move.FetchAll(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(bad); !os.IsNotExist(err) {
+		t.Fatal("expected bad file to be moved")
+	}
+	if _, err := os.Stat(filepath.Join(dir, FileQuarantineDir, fileName("bad"))); err != nil {
+		t.Fatal("expected bad file to be quarantined")
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"log"
+
+	"github.com/bitwurx/jrpc2"
+)
+
+// NewLazyApiV1 returns an api that loads queues from the model on first
+// access by key instead of at startup.  Once more than maxQueues queues
+// are loaded the least recently used idle queues are unloaded.
+// A maxQueues of zero never unloads queues.  No queue is loaded at
+// construction, so it cannot fail.
+func NewLazyApiV1(model Model, s *jrpc2.Server, maxQueues int) *ApiV1 {
+	api, _ := NewApiV1WithOptions(model, s, ApiOptions{Lazy: true, MaxLoadedQueues: maxQueues})
+	return api
+}
+
+// lookup returns the locked queue with the provided key, or nil if it
+// does not exist.  A queue that is not loaded is fetched within the
+// request context.
+func (api *ApiV1) lookup(ctx context.Context, key string) (*PriorityQueue, *jrpc2.ErrorObject) {
+	queue, err := api.acquire(ctx, key, false)
+	if err != nil {
+		return nil, storageError(err)
+	}
+	return queue, nil
+}
+
+// lookupOrCreate returns the locked queue with the provided key.  If the
+// queue does not exist it is created.
+func (api *ApiV1) lookupOrCreate(ctx context.Context, key string) (*PriorityQueue, *jrpc2.ErrorObject) {
+	queue, err := api.acquire(ctx, key, true)
+	if err != nil {
+		return nil, storageError(err)
+	}
+	return queue, nil
+}
+
+// acquire returns the locked queue with the provided key.  A queue that
+// is not loaded is fetched from the model if the api loads queues
+// lazily.  If the queue does not exist it is created if create is set,
+// otherwise nil is returned.
+func (api *ApiV1) acquire(ctx context.Context, key string, create bool) (*PriorityQueue, error) {
+	for {
+		queue, ok := api.queues.Get(key)
+		if !ok && api.lazy {
+			return api.acquireStored(ctx, key, create)
+		}
+		if !ok {
+			if !create {
+				return nil, nil
+			}
+			queue = api.queues.GetOrCreate(key)
+		}
+		queue.Lock()
+		if queue.evicted {
+			// unloaded after the lookup, look it up again.
+			queue.Unlock()
+			continue
+		}
+		api.queues.Touch(key)
+		return queue, nil
+	}
+}
+
+// acquireStored registers a locked placeholder for the queue with the
+// provided key and loads the stored queue into it.  Other callers block
+// on the placeholder until it is loaded, so a queue is never loaded
+// twice.  The placeholder is unregistered if the queue is not stored and
+// create is not set, or if the load fails.
+func (api *ApiV1) acquireStored(ctx context.Context, key string, create bool) (*PriorityQueue, error) {
+	queue := NewPriorityQueue(key)
+	queue.Lock()
+	if api.queues.AddIfAbsent(queue) != queue {
+		// registered by another caller meanwhile.
+		queue.Unlock()
+		return api.acquire(ctx, key, create)
+	}
+	loaded, err := api.load(ctx, key)
+	if err != nil || (loaded == nil && !create) {
+		api.unload(queue)
+		queue.Unlock()
+		return nil, err
+	}
+	if loaded != nil {
+		queue.restore(loaded)
+		queue.rev = loaded.rev
+	}
+	api.evict()
+	return queue, nil
+}
+
+// copy returns a copy of the queue with the provided key, or nil if it
+// does not exist.  A queue that is not loaded is read from the model
+// without loading it.
+func (api *ApiV1) copy(ctx context.Context, key string) (*PriorityQueue, *jrpc2.ErrorObject) {
+	if queue, ok := api.queues.Get(key); ok {
+		queue.Lock()
+		if !queue.evicted {
+			defer queue.Unlock()
+			return queue.Copy(), nil
+		}
+		// unloaded after the lookup, read the stored queue.
+		queue.Unlock()
+	}
+	loaded, err := api.load(ctx, key)
+	if err != nil {
+		return nil, storageError(err)
+	}
+	if loaded == nil {
+		return nil, nil
+	}
+	return loaded.Copy(), nil
+}
+
+// keys returns the keys of the stored and the loaded queues.
+func (api *ApiV1) keys(ctx context.Context) ([]string, *jrpc2.ErrorObject) {
+	stored, err := api.model.Keys(ctx)
+	if err != nil {
+		return nil, storageError(err)
+	}
+	seen := make(map[string]bool, len(stored))
+	keys := make([]string, 0, len(stored))
+	for _, key := range stored {
+		if !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	for _, queue := range api.queues.List() {
+		if !seen[queue.Key] {
+			seen[queue.Key] = true
+			keys = append(keys, queue.Key)
+		}
+	}
+	return keys, nil
+}
+
+// load fetches the queue with the provided key from the model and
+// migrates it to the current storage version.  Nil is returned if the
+// queue is not stored.  The storage calls run within the request
+// context, so a load counts against the storage timeout of the request.
+func (api *ApiV1) load(ctx context.Context, key string) (*PriorityQueue, error) {
+	v, err := api.model.Fetch(ctx, key)
+	if err != nil || v == nil {
+		return nil, err
+	}
+	queue := v.(*PriorityQueue)
+	if _, err := Migrate(ctx, api.model, []*PriorityQueue{queue}); err != nil {
+		return nil, err
+	}
+	return queue, nil
+}
+
+// loadSwept loads the stored queues that the sweeper must visit, and
+// sets swept once all are loaded.  Such queues are never unloaded, so
+// the stored queues only need to be read once.  Loading is retried on
+// the next sweep if the stored queues cannot be read.
+func (api *ApiV1) loadSwept() {
+	ctx, cancel := api.context()
+	keys, err := api.model.Keys(ctx)
+	cancel()
+	if err != nil {
+		log.Printf("failed to list the stored queues to sweep: %v", err)
+		return
+	}
+	for _, key := range keys {
+		if _, ok := api.queues.Get(key); ok {
+			continue
+		}
+		ctx, cancel := api.context()
+		queue, err := api.acquire(ctx, key, false)
+		cancel()
+		if err != nil {
+			log.Printf("failed to load queue [%s] to sweep: %v", key, err)
+			return
+		}
+		if queue == nil {
+			continue
+		}
+		if !pinned(queue) {
+			api.unload(queue)
+		}
+		queue.Unlock()
+	}
+	api.swept.Store(true)
+}
+
+// pinned reports whether the queue must stay loaded because the sweeper
+// expires its leases, serves its waiters, purges its expiring tasks, or
+// auto deletes it.  The caller must hold the queue lock.
+func pinned(queue *PriorityQueue) bool {
+	if len(queue.inflight) > 0 || len(queue.waiters) > 0 || queue.Config.AutoDelete > 0 {
+		return true
+	}
+	for _, task := range queue.heap {
+		if task.ExpiresAt != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// unload unregisters the queue.  Changes are stored when they are made,
+// so it is not saved.  The caller must hold the queue lock.
+func (api *ApiV1) unload(queue *PriorityQueue) {
+	queue.evicted = true
+	api.queues.Remove(queue)
+}
+
+// evict unloads the least recently used queues that are not pinned
+// while more than maxQueues queues are loaded.  Queues in use are
+// skipped.
+func (api *ApiV1) evict() {
+	if api.maxQueues <= 0 {
+		return
+	}
+	excess := api.queues.Len() - api.maxQueues
+	for _, queue := range api.queues.LeastRecentlyUsed() {
+		if excess <= 0 {
+			return
+		}
+		if !queue.TryLock() {
+			continue
+		}
+		if !pinned(queue) {
+			api.unload(queue)
+			excess--
+		}
+		queue.Unlock()
+	}
+}
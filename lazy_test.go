@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bitwurx/jrpc2"
+)
+
+func TestApiV1Lazy(t *testing.T) {
+	model := NewMemoryModel()
+	stored := NewPriorityQueue("stored")
+	stored.Push(&Task{Id: "a", Priority: 1.5})
+	if _, err := model.Save(context.Background(), stored); err != nil {
+		t.Fatal(err)
+	}
+	api := NewLazyApiV1(model, jrpc2.NewServer("", ""), 2)
+	defer api.Close()
+	if api.queues.Len() != 0 {
+		t.Fatal("expected no queues to be loaded at startup")
+	}
+	result, errObj := api.Peek([]byte(`{"key": "stored"}`))
+	if errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	if result.(*Task).Id != "a" {
+		t.Fatal("expected stored queue to be loaded on first access")
+	}
+	if _, errObj := api.Get([]byte(`{"key": "missing"}`)); errObj == nil || errObj.Code != QueueNotFoundCode {
+		t.Fatal("expected queue not found error")
+	}
+
+	api.Push([]byte(`{"key": "b", "id": "b", "priority": 1.5}`))
+	api.Push([]byte(`{"key": "c", "id": "c", "priority": 1.5}`))
+	if api.queues.Len() != 2 {
+		t.Fatal("expected loaded queues to be bounded")
+	}
+	if _, ok := api.queues.Get("stored"); ok {
+		t.Fatal("expected least recently used queue to be evicted")
+	}
+	api.Push([]byte(`{"key": "stored", "id": "d", "priority": 2.5}`))
+	v, _ := model.Fetch(context.Background(), "b")
+	if q, ok := v.(*PriorityQueue); !ok || !q.Has("b") {
+		t.Fatal("expected evicted queue to be stored")
+	}
+	queue, _ := api.queues.Get("stored")
+	if queue == nil || !queue.Has("a") || !queue.Has("d") {
+		t.Fatal("expected evicted queue to be reloaded")
+	}
+
+	if _, errObj := api.Lease([]byte(`{"key": "stored", "ttl": 30}`)); errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	api.Push([]byte(`{"key": "e", "id": "e", "priority": 1.5}`))
+	api.Push([]byte(`{"key": "f", "id": "f", "priority": 1.5}`))
+	if _, ok := api.queues.Get("stored"); !ok {
+		t.Fatal("expected queue with leases to stay loaded")
+	}
+
+	loaded := api.queues.Len()
+	result, errObj = api.GetAll(nil)
+	if errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	if api.queues.Len() != loaded {
+		t.Fatal("expected getAll to not load the stored queues")
+	}
+	keys := make(map[string]bool)
+	for _, q := range result.([]*PriorityQueue) {
+		keys[q.Key] = true
+	}
+	for _, key := range []string{"stored", "b", "c", "e", "f"} {
+		if !keys[key] {
+			t.Fatalf("expected getAll to return queue [%s]", key)
+		}
+	}
+	if len(keys) != 5 {
+		t.Fatal("expected getAll to return each queue once")
+	}
+}
+
+func TestApiV1LazyConcurrent(t *testing.T) {
+	model := NewMemoryModel()
+	api := NewLazyApiV1(model, jrpc2.NewServer("", ""), 3)
+	defer api.Close()
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				params := fmt.Sprintf(`{"key": "k%d", "id": "%d-%d", "priority": 1.5}`, j%10, i, j)
+				if _, errObj := api.Push([]byte(params)); errObj != nil {
+					t.Error(errObj.Message)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	total := 0
+	for j := 0; j < 10; j++ {
+		queue, errObj := api.lookup(context.Background(), fmt.Sprintf("k%d", j))
+		if errObj != nil {
+			t.Fatal(errObj.Message)
+		}
+		total += queue.count
+		queue.Unlock()
+	}
+	if total != 400 {
+		t.Fatalf("expected every push to be kept across evictions, got %d", total)
+	}
+}
+
+func TestApiV1LazyPopWait(t *testing.T) {
+	model := NewMemoryModel()
+	stored := NewPriorityQueue("stored")
+	stored.Push(&Task{Id: "a", Priority: 1.5})
+	dlq := NewPriorityQueue(DeadLetterKey("stored"))
+	dlq.Push(&Task{Id: "b", Priority: 2.5})
+	for _, q := range []*PriorityQueue{stored, dlq} {
+		if _, err := model.Save(context.Background(), q); err != nil {
+			t.Fatal(err)
+		}
+	}
+	api := NewLazyApiV1(model, jrpc2.NewServer("", ""), 0)
+	defer api.Close()
+	result, errObj := api.PopWait([]byte(`{"key": "stored", "timeout": 0}`))
+	if errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	if task, ok := result.(*Task); !ok || task.Id != "a" {
+		t.Fatal("expected popWait to load the stored queue")
+	}
+	result, errObj = api.ListDead([]byte(`{"key": "stored"}`))
+	if errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	if tasks := result.([]*Task); len(tasks) != 1 || tasks[0].Id != "b" {
+		t.Fatal("expected listDead to load the stored dead letter queue")
+	}
+}
+
+// deadlineModel is a memory model that records the deadlines of the
+// contexts of its fetches and saves.
+type deadlineModel struct {
+	*MemoryModel
+	mu        sync.Mutex
+	deadlines []time.Time
+}
+
+func (m *deadlineModel) record(ctx context.Context) {
+	deadline, _ := ctx.Deadline()
+	m.mu.Lock()
+	m.deadlines = append(m.deadlines, deadline)
+	m.mu.Unlock()
+}
+
+func (m *deadlineModel) Fetch(ctx context.Context, key string) (interface{}, error) {
+	m.record(ctx)
+	return m.MemoryModel.Fetch(ctx, key)
+}
+
+func (m *deadlineModel) Save(ctx context.Context, pq interface{}) (DocumentMeta, error) {
+	m.record(ctx)
+	return m.MemoryModel.Save(ctx, pq)
+}
+
+func TestApiV1LazyStorageTimeout(t *testing.T) {
+	model := &deadlineModel{MemoryModel: NewMemoryModel()}
+	api, err := NewApiV1WithOptions(model, jrpc2.NewServer("", ""),
+		ApiOptions{Lazy: true, StorageTimeout: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer api.Close()
+	if _, errObj := api.Push([]byte(`{"key": "lazy", "id": "a", "priority": 1.5}`)); errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	if len(model.deadlines) != 2 {
+		t.Fatalf("expected a fetch and a save, got %d storage calls", len(model.deadlines))
+	}
+	if model.deadlines[0].IsZero() || !model.deadlines[0].Equal(model.deadlines[1]) {
+		t.Fatal("expected the load to share the storage timeout of the request")
+	}
+}
+
+func TestApiV1LazySweepExpired(t *testing.T) {
+	model := NewMemoryModel()
+	now := time.Now()
+	expires := now.Add(time.Minute)
+	expiring := NewPriorityQueue("expiring")
+	expiring.Config.RecordExpired = true
+	expiring.Push(&Task{Id: "a", Priority: 1.5, ExpiresAt: &expires})
+	idle := NewPriorityQueue("idle")
+	idle.Push(&Task{Id: "b", Priority: 1.5})
+	for _, q := range []*PriorityQueue{expiring, idle} {
+		if _, err := model.Save(context.Background(), q); err != nil {
+			t.Fatal(err)
+		}
+	}
+	api := NewLazyApiV1(model, jrpc2.NewServer("", ""), 1)
+	defer api.Close()
+	api.Sweep(now)
+	if _, ok := api.queues.Get("idle"); ok {
+		t.Fatal("expected queue without expiring tasks to stay unloaded")
+	}
+	api.Push([]byte(`{"key": "c", "id": "c", "priority": 1.5}`))
+	api.Push([]byte(`{"key": "d", "id": "d", "priority": 1.5}`))
+	if _, ok := api.queues.Get("expiring"); !ok {
+		t.Fatal("expected queue with expiring tasks to stay loaded")
+	}
+
+	api.Sweep(expires)
+	v, _ := model.Fetch(context.Background(), "expiring")
+	if q := v.(*PriorityQueue); q.Has("a") {
+		t.Fatal("expected expired task of a stored queue to be purged")
+	}
+	result, errObj := api.Expired([]byte(`{"key": "expiring"}`))
+	if errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	if ids := result.([]string); len(ids) != 1 || ids[0] != "a" {
+		t.Fatal("expected expired task of a stored queue to be recorded")
+	}
+}
+
+func TestApiV1LazyAutoDelete(t *testing.T) {
+	model := NewMemoryModel()
+	auto := NewPriorityQueue("auto")
+	auto.Config.AutoDelete = 1
+	if _, err := model.Save(context.Background(), auto); err != nil {
+		t.Fatal(err)
+	}
+	api := NewLazyApiV1(model, jrpc2.NewServer("", ""), 1)
+	defer api.Close()
+	now := time.Now()
+	api.Sweep(now)
+	api.Push([]byte(`{"key": "c", "id": "c", "priority": 1.5}`))
+	api.Push([]byte(`{"key": "d", "id": "d", "priority": 1.5}`))
+	if _, ok := api.queues.Get("auto"); !ok {
+		t.Fatal("expected auto deleted queue to stay loaded")
+	}
+
+	api.Sweep(now.Add(2 * time.Second))
+	if v, _ := model.Fetch(context.Background(), "auto"); v != nil {
+		t.Fatal("expected empty stored queue to be auto deleted")
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sort"
+	"time"
+)
+
+const (
+	DeadLetterSuffix = ".dlq" // the key suffix of dead letter queues.
+)
+
+// ErrLeaseNotFound is returned when a task id is not leased from the
+// queue.
+var ErrLeaseNotFound = errors.New("lease not found")
+
+// Lease is a task handed out to a consumer.  The task is held in flight
+// until it is acknowledged, and is requeued with its original priority
+// when it is negatively acknowledged or the lease expires.  A released
+// task that has reached the queue max attempts is dead lettered instead.
+type Lease struct {
+	// Task is the leased task.
+	// Expires is the time the lease expires.
+	Task    *Task     `json:"task"`
+	Expires time.Time `json:"expires"`
+}
+
+// DeadLetterKey returns the key of the dead letter queue that holds the
+// tasks of the queue with the provided key that reached the max attempts.
+func DeadLetterKey(key string) string {
+	return key + DeadLetterSuffix
+}
+
+// Lease removes the min eligible heap node, increments its attempts, and
+// holds it in flight until the expiration time.  Nil is returned if no
+// task is eligible.
+func (pq *PriorityQueue) Lease(expires time.Time) *Lease {
+	i := pq.next(time.Now())
+	if i == -1 {
+		return nil
+	}
+	lease := &Lease{Task: pq.removeAt(i), Expires: expires}
+	lease.Task.Attempts++
+	pq.inflight[lease.Task.Id] = lease
+	log.Printf("leased task [%s] from queue [%s] until %s", lease.Task.Id, pq.Key, expires)
+
+	return lease
+}
+
+// Leases returns the in flight leases ordered by task id.
+func (pq *PriorityQueue) Leases() []*Lease {
+	leases := make([]*Lease, 0, len(pq.inflight))
+	for _, lease := range pq.inflight {
+		leases = append(leases, lease)
+	}
+	sort.Slice(leases, func(i, j int) bool {
+		return leases[i].Task.Id < leases[j].Task.Id
+	})
+	return leases
+}
+
+// Ack completes the lease of the task with the provided id.
+func (pq *PriorityQueue) Ack(id string) error {
+	if _, ok := pq.inflight[id]; !ok {
+		return ErrLeaseNotFound
+	}
+	delete(pq.inflight, id)
+	log.Printf("acked task [%s] in queue [%s]", id, pq.Key)
+
+	return nil
+}
+
+// Nack releases the lease of the task with the provided id and requeues
+// the task.  If the task has reached the max attempts it is returned
+// for dead lettering instead.
+func (pq *PriorityQueue) Nack(id string) (*Task, error) {
+	if _, ok := pq.inflight[id]; !ok {
+		return nil, ErrLeaseNotFound
+	}
+	log.Printf("nacked task [%s] in queue [%s]", id, pq.Key)
+
+	return pq.requeue(id), nil
+}
+
+// RequeueExpired releases all leases that expired at or before now.
+// The ids of the requeued tasks are returned along with the tasks that
+// reached the max attempts and must be dead lettered.
+func (pq *PriorityQueue) RequeueExpired(now time.Time) ([]string, []*Task) {
+	ids := make([]string, 0)
+	dead := make([]*Task, 0)
+	for _, lease := range pq.Leases() {
+		if !lease.Expires.After(now) {
+			log.Printf("lease of task [%s] in queue [%s] expired", lease.Task.Id, pq.Key)
+			if task := pq.requeue(lease.Task.Id); task != nil {
+				dead = append(dead, task)
+			} else {
+				ids = append(ids, lease.Task.Id)
+			}
+		}
+	}
+	return ids, dead
+}
+
+// requeue releases the lease of the task and moves the task back into
+// the heap at its original priority and sequence.  If the task has
+// reached the max attempts it is returned instead of requeued.
+func (pq *PriorityQueue) requeue(id string) *Task {
+	lease := pq.inflight[id]
+	delete(pq.inflight, id)
+	if pq.Config.MaxAttempts > 0 && lease.Task.Attempts >= pq.Config.MaxAttempts {
+		log.Printf("task [%s] in queue [%s] reached %d attempts", id, pq.Key, lease.Task.Attempts)
+		return lease.Task
+	}
+	pq.insert(lease.Task)
+	return nil
+}
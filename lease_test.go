@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestPriorityQueueLease(t *testing.T) {
+	pq := NewPriorityQueue("test")
+	pq.Config.Duplicates = DuplicateReject
+	if pq.Lease(time.Now()) != nil {
+		t.Fatal("expected lease of empty queue to be nil")
+	}
+	pq.Push(&Task{Id: "a", Priority: 2.5})
+	pq.Push(&Task{Id: "b", Priority: 1.5})
+	expires := time.Now().Add(time.Minute)
+	lease := pq.Lease(expires)
+	if lease.Task.Id != "b" || !lease.Expires.Equal(expires) {
+		t.Fatal("expected lease of task 'b'")
+	}
+	if pq.count != 1 || len(pq.inflight) != 1 {
+		t.Fatal("expected leased task to be held in flight")
+	}
+	if _, err := pq.Push(&Task{Id: "b", Priority: 0.5}); err != ErrDuplicateTask {
+		t.Fatal("expected leased task id to be rejected as a duplicate")
+	}
+	if err := pq.Ack("x"); err != ErrLeaseNotFound {
+		t.Fatal("expected lease not found error")
+	}
+	if err := pq.Ack("b"); err != nil {
+		t.Fatal(err)
+	}
+	if len(pq.inflight) != 0 || pq.count != 1 {
+		t.Fatal("expected acked task to be discarded")
+	}
+}
+
+func TestPriorityQueueNack(t *testing.T) {
+	pq := NewPriorityQueue("test")
+	pq.Push(&Task{Id: "a", Priority: 1.5})
+	pq.Push(&Task{Id: "b", Priority: 1.5})
+	pq.Lease(time.Now().Add(time.Minute))
+	if _, err := pq.Nack("x"); err != ErrLeaseNotFound {
+		t.Fatal("expected lease not found error")
+	}
+	if dead, err := pq.Nack("a"); err != nil || dead != nil {
+		t.Fatal("expected nacked task to be requeued")
+	}
+	checkHeap(t, pq)
+	if pq.Peek().Id != "a" {
+		t.Fatal("expected nacked task to keep its queue position")
+	}
+}
+
+func TestPriorityQueueRequeueExpired(t *testing.T) {
+	now := time.Now()
+	pq := NewPriorityQueue("test")
+	pq.Push(&Task{Id: "a", Priority: 1.5})
+	pq.Push(&Task{Id: "b", Priority: 2.5})
+	pq.Push(&Task{Id: "c", Priority: 3.5})
+	pq.Lease(now.Add(time.Second))
+	pq.Lease(now.Add(time.Minute))
+	ids, dead := pq.RequeueExpired(now.Add(2 * time.Second))
+	if len(ids) != 1 || ids[0] != "a" || len(dead) != 0 {
+		t.Fatal("expected lease of task 'a' to expire")
+	}
+	checkHeap(t, pq)
+	if pq.Peek().Id != "a" || pq.Peek().Priority != 1.5 {
+		t.Fatal("expected expired task to be requeued with its original priority")
+	}
+	if _, ok := pq.inflight["b"]; !ok {
+		t.Fatal("expected lease of task 'b' to be held")
+	}
+}
+
+func TestPriorityQueueLeasePersistence(t *testing.T) {
+	expires := time.Now().Add(time.Minute).UTC()
+	pq := NewPriorityQueue("test")
+	pq.Push(&Task{Id: "a", Priority: 1.5})
+	pq.Push(&Task{Id: "b", Priority: 2.5})
+	pq.Lease(expires)
+	data, err := json.Marshal(pq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := new(PriorityQueue)
+	if err := json.Unmarshal(data, restored); err != nil {
+		t.Fatal(err)
+	}
+	lease, ok := restored.inflight["a"]
+	if !ok || !lease.Expires.Equal(expires) || lease.Task.Priority != 1.5 {
+		t.Fatal("expected lease of task 'a' to be restored")
+	}
+	if ids, _ := restored.RequeueExpired(expires); len(ids) != 1 {
+		t.Fatal("expected restored lease to expire")
+	}
+	if restored.Pop().Id != "a" {
+		t.Fatal("expected requeued task to be next in queue")
+	}
+}
+
+func TestPriorityQueueMaxAttempts(t *testing.T) {
+	now := time.Now()
+	pq := NewPriorityQueue("test")
+	pq.Config.MaxAttempts = 2
+	pq.Push(&Task{Id: "a", Priority: 1.5})
+	pq.Lease(now)
+	if dead, _ := pq.Nack("a"); dead != nil {
+		t.Fatal("expected task to be requeued after the first attempt")
+	}
+	if lease := pq.Lease(now); lease.Task.Attempts != 2 {
+		t.Fatal("expected task attempts to be 2")
+	}
+	ids, dead := pq.RequeueExpired(now)
+	if len(ids) != 0 || len(dead) != 1 || dead[0].Id != "a" {
+		t.Fatal("expected task to be dead lettered after the second attempt")
+	}
+	if pq.count != 0 || len(pq.inflight) != 0 {
+		t.Fatal("expected dead lettered task to leave the queue")
+	}
+}
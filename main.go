@@ -1,12 +1,99 @@
 package main
 
 import (
+	"context"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
 	"github.com/bitwurx/jrpc2"
 )
 
+const (
+	StorageArango = "arango" // store queues in an arangodb database.
+	StorageFile   = "file"   // store queues as files on the local disk.
+	StorageMemory = "memory" // keep queues in memory until the process exits.
+	StorageTasks  = "tasks"  // store each task as a document in an arangodb database.
+)
+
+const (
+	LoadEager = "eager" // load all queues at startup.
+	LoadLazy  = "lazy"  // load queues on first access.
+)
+
 func main() {
-	InitDatabase()
+	quarantine := QuarantineMode(os.Getenv("QUARANTINE_MODE"))
+	if !quarantine.Valid() {
+		log.Fatalf("unknown quarantine mode %q", quarantine)
+	}
+	var model Model
+	switch os.Getenv("STORAGE") {
+	case StorageFile:
+		dir := os.Getenv("STORAGE_DIR")
+		if dir == "" {
+			dir = "data"
+		}
+		model = &FileModel{Dir: dir, Quarantine: quarantine}
+		if err := model.Create(context.Background()); err != nil {
+			log.Fatal(err)
+		}
+	case StorageMemory:
+		model = NewMemoryModel()
+	case StorageTasks:
+		if err := initDatabase(); err != nil {
+			log.Fatal(err)
+		}
+		model = &TaskModel{Quarantine: quarantine}
+		if err := model.Create(context.Background()); err != nil {
+			log.Fatal(err)
+		}
+	default:
+		if err := initDatabase(); err != nil {
+			log.Fatal(err)
+		}
+		model = &PriorityQueueModel{Quarantine: quarantine}
+	}
+	policy := DefaultRetryPolicy
+	if n, err := strconv.Atoi(os.Getenv("STORAGE_RETRIES")); err == nil {
+		policy.Attempts = n
+	}
+	if d, err := time.ParseDuration(os.Getenv("STORAGE_RETRY_BACKOFF")); err == nil {
+		policy.Backoff = d
+	}
+	model = NewRetryModel(model, policy)
+	if path := os.Getenv("WAL_PATH"); path != "" {
+		compact, _ := strconv.Atoi(os.Getenv("WAL_COMPACT_RECORDS"))
+		model = &WALModel{
+			Model:          model,
+			Path:           path,
+			Sync:           WALSync(os.Getenv("WAL_SYNC")),
+			CompactRecords: compact,
+		}
+	}
+	var opts ApiOptions
+	if os.Getenv("LOAD_QUEUES") == LoadLazy {
+		if os.Getenv("WAL_PATH") != "" {
+			log.Fatal("lazy queue loading cannot be used with a write-ahead log")
+		}
+		opts.Lazy = true
+		opts.MaxLoadedQueues, _ = strconv.Atoi(os.Getenv("MAX_LOADED_QUEUES"))
+	}
+	opts.MaxPayloadSize, _ = strconv.Atoi(os.Getenv("MAX_PAYLOAD_SIZE"))
+	opts.StorageTimeout, _ = time.ParseDuration(os.Getenv("STORAGE_TIMEOUT"))
 	s := jrpc2.NewServer(":8080", "/rpc")
-	NewApiV1(&PriorityQueueModel{}, s)
+	if _, err := NewApiV1WithOptions(model, s, opts); err != nil {
+		log.Fatal(err)
+	}
 	s.Start()
 }
+
+// initDatabase loads the database configuration from the config file,
+// the environment, and the command line, and connects to the database.
+func initDatabase() error {
+	cfg, err := LoadDatabaseConfig(os.Args[1:])
+	if err != nil {
+		return err
+	}
+	return InitDatabase(cfg)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+
+	arango "github.com/arangodb/go-driver"
+)
+
+// MemoryModel is a priority queue model that keeps the serialized queues
+// in memory.  Queues are stored as snapshots so fetched queues share no
+// state with the saved ones, as if they had been read from a database.
+type MemoryModel struct {
+	// mu guards the docs map.
+	// docs is the serialized queues by key.
+	mu   sync.Mutex
+	docs map[string][]byte
+}
+
+// NewMemoryModel returns an empty in memory model instance.
+func NewMemoryModel() *MemoryModel {
+	return &MemoryModel{docs: make(map[string][]byte)}
+}
+
+// Create is a no-op as the in memory model needs no collections.
+func (model *MemoryModel) Create(ctx context.Context) error {
+	return nil
+}
+
+// FetchAll decodes all stored queues.  The in memory model does not
+// block so the context is not checked.
+func (model *MemoryModel) FetchAll(ctx context.Context) ([]interface{}, error) {
+	model.mu.Lock()
+	defer model.mu.Unlock()
+	queues := make([]interface{}, 0, len(model.docs))
+	for _, data := range model.docs {
+		q := new(PriorityQueue)
+		if err := json.Unmarshal(data, q); err != nil {
+			return nil, err
+		}
+		queues = append(queues, q)
+	}
+	return queues, nil
+}
+
+// Fetch decodes the stored queue with the provided key.
+func (model *MemoryModel) Fetch(ctx context.Context, key string) (interface{}, error) {
+	model.mu.Lock()
+	data, ok := model.docs[key]
+	model.mu.Unlock()
+	if !ok {
+		return nil, nil
+	}
+	q := new(PriorityQueue)
+	if err := json.Unmarshal(data, q); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// Keys returns the keys of the stored queues.
+func (model *MemoryModel) Keys(ctx context.Context) ([]string, error) {
+	model.mu.Lock()
+	defer model.mu.Unlock()
+	keys := make([]string, 0, len(model.docs))
+	for key := range model.docs {
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// Delete discards the stored snapshot of the priority queue.
+func (model *MemoryModel) Delete(ctx context.Context, pq interface{}) error {
+	q, ok := pq.(*PriorityQueue)
+	if !ok {
+		return errors.New("memory model can only delete priority queues")
+	}
+	model.mu.Lock()
+	delete(model.docs, q.Key)
+	model.mu.Unlock()
+	return nil
+}
+
+// Save stores a snapshot of the priority queue.
+func (model *MemoryModel) Save(ctx context.Context, pq interface{}) (DocumentMeta, error) {
+	q, ok := pq.(*PriorityQueue)
+	if !ok {
+		return DocumentMeta{}, errors.New("memory model can only save priority queues")
+	}
+	data, err := json.Marshal(q)
+	if err != nil {
+		return DocumentMeta{}, err
+	}
+	model.mu.Lock()
+	model.docs[q.Key] = data
+	model.mu.Unlock()
+	return DocumentMeta{Id: arango.DocumentID(CollectionPriorityQueues + "/" + q.Key)}, nil
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/bitwurx/jrpc2"
+)
+
+func TestMemoryModel(t *testing.T) {
+	testModel(t, NewMemoryModel(), `suite/"key"`)
+}
+
+func TestMemoryModelRestart(t *testing.T) {
+	model := NewMemoryModel()
+	api := NewApiV1(model, jrpc2.NewServer("", ""))
+	api.Push([]byte(`{"key": "restart", "id": "a", "priority": 2}`))
+	api.Push([]byte(`{"key": "restart", "id": "b", "priority": 1}`))
+	api.Lease([]byte(`{"key": "restart", "ttl": 60}`))
+	api.Close()
+
+	api = NewApiV1(model, jrpc2.NewServer("", ""))
+	defer api.Close()
+	queue, ok := api.queues.Get("restart")
+	if !ok {
+		t.Fatal("expected queue to survive the restart")
+	}
+	if _, leased := queue.inflight["b"]; !leased {
+		t.Fatal("expected lease to survive the restart")
+	}
+	result, _ := api.Pop([]byte(`["restart"]`))
+	if task := result.(*Task); task.Id != "a" {
+		t.Fatal("expected queued task to survive the restart")
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"context"
+	"log"
+)
+
+// StorageVersion is the version of the stored priority queue document
+// format.  Version 1 documents were built by string formatting, which
+// rounded priorities to one decimal place and did not escape keys or
+// ids.
+const StorageVersion = 2
+
+// Migrate rewrites the stored documents of the queues that were loaded
+// from an older storage version in the current format and returns the
+// number of rewritten queues.
+func Migrate(ctx context.Context, model Model, queues []*PriorityQueue) (int, error) {
+	n := 0
+	for _, pq := range queues {
+		if pq.version >= StorageVersion {
+			continue
+		}
+		if _, err := pq.Save(ctx, model); err != nil {
+			return n, err
+		}
+		pq.version = StorageVersion
+		n++
+		log.Printf("migrated queue [%s] to storage version %d", pq.Key, StorageVersion)
+	}
+	return n, nil
+}
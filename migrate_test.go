@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+)
+
+// saveRecorder is a mock model that records the keys of saved queues.
+type saveRecorder struct {
+	MockModel
+	saved []string
+}
+
+func (m *saveRecorder) Save(ctx context.Context, pq interface{}) (DocumentMeta, error) {
+	m.saved = append(m.saved, pq.(*PriorityQueue).Key)
+	return DocumentMeta{}, nil
+}
+
+func TestMigrate(t *testing.T) {
+	legacy := new(PriorityQueue)
+	err := json.Unmarshal([]byte(`{"_key": "legacy", "count": 1, "heap": [{"_key": "a", "priority": 2.3}]}`), legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if legacy.Peek().Priority != 2.3 || legacy.Peek().EnqueuedAt.IsZero() {
+		t.Fatal("expected legacy task to be loaded")
+	}
+	current := new(PriorityQueue)
+	data, _ := json.Marshal(NewPriorityQueue("current"))
+	json.Unmarshal(data, current)
+
+	model := new(saveRecorder)
+	n, err := Migrate(context.Background(), model, []*PriorityQueue{legacy, current})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 || len(model.saved) != 1 || model.saved[0] != "legacy" {
+		t.Fatal("expected only the legacy queue to be rewritten")
+	}
+	if n, _ := Migrate(context.Background(), model, []*PriorityQueue{legacy}); n != 0 {
+		t.Fatal("expected migrated queue to not be rewritten again")
+	}
+	legacy.Push(&Task{Id: "b", Priority: 2.3})
+	if task := legacy.Pop(); task.Id != "a" {
+		t.Fatal("expected legacy task to order before a task pushed after migration")
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+
+	"github.com/bitwurx/jrpc2"
+)
+
+// context returns the context of the storage calls of a request.  It is
+// done once the storage timeout elapses.
+func (api *ApiV1) context() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), api.timeout)
+}
+
+// ConflictRetries is the number of times a method that failed with a
+// write conflict is retried on the reloaded queue.
+const ConflictRetries = 3
+
+// storageError returns the json rpc error of a failed write.
+func storageError(err error) *jrpc2.ErrorObject {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return &jrpc2.ErrorObject{
+			Code:    TimeoutCode,
+			Message: TimeoutMsg,
+			Data:    err.Error(),
+		}
+	}
+	if errors.Is(err, ErrConflict) {
+		return &jrpc2.ErrorObject{
+			Code:    ConflictCode,
+			Message: ConflictMsg,
+			Data:    err.Error(),
+		}
+	}
+	return &jrpc2.ErrorObject{
+		Code:    StorageErrorCode,
+		Message: StorageErrorMsg,
+		Data:    err.Error(),
+	}
+}
+
+// persist appends the operations of the queue to the operation log of
+// the model, or saves the whole queue if the model keeps no log.
+func (api *ApiV1) persist(ctx context.Context, queue *PriorityQueue, ops ...*Op) error {
+	if l, ok := api.model.(OpLog); ok {
+		return l.Log(ctx, queue, ops...)
+	}
+	_, err := queue.Save(ctx, api.model)
+	return err
+}
+
+// commit persists the operations of the queue.  If they cannot be
+// persisted undo reverts the in memory change and a storage error is
+// returned, so a client is never told a change succeeded that would be
+// lost on restart.
+func (api *ApiV1) commit(ctx context.Context, queue *PriorityQueue, undo func(), ops ...*Op) *jrpc2.ErrorObject {
+	if err := api.persist(ctx, queue, ops...); err != nil {
+		log.Printf("failed to persist queue [%s]: %v", queue.Key, err)
+		undo()
+		if errors.Is(err, ErrConflict) {
+			api.reload(ctx, queue)
+		}
+		return storageError(err)
+	}
+	return nil
+}
+
+// save saves the queue.  If the save fails the queue is rolled back to
+// the state cloned before the change, if any, and a storage error is
+// returned.  A queue changed by another writer is reloaded instead.
+func (api *ApiV1) save(ctx context.Context, queue *PriorityQueue, state *PriorityQueue) *jrpc2.ErrorObject {
+	if _, err := queue.Save(ctx, api.model); err != nil {
+		log.Printf("failed to save queue [%s]: %v", queue.Key, err)
+		if errors.Is(err, ErrConflict) {
+			api.reload(ctx, queue)
+		} else if state != nil {
+			queue.rollback(state)
+		}
+		return storageError(err)
+	}
+	return nil
+}
+
+// handoff delivers eligible tasks to the waiters of the queue that are
+// receiving and persists their removal.  Delivered tasks cannot be taken
+// back, so a failed write is only logged and the tasks may be delivered
+// again after a restart.
+func (api *ApiV1) handoff(ctx context.Context, queue *PriorityQueue) {
+	handed := queue.Handoff()
+	if len(handed) == 0 {
+		return
+	}
+	if err := api.persist(ctx, queue, PopOps(handed...)...); err != nil {
+		log.Printf("failed to persist handoff of queue [%s]: %v", queue.Key, err)
+	}
+}
+
+// reload replaces the state of the queue with the stored queue after
+// another writer changed it.  A queue that is no longer stored is
+// emptied.  The caller must hold the queue lock.
+func (api *ApiV1) reload(ctx context.Context, queue *PriorityQueue) {
+	v, err := api.model.Fetch(ctx, queue.Key)
+	if err != nil {
+		log.Printf("failed to reload queue [%s]: %v", queue.Key, err)
+		return
+	}
+	stored := NewPriorityQueue(queue.Key)
+	if v != nil {
+		stored = v.(*PriorityQueue)
+	}
+	queue.rollback(stored)
+	queue.rev = stored.rev
+	log.Printf("reloaded queue [%s] changed by another writer", queue.Key)
+}
+
+// retryConflicts wraps the method so that it is retried, up to
+// ConflictRetries times, when it fails with a write conflict.  The
+// failed attempt has been rolled back and its queues reloaded, so the
+// retry applies to the state stored by the other writer.
+func (api *ApiV1) retryConflicts(method func(json.RawMessage) (interface{}, *jrpc2.ErrorObject)) func(json.RawMessage) (interface{}, *jrpc2.ErrorObject) {
+	return func(params json.RawMessage) (interface{}, *jrpc2.ErrorObject) {
+		result, errObj := method(params)
+		for i := 0; i < ConflictRetries && errObj != nil && errObj.Code == ConflictCode; i++ {
+			result, errObj = method(params)
+		}
+		return result, errObj
+	}
+}
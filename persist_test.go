@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bitwurx/jrpc2"
+)
+
+// failingModel is a model whose saves and logged operations fail while
+// fail is set.
+type failingModel struct {
+	MockModel
+	fail atomic.Bool
+}
+
+func (m *failingModel) Save(context.Context, interface{}) (DocumentMeta, error) {
+	if m.fail.Load() {
+		return DocumentMeta{}, errors.New("storage unavailable")
+	}
+	return DocumentMeta{}, nil
+}
+
+// failingLogModel is a failing model with an operation log.
+type failingLogModel struct {
+	failingModel
+}
+
+func (m *failingLogModel) Log(ctx context.Context, pq *PriorityQueue, ops ...*Op) error {
+	_, err := m.Save(ctx, pq)
+	return err
+}
+
+func (m *failingLogModel) Compact(ctx context.Context, queues func() []*PriorityQueue) error {
+	return nil
+}
+
+func expectStorageError(t *testing.T, errObj *jrpc2.ErrorObject) {
+	t.Helper()
+	if errObj == nil || errObj.Code != StorageErrorCode {
+		t.Fatal("expected storage error")
+	}
+	if errObj.Data != "storage unavailable" {
+		t.Fatal("expected storage error data to be the cause")
+	}
+}
+
+func testApiV1StorageError(t *testing.T, model Model, fail *atomic.Bool) {
+	api := NewApiV1(model, jrpc2.NewServer("", ""))
+	defer api.Close()
+	api.Push([]byte(`{"key": "fail", "id": "a", "priority": 1.5}`))
+	api.Push([]byte(`{"key": "fail", "id": "b", "priority": 2.5}`))
+	queue, _ := api.queues.Get("fail")
+	queue.Config.Duplicates = DuplicateReplace
+	fail.Store(true)
+
+	_, errObj := api.Push([]byte(`{"key": "fail", "id": "c", "priority": 0.5}`))
+	expectStorageError(t, errObj)
+	if queue.Has("c") {
+		t.Fatal("expected failed push to be rolled back")
+	}
+	_, errObj = api.Push([]byte(`{"key": "fail", "id": "a", "priority": 0.5}`))
+	expectStorageError(t, errObj)
+	if queue.Peek().Priority != 1.5 {
+		t.Fatal("expected failed replace to be rolled back")
+	}
+	_, errObj = api.Push([]byte(`{"key": "new", "id": "a", "priority": 0.5}`))
+	expectStorageError(t, errObj)
+	if q, ok := api.queues.Get("new"); ok && q.Has("a") {
+		t.Fatal("expected failed push to a new queue to be rolled back")
+	}
+	_, errObj = api.Pop([]byte(`{"key": "fail"}`))
+	expectStorageError(t, errObj)
+	_, errObj = api.PopMany([]byte(`{"key": "fail", "n": 2}`))
+	expectStorageError(t, errObj)
+	_, errObj = api.Remove([]byte(`{"key": "fail", "id": "a"}`))
+	expectStorageError(t, errObj)
+	_, errObj = api.Update([]byte(`{"key": "fail", "id": "a", "priority": 9.5}`))
+	expectStorageError(t, errObj)
+	_, errObj = api.Lease([]byte(`{"key": "fail", "ttl": 30}`))
+	expectStorageError(t, errObj)
+	if queue.count != 2 || queue.Peek().Id != "a" || queue.Peek().Priority != 1.5 {
+		t.Fatal("expected failed operations to be rolled back")
+	}
+	if len(queue.inflight) != 0 {
+		t.Fatal("expected failed lease to be rolled back")
+	}
+
+	fail.Store(false)
+	if _, errObj := api.Lease([]byte(`{"key": "fail", "ttl": 30}`)); errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	fail.Store(true)
+	_, errObj = api.Ack([]byte(`{"key": "fail", "id": "a"}`))
+	expectStorageError(t, errObj)
+	if _, ok := queue.inflight["a"]; !ok {
+		t.Fatal("expected failed ack to be rolled back")
+	}
+	fail.Store(false)
+	if _, errObj := api.Ack([]byte(`{"key": "fail", "id": "a"}`)); errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+}
+
+func TestApiV1StorageError(t *testing.T) {
+	model := new(failingModel)
+	testApiV1StorageError(t, model, &model.fail)
+}
+
+func TestApiV1StorageErrorOpLog(t *testing.T) {
+	model := new(failingLogModel)
+	testApiV1StorageError(t, model, &model.fail)
+}
+
+// keyFailingModel is a model whose saves of the queue with the failing
+// key fail.
+type keyFailingModel struct {
+	MockModel
+	mu   sync.Mutex
+	fail string
+}
+
+func (m *keyFailingModel) setFail(key string) {
+	m.mu.Lock()
+	m.fail = key
+	m.mu.Unlock()
+}
+
+func (m *keyFailingModel) Save(ctx context.Context, pq interface{}) (DocumentMeta, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if pq.(*PriorityQueue).Key == m.fail {
+		return DocumentMeta{}, errors.New("storage unavailable")
+	}
+	return DocumentMeta{}, nil
+}
+
+func TestApiV1DeadLetterStorageError(t *testing.T) {
+	model := new(keyFailingModel)
+	api := NewApiV1(model, jrpc2.NewServer("", ""))
+	defer api.Close()
+	api.Configure([]byte(`{"key": "dead", "config": {"maxAttempts": 1}}`))
+	api.Push([]byte(`{"key": "dead", "id": "a", "priority": 1.5}`))
+	api.Lease([]byte(`{"key": "dead", "ttl": 30}`))
+
+	model.setFail("dead")
+	_, errObj := api.Nack([]byte(`{"key": "dead", "id": "a"}`))
+	expectStorageError(t, errObj)
+	queue, _ := api.queues.Get("dead")
+	if _, ok := queue.inflight["a"]; !ok {
+		t.Fatal("expected failed nack to keep the lease")
+	}
+	if dlq, ok := api.queues.Get(DeadLetterKey("dead")); ok && dlq.count != 0 {
+		t.Fatal("expected dead lettering to be undone")
+	}
+
+	model.setFail(DeadLetterKey("dead"))
+	_, errObj = api.Nack([]byte(`{"key": "dead", "id": "a"}`))
+	expectStorageError(t, errObj)
+	if _, ok := queue.inflight["a"]; !ok {
+		t.Fatal("expected failed dead lettering to keep the lease")
+	}
+
+	model.setFail("")
+	if _, errObj := api.Nack([]byte(`{"key": "dead", "id": "a"}`)); errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	model.setFail(DeadLetterKey("dead"))
+	_, errObj = api.RequeueDead([]byte(`{"key": "dead"}`))
+	expectStorageError(t, errObj)
+	if dlq, _ := api.queues.Get(DeadLetterKey("dead")); dlq.count != 1 || queue.count != 0 {
+		t.Fatal("expected failed requeue to be rolled back")
+	}
+}
+
+// revisionModel is a model shared by several writers that rejects saves
+// of queues whose revision is out of date, like PriorityQueueModel.
+type revisionModel struct {
+	MockModel
+	mu   sync.Mutex
+	rev  int
+	docs map[string][]byte
+	revs map[string]string
+}
+
+func newRevisionModel() *revisionModel {
+	return &revisionModel{docs: make(map[string][]byte), revs: make(map[string]string)}
+}
+
+func (m *revisionModel) FetchAll(ctx context.Context) ([]interface{}, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	queues := make([]interface{}, 0)
+	for key, data := range m.docs {
+		q := new(PriorityQueue)
+		if err := json.Unmarshal(data, q); err != nil {
+			return nil, err
+		}
+		q.rev = m.revs[key]
+		queues = append(queues, q)
+	}
+	return queues, nil
+}
+
+func (m *revisionModel) Fetch(ctx context.Context, key string) (interface{}, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.docs[key]
+	if !ok {
+		return nil, nil
+	}
+	q := new(PriorityQueue)
+	if err := json.Unmarshal(data, q); err != nil {
+		return nil, err
+	}
+	q.rev = m.revs[key]
+	return q, nil
+}
+
+func (m *revisionModel) Save(ctx context.Context, pq interface{}) (DocumentMeta, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	q := pq.(*PriorityQueue)
+	if q.rev != m.revs[q.Key] {
+		return DocumentMeta{}, ErrConflict
+	}
+	data, err := json.Marshal(q)
+	if err != nil {
+		return DocumentMeta{}, err
+	}
+	m.rev++
+	m.docs[q.Key] = data
+	m.revs[q.Key] = strconv.Itoa(m.rev)
+	q.rev = m.revs[q.Key]
+	return DocumentMeta{Rev: q.rev}, nil
+}
+
+func TestApiV1Conflict(t *testing.T) {
+	model := newRevisionModel()
+	s1, s2 := jrpc2.NewServer("", ""), jrpc2.NewServer("", "")
+	a, b := NewApiV1(model, s1), NewApiV1(model, s2)
+	defer a.Close()
+	defer b.Close()
+	push := func(api *ApiV1, params string) {
+		t.Helper()
+		result, errObj := api.retryConflicts(api.Push)([]byte(params))
+		if errObj != nil {
+			t.Fatal(errObj.Message)
+		}
+		if result != 0 {
+			t.Fatal("expected result to be 0")
+		}
+	}
+	push(a, `{"key": "conflict", "id": "a", "priority": 1.5}`)
+	push(b, `{"key": "conflict", "id": "b", "priority": 2.5}`)
+	push(a, `{"key": "conflict", "id": "c", "priority": 3.5}`)
+
+	_, errObj := b.Pop([]byte(`{"key": "conflict"}`))
+	if errObj == nil || errObj.Code != ConflictCode {
+		t.Fatal("expected write conflict error")
+	}
+	queue, _ := b.queues.Get("conflict")
+	if queue.count != 3 {
+		t.Fatal("expected conflicting queue to be reloaded")
+	}
+	result, errObj := b.retryConflicts(b.Pop)([]byte(`{"key": "conflict"}`))
+	if errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+	if result.(*Task).Id != "a" {
+		t.Fatal("expected pop of task 'a'")
+	}
+
+	queues, _ := model.FetchAll(context.Background())
+	stored := queues[0].(*PriorityQueue)
+	if stored.count != 2 || stored.Has("a") || !stored.Has("b") || !stored.Has("c") {
+		t.Fatal("expected changes of both writers to be stored")
+	}
+}
+
+// hungModel is a model whose saves block until their context is done.
+type hungModel struct {
+	MockModel
+}
+
+func (m *hungModel) Save(ctx context.Context, pq interface{}) (DocumentMeta, error) {
+	<-ctx.Done()
+	return DocumentMeta{}, ctx.Err()
+}
+
+func TestApiV1StorageTimeout(t *testing.T) {
+	api, _ := NewApiV1WithOptions(new(hungModel), jrpc2.NewServer("", ""),
+		ApiOptions{StorageTimeout: 10 * time.Millisecond})
+	defer api.Close()
+	start := time.Now()
+	_, errObj := api.Push([]byte(`{"key": "hung", "id": "a", "priority": 1.5}`))
+	if errObj == nil || errObj.Code != TimeoutCode {
+		t.Fatal("expected storage timeout error")
+	}
+	if time.Since(start) > time.Second {
+		t.Fatal("expected push to give up after the storage timeout")
+	}
+	if queue, _ := api.queues.Get("hung"); queue.Has("a") {
+		t.Fatal("expected timed out push to be rolled back")
+	}
+}
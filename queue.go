@@ -1,35 +1,282 @@
 package main
 
 import (
-	"bytes"
+	"container/heap"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
+	"sort"
+	"sync"
+	"time"
 )
 
 // Task is a unit of work that is queued in the priority queue.
 type Task struct {
 	// Id is the unique version 1 uuid assigned for task identification.
 	// Priority is the queue priority order.
-	Id       string  `json:"_key"`
-	Priority float64 `json:"priority"`
+	// Seq is the insertion sequence number that orders tasks with equal
+	// priority first-in-first-out.
+	// Attempts is the number of times the task has been leased.
+	// NotBefore is the optional time before which the task is not
+	// eligible to be dequeued.
+	// ExpiresAt is the optional time at which the task is purged.
+	// EnqueuedAt is the time the task was first pushed.
+	// EffectivePriority is the aged priority reported to clients.
+	// Payload is the optional opaque json document describing the work.
+	// Labels is the optional string metadata of the task.
+	Id                string            `json:"_key"`
+	Priority          float64           `json:"priority"`
+	Seq               uint64            `json:"seq"`
+	Attempts          int               `json:"attempts"`
+	NotBefore         *time.Time        `json:"notBefore,omitempty"`
+	ExpiresAt         *time.Time        `json:"expiresAt,omitempty"`
+	EnqueuedAt        time.Time         `json:"enqueuedAt"`
+	EffectivePriority *float64          `json:"effectivePriority,omitempty"`
+	Payload           json.RawMessage   `json:"payload,omitempty"`
+	Labels            map[string]string `json:"labels,omitempty"`
+}
+
+// Eligible reports whether the task may be dequeued at now.  Expired
+// tasks are not eligible.
+func (t *Task) Eligible(now time.Time) bool {
+	return (t.NotBefore == nil || !t.NotBefore.After(now)) && !t.Expired(now)
+}
+
+// DuplicatePolicy determines how a push of a task id that is already
+// queued is handled.
+type DuplicatePolicy string
+
+const (
+	DuplicateReject  DuplicatePolicy = "reject"  // reject the pushed task.
+	DuplicateReplace DuplicatePolicy = "replace" // replace the queued task.
+	DuplicateMin     DuplicatePolicy = "min"     // keep the task with the lower priority.
+)
+
+// Valid reports whether the policy is a known duplicate policy.  The
+// empty policy is valid and behaves as DuplicateReplace, so that a task
+// id can be pushed again as before duplicate policies existed.
+func (p DuplicatePolicy) Valid() bool {
+	switch p {
+	case "", DuplicateReject, DuplicateReplace, DuplicateMin:
+		return true
+	}
+	return false
+}
+
+// rejects reports whether the policy rejects duplicate task ids.
+func (p DuplicatePolicy) rejects() bool {
+	return p == DuplicateReject
+}
+
+// PushResult describes the effect of a push on the queue.
+type PushResult int
+
+const (
+	PushInserted PushResult = 0 // the task was added to the queue.
+	PushReplaced PushResult = 1 // the task replaced a queued task with the same id.
+	PushIgnored  PushResult = 2 // the queued task with the same id was kept.
+	PushRejected PushResult = 3 // the task was rejected as a duplicate.
+)
+
+// ErrDuplicateTask is returned when a task id is pushed that is already
+// queued and the queue rejects duplicates.
+var ErrDuplicateTask = errors.New("duplicate task id")
+
+// QueueConfig contains the per queue behavior settings.
+type QueueConfig struct {
+	// Duplicates is the duplicate task id policy.
+	// MaxAttempts is the number of leases after which a released task is
+	// dead lettered instead of requeued.  Zero means unlimited.
+	// RecordExpired enables the record of expired task ids.
+	// Aging is the optional priority aging policy.
+	// AutoDelete is the number of seconds after which a queue that
+	// stayed empty is deleted.  Zero keeps empty queues.
+	Duplicates    DuplicatePolicy `json:"duplicates,omitempty"`
+	MaxAttempts   int             `json:"maxAttempts,omitempty"`
+	RecordExpired bool            `json:"recordExpired,omitempty"`
+	Aging         *AgingPolicy    `json:"aging,omitempty"`
+	AutoDelete    float64         `json:"autoDelete,omitempty"`
 }
 
 // PriorityQueue is a min binary heap implementation of a priority queue data
 // structure.
 type PriorityQueue struct {
 	// Key is the task resource key.
+	// Config is the queue behavior configuration.
 	// count is the number of task nodes in the heap.
+	// seq is the sequence number assigned to the next pushed task.
 	// heap is the binary heap where task nodes are stored.
-	Key   string  `json:"_key"`
-	count int     `json:"count"`
-	heap  []*Task `json:"heap"`
+	// index maps task ids to their position in the heap.
+	// labels maps task labels to the ids of the queued tasks carrying them.
+	// inflight is the leased tasks by id.
+	// expired is the recorded ids of expired tasks.
+	// agedAt is the reference time of the aged heap order.
+	// version is the storage version the queue was loaded from.
+	// lsn is the log sequence number of the last logged operation.
+	// rev is the stored document revision the queue was last fetched or
+	// saved at.
+	// evicted is set once the queue is unloaded from the registry.
+	// emptyAt is when the sweeper first found the queue empty.  It is
+	// reset whenever a task is queued or removed.
+	// waiters is the blocked consumers waiting for a task.
+	// mu serializes operations on the queue.
+	Key      string      `json:"_key"`
+	Config   QueueConfig `json:"config"`
+	count    int
+	seq      uint64
+	heap     []*Task
+	index    map[string]int
+	labels   map[label]map[string]struct{}
+	inflight map[string]*Lease
+	expired  []string
+	agedAt   time.Time
+	version  int
+	lsn      uint64
+	rev      string
+	evicted  bool
+	emptyAt  time.Time
+	waiters  []*Waiter
+	mu       sync.Mutex
 }
 
 // NewPriorityQueue returns an initialized priority queue instance.
 func NewPriorityQueue(key string) *PriorityQueue {
-	return &PriorityQueue{key, 0, make([]*Task, 0)}
+	return &PriorityQueue{
+		Key:      key,
+		heap:     make([]*Task, 0),
+		index:    make(map[string]int),
+		labels:   make(map[label]map[string]struct{}),
+		inflight: make(map[string]*Lease),
+	}
+}
+
+// Lock acquires the queue lock.  Callers sharing the queue between
+// goroutines must hold the lock for the duration of any operation.
+func (pq *PriorityQueue) Lock() {
+	pq.mu.Lock()
+}
+
+// TryLock acquires the queue lock if it is free and reports whether it
+// was acquired.
+func (pq *PriorityQueue) TryLock() bool {
+	return pq.mu.TryLock()
+}
+
+// Unlock releases the queue lock.
+func (pq *PriorityQueue) Unlock() {
+	pq.mu.Unlock()
+}
+
+// Copy returns a copy of the priority queue that shares no state with
+// the original.  The copied tasks report their effective priority if the
+// queue ages tasks.
+func (pq *PriorityQueue) Copy() *PriorityQueue {
+	c := NewPriorityQueue(pq.Key)
+	c.Config = pq.Config
+	c.count = pq.count
+	c.seq = pq.seq
+	c.agedAt = pq.agedAt
+	c.lsn = pq.lsn
+	for _, node := range pq.heap {
+		task := pq.view(node)
+		c.heap = append(c.heap, task)
+		c.indexLabels(task)
+	}
+	for id, i := range pq.index {
+		c.index[id] = i
+	}
+	for id, lease := range pq.inflight {
+		task := *lease.Task
+		c.inflight[id] = &Lease{Task: &task, Expires: lease.Expires}
+	}
+	c.expired = pq.ExpiredIds()
+	return c
+}
+
+// clone returns a copy of the queue state that shares no tasks with the
+// queue, for use with rollback.
+func (pq *PriorityQueue) clone() *PriorityQueue {
+	c := NewPriorityQueue(pq.Key)
+	c.Config = pq.Config
+	c.count = pq.count
+	c.seq = pq.seq
+	c.agedAt = pq.agedAt
+	c.version = pq.version
+	c.lsn = pq.lsn
+	for i, node := range pq.heap {
+		task := *node
+		c.heap = append(c.heap, &task)
+		c.index[task.Id] = i
+		c.indexLabels(&task)
+	}
+	for id, lease := range pq.inflight {
+		task := *lease.Task
+		c.inflight[id] = &Lease{Task: &task, Expires: lease.Expires}
+	}
+	c.expired = pq.ExpiredIds()
+	return c
+}
+
+// rollback restores the queue state from a clone taken before a change.
+// The waiters of the queue and the stored revision are kept, as the
+// revision only changes when a save succeeds.
+func (pq *PriorityQueue) rollback(c *PriorityQueue) {
+	pq.restore(c)
+	log.Printf("rolled back queue [%s]", pq.Key)
+}
+
+// restore replaces the queue state with the state of c, keeping the
+// waiters of the queue and the stored revision.
+func (pq *PriorityQueue) restore(c *PriorityQueue) {
+	pq.Config = c.Config
+	pq.count = c.count
+	pq.seq = c.seq
+	pq.agedAt = c.agedAt
+	pq.version = c.version
+	pq.lsn = c.lsn
+	pq.heap = c.heap
+	pq.index = c.index
+	pq.labels = c.labels
+	pq.inflight = c.inflight
+	pq.expired = c.expired
+}
+
+// put inserts the task as is, replacing a queued task with the same id
+// or the task of a lease with the same id.
+func (pq *PriorityQueue) put(t *Task) {
+	if lease, ok := pq.inflight[t.Id]; ok {
+		lease.Task = t
+		return
+	}
+	if i, ok := pq.index[t.Id]; ok {
+		pq.removeAt(i)
+	}
+	if t.Seq >= pq.seq {
+		pq.seq = t.Seq + 1
+	}
+	pq.insert(t)
+}
+
+// undoPush returns a function that restores the task with the provided
+// id to its state before a push.
+func (pq *PriorityQueue) undoPush(id string) func() {
+	if lease, ok := pq.inflight[id]; ok {
+		prev := lease.Task
+		return func() { lease.Task = prev }
+	}
+	if i, ok := pq.index[id]; ok {
+		prev := pq.heap[i]
+		return func() { pq.put(prev) }
+	}
+	seq := pq.seq
+	return func() {
+		if i, ok := pq.index[id]; ok {
+			pq.removeAt(i)
+		}
+		pq.seq = seq
+	}
 }
 
 // List returns all priority queue nodes.
@@ -37,45 +284,78 @@ func (pq *PriorityQueue) List() []*Task {
 	return pq.heap
 }
 
-// Peek returns the min heap node without modifying the heap.
-func (pq *PriorityQueue) Peek() *Task {
-	return pq.heap[0]
+// Has reports whether a task with the provided id is queued or leased.
+func (pq *PriorityQueue) Has(id string) bool {
+	_, queued := pq.index[id]
+	_, leased := pq.inflight[id]
+	return queued || leased
 }
 
-// Pop removes and returns the min heap node.
-func (pq *PriorityQueue) Pop() *Task {
-	if pq.count == 0 {
-		return nil
-	}
-	min := pq.heap[0]
-	pq.heap[0] = pq.heap[pq.count-1]
-	pq.heap = pq.heap[:pq.count-1]
-	pq.minHeapify(pq.heap, 0)
-	pq.count--
-	log.Printf("popped task [%s] from queue [%s]", min, pq.Key)
-
-	return min
+// Sorted returns all priority queue nodes in priority order.
+func (pq *PriorityQueue) Sorted() []*Task {
+	nodes := make([]*Task, pq.count)
+	copy(nodes, pq.heap)
+	sort.Slice(nodes, func(i, j int) bool {
+		return pq.before(nodes[i], nodes[j])
+	})
+	return nodes
 }
 
-// Push inserts a task into the task nodes in priority order.
-func (pq *PriorityQueue) Push(t *Task) {
-	pq.heap = append(pq.heap, t)
-	i := len(pq.heap) - 1
+// Peek returns the min eligible heap node without modifying the heap.
+func (pq *PriorityQueue) Peek() *Task {
+	return pq.PeekMatching(nil)
+}
 
-	for i > 0 {
-		parent := (i - 1) / 2
+// Pop removes and returns the min eligible heap node.
+func (pq *PriorityQueue) Pop() *Task {
+	return pq.PopMatching(nil)
+}
 
-		if pq.heap[i].Priority < pq.heap[parent].Priority {
-			pq.heap[i] = pq.heap[parent]
-			pq.heap[parent] = t
-			i = parent
+// Push inserts a task into the task nodes in priority order.  If a
+// task with the same id is already queued or leased the queue duplicate
+// policy decides whether the push is rejected with ErrDuplicateTask,
+// replaces the queued task, or is ignored.  A replaced task keeps its
+// position among tasks with equal priority.
+func (pq *PriorityQueue) Push(t *Task) (PushResult, error) {
+	i, queued := pq.index[t.Id]
+	lease, leased := pq.inflight[t.Id]
+	if queued || leased {
+		var existing *Task
+		if queued {
+			existing = pq.heap[i]
 		} else {
-			break
+			existing = lease.Task
+		}
+		switch pq.Config.Duplicates {
+		case DuplicateReject:
+			return PushRejected, ErrDuplicateTask
+		case DuplicateMin:
+			if t.Priority >= existing.Priority {
+				return PushIgnored, nil
+			}
+		}
+		t.Seq = existing.Seq
+		t.EnqueuedAt = existing.EnqueuedAt
+		if queued {
+			pq.unindexLabels(existing)
+			pq.indexLabels(t)
+			pq.heap[i] = t
+			pq.fix(i)
+		} else {
+			lease.Task = t
 		}
+		log.Printf("replaced task [%s] in queue [%s]", t.Id, pq.Key)
+		return PushReplaced, nil
 	}
+	t.Seq = pq.seq
+	pq.seq++
+	if t.EnqueuedAt.IsZero() {
+		t.EnqueuedAt = time.Now()
+	}
+	pq.insert(t)
 
-	log.Printf("pushed task [%s] to queue [%s]", t, pq.Key)
-	pq.count++
+	log.Printf("pushed task [%s] to queue [%s]", t.Id, pq.Key)
+	return PushInserted, nil
 }
 
 // Remove the node from the priority queue with the provided id.
@@ -83,106 +363,339 @@ func (pq *PriorityQueue) Remove(id string) error {
 	if pq.count == 0 {
 		return nil
 	}
-	nodeIndex := -1
-	for i, node := range pq.heap {
-		if node.Id == id {
-			nodeIndex = i
-		}
+	i, ok := pq.index[id]
+	if !ok {
+		return errors.New("id not found")
 	}
-	if nodeIndex == -1 {
+	pq.removeAt(i)
+
+	return nil
+}
+
+// Clear removes all nodes and leased tasks from the priority queue and
+// returns the number of removed tasks.
+func (pq *PriorityQueue) Clear() int {
+	n := pq.count + len(pq.inflight)
+	pq.count = 0
+	pq.heap = make([]*Task, 0)
+	pq.index = make(map[string]int)
+	pq.labels = make(map[label]map[string]struct{})
+	pq.inflight = make(map[string]*Lease)
+	log.Printf("cleared %d tasks from queue [%s]", n, pq.Key)
+
+	return n
+}
+
+// Update changes the priority of the task with the provided id and
+// restores the heap order.
+func (pq *PriorityQueue) Update(id string, priority float64) error {
+	i, ok := pq.index[id]
+	if !ok {
 		return errors.New("id not found")
 	}
-	pq.heap[nodeIndex] = pq.heap[pq.count-1]
-	pq.heap = pq.heap[:pq.count-1]
+	pq.heap[i].Priority = priority
+	pq.fix(i)
+	log.Printf("updated task [%s] in queue [%s] to priority %v", id, pq.Key, priority)
+
+	return nil
+}
+
+// Save writes the priority queue to the database.
+func (pq *PriorityQueue) Save(ctx context.Context, pqModel Model) (DocumentMeta, error) {
+	return pqModel.Save(ctx, pq)
+}
+
+// less reports whether the node at index i orders before the node at
+// index j.
+func (pq *PriorityQueue) less(i, j int) bool {
+	return pq.before(pq.heap[i], pq.heap[j])
+}
+
+// before reports whether task a orders before task b.  Tasks are ordered
+// by their effective priority at the aging reference time, and tasks with
+// equal priority are ordered by insertion sequence.
+func (pq *PriorityQueue) before(a, b *Task) bool {
+	if policy := pq.Config.Aging; policy != nil && policy.Rate > 0 && policy.Max == 0 {
+		// uncapped aging orders tasks the same at any reference time.
+		d := a.Priority - b.Priority - policy.Rate*b.EnqueuedAt.Sub(a.EnqueuedAt).Seconds()
+		if d != 0 {
+			return d < 0
+		}
+		return a.Seq < b.Seq
+	}
+	pa := pq.Config.Aging.EffectivePriority(a, pq.agedAt)
+	pb := pq.Config.Aging.EffectivePriority(b, pq.agedAt)
+	if pa != pb {
+		return pa < pb
+	}
+	return a.Seq < b.Seq
+}
+
+// swap exchanges the nodes at indexes i and j and updates the id index.
+func (pq *PriorityQueue) swap(i, j int) {
+	pq.heap[i], pq.heap[j] = pq.heap[j], pq.heap[i]
+	pq.index[pq.heap[i].Id] = i
+	pq.index[pq.heap[j].Id] = j
+}
 
-	i := nodeIndex
+// siftUp moves the node at index i up the heap until its parent orders
+// before it and returns the final index of the node.
+func (pq *PriorityQueue) siftUp(i int) int {
 	for i > 0 {
 		parent := (i - 1) / 2
-		node := pq.heap[i]
-
-		if pq.heap[i].Priority < pq.heap[parent].Priority {
-			pq.heap[i] = pq.heap[parent]
-			pq.heap[parent] = node
-			i = parent
-		} else {
+		if !pq.less(i, parent) {
 			break
 		}
+		pq.swap(i, parent)
+		i = parent
 	}
+	return i
+}
 
-	pq.minHeapify(pq.heap, nodeIndex)
-	pq.count--
+// fix restores the heap order after the node at index i has changed.
+func (pq *PriorityQueue) fix(i int) {
+	if pq.siftUp(i) == i {
+		pq.minHeapify(i)
+	}
+}
 
-	return nil
+// ordered reports whether no node orders before its parent.
+func (pq *PriorityQueue) ordered() bool {
+	for i := 1; i < pq.count; i++ {
+		if pq.less(i, (i-1)/2) {
+			return false
+		}
+	}
+	return true
 }
 
-// Save writes the priority queue to the database.
-func (pq *PriorityQueue) Save(pqModel Model) (DocumentMeta, error) {
-	nodes := make([]*Task, 0)
-	for _, node := range pq.heap {
-		nodes = append(nodes, &Task{Id: node.Id, Priority: node.Priority})
+// next returns the heap index of the min node that is eligible at now,
+// or -1 if no node is eligible.
+func (pq *PriorityQueue) next(now time.Time) int {
+	pq.age(now)
+	return pq.find(func(t *Task) bool {
+		return t.Eligible(now)
+	})
+}
+
+// find returns the heap index of the min node that matches, or -1 if
+// no node matches.  The heap is searched best first so only the nodes
+// that order before the result and their children are visited.
+func (pq *PriorityQueue) find(match func(*Task) bool) int {
+	if pq.count == 0 {
+		return -1
+	}
+	if match(pq.heap[0]) {
+		return 0
 	}
-	pq.heap = nodes
-	return pqModel.Save(pq)
+	frontier := &indexHeap{pq: pq, nodes: []int{0}}
+	for frontier.Len() > 0 {
+		i := heap.Pop(frontier).(int)
+		if match(pq.heap[i]) {
+			return i
+		}
+		for _, child := range []int{(i * 2) + 1, (i * 2) + 2} {
+			if child < pq.count {
+				heap.Push(frontier, child)
+			}
+		}
+	}
+	return -1
 }
 
-// minHeapify the MaxHeapify function on the priority queue nodes.
-func (pq *PriorityQueue) minHeapify(nodes []*Task, i int) {
+// insert adds the node to the heap without assigning a sequence number.
+func (pq *PriorityQueue) insert(t *Task) {
+	pq.emptyAt = time.Time{}
+	pq.heap = append(pq.heap, t)
+	pq.index[t.Id] = pq.count
+	pq.indexLabels(t)
+	pq.count++
+	pq.siftUp(pq.count - 1)
+}
+
+// removeAt removes and returns the node at index i.
+func (pq *PriorityQueue) removeAt(i int) *Task {
+	pq.emptyAt = time.Time{}
+	node := pq.heap[i]
+	last := pq.count - 1
+	if i != last {
+		pq.swap(i, last)
+	}
+	pq.heap[last] = nil
+	pq.heap = pq.heap[:last]
+	pq.count--
+	delete(pq.index, node.Id)
+	pq.unindexLabels(node)
+	if i != last {
+		pq.fix(i)
+	}
+	return node
+}
+
+// minHeapify moves the node at index i down the heap until both of its
+// children order after it.
+func (pq *PriorityQueue) minHeapify(i int) {
 	left := (i * 2) + 1
 	right := (i * 2) + 2
 	min := i
 
-	if left < len(nodes) && nodes[left].Priority < nodes[i].Priority {
+	if left < pq.count && pq.less(left, min) {
 		min = left
 	}
-	if right < len(nodes) && nodes[right].Priority < nodes[i].Priority {
+	if right < pq.count && pq.less(right, min) {
 		min = right
 	}
 	if min != i {
-		node := nodes[i]
-		nodes[i] = nodes[min]
-		nodes[min] = node
-		pq.minHeapify(nodes, min)
+		pq.swap(i, min)
+		pq.minHeapify(min)
 	}
+}
+
+// indexHeap is a min heap of priority queue heap indexes ordered by the
+// nodes they refer to.
+type indexHeap struct {
+	pq    *PriorityQueue
+	nodes []int
+}
 
-	pq.heap = nodes
+func (h *indexHeap) Len() int           { return len(h.nodes) }
+func (h *indexHeap) Less(i, j int) bool { return h.pq.less(h.nodes[i], h.nodes[j]) }
+func (h *indexHeap) Swap(i, j int)      { h.nodes[i], h.nodes[j] = h.nodes[j], h.nodes[i] }
+func (h *indexHeap) Push(x interface{}) { h.nodes = append(h.nodes, x.(int)) }
+func (h *indexHeap) Pop() interface{} {
+	i := h.nodes[len(h.nodes)-1]
+	h.nodes = h.nodes[:len(h.nodes)-1]
+	return i
 }
 
-// MarshalJSON serializes the priority queue key, count, and nodes
-// members.
+// queueDocument is the stored and wire representation of a priority
+// queue.
+type queueDocument struct {
+	Key      string      `json:"_key"`
+	Version  int         `json:"version"`
+	Lsn      uint64      `json:"lsn,omitempty"`
+	Config   QueueConfig `json:"config"`
+	Count    int         `json:"count"`
+	Seq      uint64      `json:"seq"`
+	Heap     []*Task     `json:"heap"`
+	Inflight []*Lease    `json:"inflight"`
+	Expired  []string    `json:"expired"`
+}
+
+// MarshalJSON serializes the priority queue key, storage version,
+// config, count, seq, nodes, inflight, and expired members.
 func (pq *PriorityQueue) MarshalJSON() ([]byte, error) {
-	var buf bytes.Buffer
-	buf.WriteString(
-		fmt.Sprintf(`{"_key": "%s", "count": %d, "heap": %s}`, pq.Key, pq.count, (func() string {
-			nodes := bytes.NewBuffer([]byte("["))
-			for i, node := range pq.heap {
-				nodes.WriteString(
-					fmt.Sprintf(`{"_key": "%s", "priority": %.1f}`, node.Id, node.Priority),
-				)
-				if i < (pq.count - 1) {
-					nodes.WriteByte(',')
-				}
-			}
-			nodes.WriteString("]")
-			return nodes.String()
-		})(),
-		))
-	return buf.Bytes(), nil
+	return json.Marshal(pq.document())
+}
+
+// document returns the stored representation of the queue.
+func (pq *PriorityQueue) document() *queueDocument {
+	return &queueDocument{
+		Key:      pq.Key,
+		Version:  StorageVersion,
+		Lsn:      pq.lsn,
+		Config:   pq.Config,
+		Count:    pq.count,
+		Seq:      pq.seq,
+		Heap:     pq.heap,
+		Inflight: pq.Leases(),
+		Expired:  pq.ExpiredIds(),
+	}
+}
+
+// validate returns a descriptive error for the first inconsistency of
+// the document that cannot be repaired on load.
+func (doc *queueDocument) validate() error {
+	if doc.Key == "" {
+		return errors.New("queue document has no _key")
+	}
+	if !doc.Config.Duplicates.Valid() {
+		return fmt.Errorf("queue [%s] has unknown duplicates policy %q", doc.Key, doc.Config.Duplicates)
+	}
+	if doc.Config.MaxAttempts < 0 {
+		return fmt.Errorf("queue [%s] has negative max attempts", doc.Key)
+	}
+	if !doc.Config.Aging.Valid() {
+		return fmt.Errorf("queue [%s] has negative aging rate or max", doc.Key)
+	}
+	ids := make(map[string]bool)
+	for i, task := range doc.Heap {
+		if task == nil {
+			return fmt.Errorf("queue [%s] heap node %d is null", doc.Key, i)
+		}
+		if ids[task.Id] {
+			return fmt.Errorf("queue [%s] has duplicate task [%s]", doc.Key, task.Id)
+		}
+		ids[task.Id] = true
+	}
+	for i, lease := range doc.Inflight {
+		if lease == nil || lease.Task == nil {
+			return fmt.Errorf("queue [%s] inflight lease %d has no task", doc.Key, i)
+		}
+		if lease.Expires.IsZero() {
+			return fmt.Errorf("queue [%s] lease of task [%s] has no expires time", doc.Key, lease.Task.Id)
+		}
+		if ids[lease.Task.Id] {
+			return fmt.Errorf("queue [%s] has duplicate task [%s]", doc.Key, lease.Task.Id)
+		}
+		ids[lease.Task.Id] = true
+	}
+	return nil
 }
 
 // UnmarshalJSON deserializes the stored priority queue meta data into
-// a priority queue instance.
+// a priority queue instance.  Documents that cannot be decoded or fail
+// validation return an error and leave the queue unchanged.  The count
+// is recomputed from the heap and the heap is rebuilt if the stored node
+// order is invalid.  Tasks stored without an enqueued at time are treated
+// as enqueued now.
 func (pq *PriorityQueue) UnmarshalJSON(b []byte) error {
-	data := make(map[string]interface{})
-	json.Unmarshal(b, &data)
-	pq.Key = data["_key"].(string)
-	pq.count = int(data["count"].(float64))
-	for _, node := range data["heap"].([]interface{}) {
-		v, _ := node.(map[string]interface{})
-		task := &Task{
-			Id:       v["_key"].(string),
-			Priority: v["priority"].(float64),
+	var doc queueDocument
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return fmt.Errorf("decode queue document: %w", err)
+	}
+	if err := doc.validate(); err != nil {
+		return err
+	}
+	now := time.Now()
+	pq.Key = doc.Key
+	pq.version = doc.Version
+	pq.lsn = doc.Lsn
+	pq.Config = doc.Config
+	pq.seq = doc.Seq
+	pq.agedAt = now
+	pq.heap = make([]*Task, 0, len(doc.Heap))
+	pq.index = make(map[string]int)
+	pq.labels = make(map[label]map[string]struct{})
+	pq.inflight = make(map[string]*Lease)
+	pq.expired = doc.Expired
+	for _, task := range doc.Heap {
+		if task.EnqueuedAt.IsZero() {
+			task.EnqueuedAt = now
 		}
+		if task.Seq >= pq.seq {
+			pq.seq = task.Seq + 1
+		}
+		pq.index[task.Id] = len(pq.heap)
+		pq.indexLabels(task)
 		pq.heap = append(pq.heap, task)
 	}
+	pq.count = len(pq.heap)
+	if doc.Count != pq.count {
+		log.Printf("recomputed count of queue [%s] from %d to %d", pq.Key, doc.Count, pq.count)
+	}
+	if !pq.ordered() {
+		log.Printf("rebuilt heap order of queue [%s]", pq.Key)
+		pq.heapify()
+	}
+	for _, lease := range doc.Inflight {
+		if lease.Task.EnqueuedAt.IsZero() {
+			lease.Task.EnqueuedAt = now
+		}
+		if lease.Task.Seq >= pq.seq {
+			pq.seq = lease.Task.Seq + 1
+		}
+		pq.inflight[lease.Task.Id] = lease
+	}
 	return nil
 }
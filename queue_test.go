@@ -1,9 +1,13 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"math"
 	"testing"
+	"time"
+	"unicode/utf8"
 )
 
 func TestNewPriorityQueue(t *testing.T) {
@@ -15,8 +19,8 @@ func TestNewPriorityQueue(t *testing.T) {
 
 func TestPriorityQueuePeek(t *testing.T) {
 	nodes := []*Task{
-		&Task{Priority: 13.5},
-		&Task{Priority: 11.5},
+		&Task{Id: "1", Priority: 13.5},
+		&Task{Id: "2", Priority: 11.5},
 	}
 	pq := NewPriorityQueue("key")
 	for _, task := range nodes {
@@ -29,9 +33,9 @@ func TestPriorityQueuePeek(t *testing.T) {
 
 func TestPriorityQueuePush(t *testing.T) {
 	nodes := []*Task{
-		&Task{Priority: 22.5},
-		&Task{Priority: 3.5},
-		&Task{Priority: 16.5},
+		&Task{Id: "1", Priority: 22.5},
+		&Task{Id: "2", Priority: 3.5},
+		&Task{Id: "3", Priority: 16.5},
 	}
 	pq := NewPriorityQueue("key")
 	for _, task := range nodes {
@@ -48,9 +52,9 @@ func TestPriorityQueuePush(t *testing.T) {
 
 func TestPriorityQueuePop(t *testing.T) {
 	nodes := []*Task{
-		&Task{Priority: 22.5},
-		&Task{Priority: 5.5},
-		&Task{Priority: 125.5},
+		&Task{Id: "1", Priority: 22.5},
+		&Task{Id: "2", Priority: 5.5},
+		&Task{Id: "3", Priority: 125.5},
 	}
 	pq := NewPriorityQueue("key")
 	for _, task := range nodes {
@@ -98,15 +102,190 @@ func TestPriorityQueueRemove(t *testing.T) {
 	}
 }
 
+func TestPriorityQueuePushDuplicate(t *testing.T) {
+	var table = []struct {
+		Policy   DuplicatePolicy
+		Priority float64
+		Result   PushResult
+		Err      error
+		Expected float64
+	}{
+		{"", 1.5, PushReplaced, nil, 1.5},
+		{DuplicateReject, 1.5, PushRejected, ErrDuplicateTask, 5.5},
+		{DuplicateReplace, 9.5, PushReplaced, nil, 9.5},
+		{DuplicateMin, 9.5, PushIgnored, nil, 5.5},
+		{DuplicateMin, 1.5, PushReplaced, nil, 1.5},
+	}
+
+	for _, tt := range table {
+		pq := NewPriorityQueue("test")
+		pq.Config.Duplicates = tt.Policy
+		pq.Push(&Task{Id: "a", Priority: 5.5})
+		pq.Push(&Task{Id: "b", Priority: 3.5})
+		result, err := pq.Push(&Task{Id: "a", Priority: tt.Priority})
+		if result != tt.Result || err != tt.Err {
+			t.Fatalf("policy '%s': got result %d and error %v", tt.Policy, result, err)
+		}
+		checkHeap(t, pq)
+		if pq.count != 2 {
+			t.Fatalf("policy '%s': expected count to be 2", tt.Policy)
+		}
+		if priority := pq.heap[pq.index["a"]].Priority; priority != tt.Expected {
+			t.Fatalf("policy '%s': expected priority %v, got %v", tt.Policy, tt.Expected, priority)
+		}
+	}
+}
+
+func TestPriorityQueueFIFO(t *testing.T) {
+	pq := NewPriorityQueue("test")
+	for i := 0; i < 50; i++ {
+		pq.Push(&Task{Id: fmt.Sprint(i), Priority: float64(i % 2)})
+	}
+	pq.Remove("10")
+	pq.Update("11", 0)
+	data, err := json.Marshal(pq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := new(PriorityQueue)
+	if err := json.Unmarshal(data, restored); err != nil {
+		t.Fatal(err)
+	}
+	restored.Push(&Task{Id: "50", Priority: 0})
+	expected := make([]string, 0)
+	for i := 0; i < 50; i += 2 {
+		if i == 10 {
+			// task 11 keeps its sequence number when its priority changes.
+			expected = append(expected, "11")
+			continue
+		}
+		expected = append(expected, fmt.Sprint(i))
+	}
+	expected = append(expected, "50")
+	for i := 1; i < 50; i += 2 {
+		if i != 11 {
+			expected = append(expected, fmt.Sprint(i))
+		}
+	}
+	for _, id := range expected {
+		if task := restored.Pop(); task.Id != id {
+			t.Fatalf("expected task [%s], got [%s]", id, task.Id)
+		}
+	}
+}
+
+func TestPriorityQueueNotBefore(t *testing.T) {
+	past := time.Now().Add(-time.Minute)
+	future := time.Now().Add(time.Hour)
+	pq := NewPriorityQueue("test")
+	pq.Push(&Task{Id: "a", Priority: 1.5, NotBefore: &future})
+	if pq.Peek() != nil || pq.Pop() != nil {
+		t.Fatal("expected delayed task to be skipped")
+	}
+	for i := 0; i < 20; i++ {
+		pq.Push(&Task{Id: fmt.Sprint(i), Priority: 2.5 + float64(i), NotBefore: &future})
+	}
+	pq.Push(&Task{Id: "b", Priority: 30.5, NotBefore: &past})
+	pq.Push(&Task{Id: "c", Priority: 40.5})
+	if task := pq.Peek(); task == nil || task.Id != "b" {
+		t.Fatal("expected task 'b' to be the next eligible task")
+	}
+	if task := pq.Pop(); task == nil || task.Id != "b" {
+		t.Fatal("expected task 'b' to be popped")
+	}
+	checkHeap(t, pq)
+	if task := pq.Pop(); task == nil || task.Id != "c" {
+		t.Fatal("expected task 'c' to be popped")
+	}
+	if pq.Pop() != nil {
+		t.Fatal("expected no eligible task")
+	}
+	if pq.count != 21 {
+		t.Fatal("expected delayed tasks to remain queued")
+	}
+	data, err := json.Marshal(pq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := new(PriorityQueue)
+	if err := json.Unmarshal(data, restored); err != nil {
+		t.Fatal(err)
+	}
+	if task := restored.heap[restored.index["a"]]; task.NotBefore == nil || !task.NotBefore.Equal(future) {
+		t.Fatal("expected not before time to be restored")
+	}
+}
+
+func TestPriorityQueueUpdate(t *testing.T) {
+	pq := NewPriorityQueue("test")
+	for i, priority := range []float64{5.5, 2.5, 9.5, 7.5, 1.5, 3.5} {
+		pq.Push(&Task{Id: fmt.Sprint(i), Priority: priority})
+	}
+	if err := pq.Update("x", 1.0); err == nil {
+		t.Fatal("expected id not found error")
+	}
+	if err := pq.Update("2", 0.5); err != nil {
+		t.Fatal(err)
+	}
+	checkHeap(t, pq)
+	if pq.Peek().Id != "2" {
+		t.Fatal("expected task '2' to be moved to the front")
+	}
+	if err := pq.Update("2", 8.5); err != nil {
+		t.Fatal(err)
+	}
+	checkHeap(t, pq)
+	order := make([]float64, 0)
+	for task := pq.Pop(); task != nil; task = pq.Pop() {
+		order = append(order, task.Priority)
+	}
+	expected := []float64{1.5, 2.5, 3.5, 5.5, 7.5, 8.5}
+	if fmt.Sprint(order) != fmt.Sprint(expected) {
+		t.Fatalf("got unexpected pop order %v", order)
+	}
+}
+
+func TestPriorityQueueIndex(t *testing.T) {
+	pq := NewPriorityQueue("test")
+	for i := 0; i < 100; i++ {
+		pq.Push(&Task{Id: fmt.Sprint(i), Priority: float64((i * 37) % 101)})
+	}
+	for i := 0; i < 100; i += 3 {
+		if err := pq.Remove(fmt.Sprint(i)); err != nil {
+			t.Fatal(err)
+		}
+		checkHeap(t, pq)
+	}
+	pq.Pop()
+	checkHeap(t, pq)
+}
+
+// checkHeap fails the test if the heap order or the id index of the
+// priority queue is inconsistent.
+func checkHeap(t *testing.T, pq *PriorityQueue) {
+	t.Helper()
+	if pq.count != len(pq.heap) || len(pq.index) != len(pq.heap) {
+		t.Fatalf("count %d, heap %d, and index %d sizes differ", pq.count, len(pq.heap), len(pq.index))
+	}
+	for i, node := range pq.heap {
+		if i > 0 && pq.less(i, (i-1)/2) {
+			t.Fatalf("heap order violated at index %d", i)
+		}
+		if pq.index[node.Id] != i {
+			t.Fatalf("index of task [%s] is %d, expected %d", node.Id, pq.index[node.Id], i)
+		}
+	}
+}
+
 func TestPriorityQueueMarshalJSON(t *testing.T) {
 	pq := NewPriorityQueue("key-123")
-	task := &Task{Priority: 3.5}
+	task := &Task{Priority: 3.5, EnqueuedAt: time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC)}
 	pq.Push(task)
 	data, err := json.Marshal(pq)
 	if err != nil {
 		t.Fatal(err)
 	}
-	dataString := fmt.Sprintf(`{"_key":"key-123","count":1,"heap":[{"_key":"%s","priority":3.5}]}`, task.Id)
+	dataString := fmt.Sprintf(`{"_key":"key-123","version":2,"config":{},"count":1,"seq":1,"heap":[{"_key":"%s","priority":3.5,"seq":0,"attempts":0,"enqueuedAt":"2018-01-02T03:04:05Z"}],"inflight":[],"expired":[]}`, task.Id)
 	if string(data) != dataString {
 		t.Fatal("got unexpected marshal json data string")
 	}
@@ -114,15 +293,174 @@ func TestPriorityQueueMarshalJSON(t *testing.T) {
 
 func TestPriorityQueueUnmarshalJSON(t *testing.T) {
 	pq := new(PriorityQueue)
-	json.Unmarshal([]byte(`{"_key":"key-xyz","count":1,"heap":[{"_key":"%s","priority":3.5}]}`), pq)
+	json.Unmarshal([]byte(`{"_key":"key-xyz","config":{"duplicates":"min"},"count":1,"heap":[{"_key":"%s","priority":3.5}]}`), pq)
 	if pq.Key != "key-xyz" {
 		t.Fatal("expected key to be 'key-xyz'")
 	}
+	if pq.Config.Duplicates != DuplicateMin {
+		t.Fatal("expected duplicates policy to be 'min'")
+	}
 	if pq.Peek().Priority != 3.5 {
 		t.Fatal("expected heap node priority to be 3.5")
 	}
 }
 
+func TestPriorityQueueUnmarshalJSONInvalid(t *testing.T) {
+	var table = []string{
+		`[]`,
+		`{"_key": 12}`,
+		`{"config": {}, "heap": []}`,
+		`{"_key": "k", "count": "1"}`,
+		`{"_key": "k", "heap": [null]}`,
+		`{"_key": "k", "heap": [{"_key": "a", "priority": "high"}]}`,
+		`{"_key": "k", "heap": [{"_key": "a"}, {"_key": "a"}]}`,
+		`{"_key": "k", "heap": [{"_key": "a"}], "inflight": [{"task": {"_key": "a"}, "expires": "2018-01-02T03:04:05Z"}]}`,
+		`{"_key": "k", "inflight": [{"expires": "2018-01-02T03:04:05Z"}]}`,
+		`{"_key": "k", "inflight": [{"task": {"_key": "a"}}]}`,
+		`{"_key": "k", "config": {"duplicates": "keep"}}`,
+		`{"_key": "k", "config": {"maxAttempts": -1}}`,
+		`{"_key": "k", "config": {"aging": {"rate": -1}}}`,
+	}
+	for _, data := range table {
+		pq := NewPriorityQueue("unchanged")
+		if err := json.Unmarshal([]byte(data), pq); err == nil {
+			t.Fatalf("expected an error decoding %s", data)
+		}
+		if pq.Key != "unchanged" {
+			t.Fatal("expected a failed decode to leave the queue unchanged")
+		}
+	}
+}
+
+func TestPriorityQueueUnmarshalJSONRepair(t *testing.T) {
+	pq := new(PriorityQueue)
+	err := json.Unmarshal([]byte(`{"_key": "repair", "count": 7, "heap": [
+		{"_key": "c", "priority": 3, "seq": 0},
+		{"_key": "b", "priority": 2, "seq": 1},
+		{"_key": "a", "priority": 1, "seq": 2}]}`), pq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pq.count != 3 {
+		t.Fatal("expected count to be recomputed from the heap")
+	}
+	checkHeap(t, pq)
+	for _, id := range []string{"a", "b", "c"} {
+		if task := pq.Pop(); task.Id != id {
+			t.Fatalf("expected task [%s], got [%s]", id, task.Id)
+		}
+	}
+}
+
+func TestPriorityQueuePayload(t *testing.T) {
+	pq := NewPriorityQueue("payload")
+	payload := json.RawMessage(`{"url":"http://x/y","n":12345678901234567890,"a":[]}`)
+	pq.Push(&Task{Id: "a", Priority: 1, Payload: payload, Labels: map[string]string{"kind": "fetch"}})
+	pq.Push(&Task{Id: "b", Priority: 2})
+	pq.Lease(time.Now().Add(time.Minute))
+	pq.Push(&Task{Id: "c", Priority: 3, Payload: json.RawMessage(`[1,2.50]`)})
+
+	data, err := json.Marshal(pq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := new(PriorityQueue)
+	if err := json.Unmarshal(data, restored); err != nil {
+		t.Fatal(err)
+	}
+	lease := restored.inflight["a"]
+	if lease == nil || string(lease.Task.Payload) != string(payload) {
+		t.Fatal("expected leased task payload to round trip unchanged")
+	}
+	if lease.Task.Labels["kind"] != "fetch" {
+		t.Fatal("expected leased task labels to round trip")
+	}
+	if task := restored.Pop(); task.Id != "b" || task.Payload != nil || task.Labels != nil {
+		t.Fatal("expected task without payload to have none")
+	}
+	if task := restored.Pop(); string(task.Payload) != `[1,2.50]` {
+		t.Fatal("expected queued task payload to round trip unchanged")
+	}
+}
+
+func TestPriorityQueueMarshalJSONPrecision(t *testing.T) {
+	pq := NewPriorityQueue(`key "quoted"`)
+	pq.Push(&Task{Id: `id "with" \ escapes`, Priority: 2.34})
+	pq.Push(&Task{Id: "tiny", Priority: 1e-9})
+	data, err := json.Marshal(pq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := new(PriorityQueue)
+	if err := json.Unmarshal(data, restored); err != nil {
+		t.Fatal(err)
+	}
+	if restored.Key != pq.Key {
+		t.Fatal("expected escaped key to round trip")
+	}
+	if task := restored.Pop(); task.Id != "tiny" || task.Priority != 1e-9 {
+		t.Fatal("expected small priority to keep its precision")
+	}
+	if task := restored.Pop(); task.Id != `id "with" \ escapes` || task.Priority != 2.34 {
+		t.Fatal("expected escaped id and priority 2.34 to round trip")
+	}
+}
+
+func FuzzPriorityQueueJSON(f *testing.F) {
+	f.Add("key", "id", 2.34, "label", uint8(1))
+	f.Add(`k"ey`, "\\u0000\"", -1e300, "", uint8(0))
+	f.Add("k", "", 0.1, "\n", uint8(3))
+	f.Fuzz(func(t *testing.T, key, id string, priority float64, label string, n uint8) {
+		if !utf8.ValidString(key) || !utf8.ValidString(id) || !utf8.ValidString(label) {
+			t.Skip("json strings are utf-8")
+		}
+		if math.IsNaN(priority) || math.IsInf(priority, 0) {
+			t.Skip("json numbers are finite")
+		}
+		if key == "" {
+			t.Skip("stored queues have a key")
+		}
+		pq := NewPriorityQueue(key)
+		pq.Config.RecordExpired = true
+		payload, _ := json.Marshal(map[string]string{label: id})
+		for i := 0; i < int(n%8); i++ {
+			pq.Push(&Task{
+				Id:       fmt.Sprint(id, i),
+				Priority: priority / float64(i+1),
+				Payload:  payload,
+				Labels:   map[string]string{label: id},
+			})
+		}
+		if n%2 == 1 {
+			pq.Lease(time.Now().Add(time.Minute))
+		}
+		data, err := json.Marshal(pq)
+		if err != nil {
+			t.Fatal(err)
+		}
+		restored := new(PriorityQueue)
+		if err := json.Unmarshal(data, restored); err != nil {
+			t.Fatal(err)
+		}
+		if restored.Key != key || restored.count != pq.count || len(restored.inflight) != len(pq.inflight) {
+			t.Fatal("expected queue members to round trip")
+		}
+		for i, node := range pq.heap {
+			got := restored.heap[i]
+			if got.Id != node.Id || got.Priority != node.Priority || string(got.Payload) != string(node.Payload) {
+				t.Fatalf("expected task [%q] to round trip, got [%q]", node.Id, got.Id)
+			}
+		}
+		again, err := json.Marshal(restored)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(again) != string(data) {
+			t.Fatalf("expected stable encoding\n%s\n%s", data, again)
+		}
+	})
+}
+
 func TestPriorityQueueSave(t *testing.T) {
 	var model Model
 	if testing.Short() {
@@ -132,7 +470,7 @@ func TestPriorityQueueSave(t *testing.T) {
 	}
 	pq := NewPriorityQueue("some-key")
 	pq.Push(&Task{Priority: 13.5})
-	if _, err := pq.Save(model); err != nil {
+	if _, err := pq.Save(context.Background(), model); err != nil {
 		t.Fatal(err)
 	}
 }
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+)
+
+// QueueRegistry is a concurrency safe collection of priority queues
+// indexed by key.  It keeps the queues in least recently used order so
+// that idle queues can be evicted.  Waiters of keys without a queue are
+// kept by the registry and handed to the queue once it is added.
+type QueueRegistry struct {
+	// mu guards the queues and pending maps and the usage list.
+	// queues is the priority queues by key.
+	// used is the keys of the queues, least recently used first.
+	// elements is the elements of the usage list by key.
+	// pending is the waiters of keys without a queue.
+	mu       sync.RWMutex
+	queues   map[string]*PriorityQueue
+	used     *list.List
+	elements map[string]*list.Element
+	pending  map[string][]*Waiter
+}
+
+// NewQueueRegistry returns an empty queue registry instance.
+func NewQueueRegistry() *QueueRegistry {
+	return &QueueRegistry{
+		queues:   make(map[string]*PriorityQueue),
+		used:     list.New(),
+		elements: make(map[string]*list.Element),
+		pending:  make(map[string][]*Waiter),
+	}
+}
+
+// Add inserts the priority queue into the registry, replacing any
+// existing queue with the same key.
+func (r *QueueRegistry) Add(pq *PriorityQueue) {
+	r.mu.Lock()
+	r.put(pq)
+	r.mu.Unlock()
+}
+
+// put inserts the priority queue as the most recently used queue and
+// hands it the pending waiters of its key.  The caller must hold the
+// write lock, and the queue must be locked or not yet shared.
+func (r *QueueRegistry) put(pq *PriorityQueue) {
+	if waiters, ok := r.pending[pq.Key]; ok {
+		pq.waiters = append(pq.waiters, waiters...)
+		delete(r.pending, pq.Key)
+	}
+	r.queues[pq.Key] = pq
+	if e, ok := r.elements[pq.Key]; ok {
+		r.used.MoveToBack(e)
+	} else {
+		r.elements[pq.Key] = r.used.PushBack(pq.Key)
+	}
+}
+
+// AddIfAbsent inserts the priority queue into the registry unless a
+// queue with the same key exists, and returns the registered queue.
+func (r *QueueRegistry) AddIfAbsent(pq *PriorityQueue) *PriorityQueue {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if existing, ok := r.queues[pq.Key]; ok {
+		return existing
+	}
+	r.put(pq)
+	return pq
+}
+
+// Get returns the priority queue with the provided key.
+func (r *QueueRegistry) Get(key string) (*PriorityQueue, bool) {
+	r.mu.RLock()
+	pq, ok := r.queues[key]
+	r.mu.RUnlock()
+	return pq, ok
+}
+
+// GetOrCreate returns the priority queue with the provided key. If the
+// queue does not exist it is created and added to the registry.
+func (r *QueueRegistry) GetOrCreate(key string) *PriorityQueue {
+	if pq, ok := r.Get(key); ok {
+		return pq
+	}
+	return r.AddIfAbsent(NewPriorityQueue(key))
+}
+
+// Touch marks the queue with the provided key as the most recently used.
+func (r *QueueRegistry) Touch(key string) {
+	r.mu.Lock()
+	if e, ok := r.elements[key]; ok {
+		r.used.MoveToBack(e)
+	}
+	r.mu.Unlock()
+}
+
+// Remove removes the priority queue from the registry if it is the
+// registered queue of its key.  The waiters of the queue are kept as
+// pending waiters of its key.  The caller must hold the queue lock.
+func (r *QueueRegistry) Remove(pq *PriorityQueue) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.queues[pq.Key] != pq {
+		return
+	}
+	delete(r.queues, pq.Key)
+	r.used.Remove(r.elements[pq.Key])
+	delete(r.elements, pq.Key)
+	if len(pq.waiters) > 0 {
+		r.pending[pq.Key] = append(pq.waiters, r.pending[pq.Key]...)
+		pq.waiters = nil
+	}
+}
+
+// Wait registers the waiter as a pending waiter of the key if no queue
+// is registered with the key, and reports whether it was registered.
+func (r *QueueRegistry) Wait(key string, w *Waiter) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.queues[key]; ok {
+		return false
+	}
+	r.pending[key] = append(r.pending[key], w)
+	return true
+}
+
+// Waiting reports whether the waiter is a pending waiter of the key.
+func (r *QueueRegistry) Waiting(key string, w *Waiter) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, waiter := range r.pending[key] {
+		if waiter == w {
+			return true
+		}
+	}
+	return false
+}
+
+// CancelWait unregisters the pending waiter of the key, and reports
+// whether it was pending.
+func (r *QueueRegistry) CancelWait(key string, w *Waiter) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i, waiter := range r.pending[key] {
+		if waiter == w {
+			waiters := append(r.pending[key][:i], r.pending[key][i+1:]...)
+			if len(waiters) == 0 {
+				delete(r.pending, key)
+			} else {
+				r.pending[key] = waiters
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// Len returns the number of queues in the registry.
+func (r *QueueRegistry) Len() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.queues)
+}
+
+// LeastRecentlyUsed returns the queues in the registry, least recently
+// used first.
+func (r *QueueRegistry) LeastRecentlyUsed() []*PriorityQueue {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	queues := make([]*PriorityQueue, 0, len(r.queues))
+	for e := r.used.Front(); e != nil; e = e.Next() {
+		queues = append(queues, r.queues[e.Value.(string)])
+	}
+	return queues
+}
+
+// List returns all priority queues in the registry.
+func (r *QueueRegistry) List() []*PriorityQueue {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	queues := make([]*PriorityQueue, 0, len(r.queues))
+	for _, pq := range r.queues {
+		queues = append(queues, pq)
+	}
+	return queues
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestQueueRegistryGetOrCreate(t *testing.T) {
+	r := NewQueueRegistry()
+	queues := make([]*PriorityQueue, 32)
+	var wg sync.WaitGroup
+	for i := range queues {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			queues[i] = r.GetOrCreate("key")
+		}(i)
+	}
+	wg.Wait()
+	for _, pq := range queues {
+		if pq != queues[0] {
+			t.Fatal("expected a single queue instance to be created")
+		}
+	}
+	if len(r.List()) != 1 {
+		t.Fatal("expected registry to contain 1 queue")
+	}
+}
+
+func TestQueueRegistryGet(t *testing.T) {
+	r := NewQueueRegistry()
+	if _, ok := r.Get("key"); ok {
+		t.Fatal("expected queue to not exist")
+	}
+	r.Add(NewPriorityQueue("key"))
+	if pq, ok := r.Get("key"); !ok || pq.Key != "key" {
+		t.Fatal("expected queue with key 'key'")
+	}
+}
+
+func TestQueueRegistryLeastRecentlyUsed(t *testing.T) {
+	r := NewQueueRegistry()
+	a, b, c := NewPriorityQueue("a"), NewPriorityQueue("b"), NewPriorityQueue("c")
+	r.Add(a)
+	r.Add(b)
+	if r.AddIfAbsent(NewPriorityQueue("a")) != a {
+		t.Fatal("expected existing queue to be kept")
+	}
+	if r.AddIfAbsent(c) != c {
+		t.Fatal("expected absent queue to be added")
+	}
+	r.Touch("a")
+	order := r.LeastRecentlyUsed()
+	if len(order) != 3 || order[0] != b || order[1] != c || order[2] != a {
+		t.Fatal("expected queues in least recently used order")
+	}
+	r.Remove(NewPriorityQueue("b"))
+	if r.Len() != 3 {
+		t.Fatal("expected unregistered queue to not be removed")
+	}
+	r.Remove(b)
+	if _, ok := r.Get("b"); ok || r.Len() != 2 || len(r.LeastRecentlyUsed()) != 2 {
+		t.Fatal("expected queue to be removed")
+	}
+}
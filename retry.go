@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+)
+
+// RetryPolicy determines how often and how fast failed storage calls are
+// retried.
+type RetryPolicy struct {
+	// Attempts is the number of calls made before giving up.  Values
+	// below one make a single call.
+	// Backoff is the delay before the first retry.  It doubles after
+	// each retry.
+	// MaxBackoff caps the delay between retries.
+	Attempts   int
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// DefaultRetryPolicy is the retry policy of storage calls unless
+// configured otherwise.
+var DefaultRetryPolicy = RetryPolicy{
+	Attempts:   3,
+	Backoff:    100 * time.Millisecond,
+	MaxBackoff: 2 * time.Second,
+}
+
+// do calls fn until it succeeds or the attempts are exhausted, and
+// returns the last error.  Write conflicts are not retried as they fail
+// until the queue is reloaded.  A conflict of a retry is not returned,
+// as the failed attempt before it may have been stored, so the retry may
+// conflict with its own write; the error of the failed attempt is
+// returned instead.  Waiting for a retry stops when the context is done.
+func (policy RetryPolicy) do(ctx context.Context, name string, fn func() error) error {
+	backoff := policy.Backoff
+	var err error
+	for attempt := 1; ; attempt++ {
+		prev := err
+		err = fn()
+		if attempt > 1 && errors.Is(err, ErrConflict) {
+			log.Printf("storage %s conflicted on retry (attempt %d of %d): %v", name, attempt, policy.Attempts, err)
+			return prev
+		}
+		if err == nil || attempt >= policy.Attempts || errors.Is(err, ErrConflict) {
+			return err
+		}
+		log.Printf("storage %s failed (attempt %d of %d): %v", name, attempt, policy.Attempts, err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return err
+		}
+		backoff *= 2
+		if policy.MaxBackoff > 0 && backoff > policy.MaxBackoff {
+			backoff = policy.MaxBackoff
+		}
+	}
+}
+
+// RetryModel wraps a model and retries its failed calls according to
+// the policy, so that transient storage failures are not surfaced to
+// clients.
+type RetryModel struct {
+	Model
+	Policy RetryPolicy
+}
+
+// NewRetryModel returns the model wrapped with the retry policy.  If the
+// model keeps an operation log its Log and Compact calls are retried as
+// well.
+func NewRetryModel(model Model, policy RetryPolicy) Model {
+	retry := &RetryModel{Model: model, Policy: policy}
+	if l, ok := model.(OpLog); ok {
+		return &retryOpLogModel{RetryModel: retry, log: l}
+	}
+	return retry
+}
+
+// Create creates the storage of the wrapped model.
+func (model *RetryModel) Create(ctx context.Context) error {
+	return model.Policy.do(ctx, "create", func() error {
+		return model.Model.Create(ctx)
+	})
+}
+
+// FetchAll fetches all queues from the wrapped model.
+func (model *RetryModel) FetchAll(ctx context.Context) ([]interface{}, error) {
+	var queues []interface{}
+	err := model.Policy.do(ctx, "fetch", func() error {
+		var err error
+		queues, err = model.Model.FetchAll(ctx)
+		return err
+	})
+	return queues, err
+}
+
+// Fetch fetches the queue with the provided key from the wrapped model.
+func (model *RetryModel) Fetch(ctx context.Context, key string) (interface{}, error) {
+	var pq interface{}
+	err := model.Policy.do(ctx, "fetch", func() error {
+		var err error
+		pq, err = model.Model.Fetch(ctx, key)
+		return err
+	})
+	return pq, err
+}
+
+// Keys returns the keys of the queues of the wrapped model.
+func (model *RetryModel) Keys(ctx context.Context) ([]string, error) {
+	var keys []string
+	err := model.Policy.do(ctx, "keys", func() error {
+		var err error
+		keys, err = model.Model.Keys(ctx)
+		return err
+	})
+	return keys, err
+}
+
+// Save saves the queue to the wrapped model.
+func (model *RetryModel) Save(ctx context.Context, pq interface{}) (DocumentMeta, error) {
+	var meta DocumentMeta
+	err := model.Policy.do(ctx, "save", func() error {
+		var err error
+		meta, err = model.Model.Save(ctx, pq)
+		return err
+	})
+	return meta, err
+}
+
+// Delete deletes the queue from the wrapped model.
+func (model *RetryModel) Delete(ctx context.Context, pq interface{}) error {
+	return model.Policy.do(ctx, "delete", func() error {
+		return model.Model.Delete(ctx, pq)
+	})
+}
+
+// retryOpLogModel is a retry model of a model with an operation log.
+type retryOpLogModel struct {
+	*RetryModel
+	log OpLog
+}
+
+// Log logs the operations of the queue to the wrapped model.
+func (model *retryOpLogModel) Log(ctx context.Context, pq *PriorityQueue, ops ...*Op) error {
+	return model.Policy.do(ctx, "log", func() error {
+		return model.log.Log(ctx, pq, ops...)
+	})
+}
+
+// Compact compacts the log of the wrapped model.
+func (model *retryOpLogModel) Compact(ctx context.Context, queues func() []*PriorityQueue) error {
+	return model.Policy.do(ctx, "compact", func() error {
+		return model.log.Compact(ctx, queues)
+	})
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bitwurx/jrpc2"
+)
+
+// flakyModel is a model whose first calls fail.
+type flakyModel struct {
+	MockModel
+	failures int
+	calls    int
+}
+
+func (m *flakyModel) Save(context.Context, interface{}) (DocumentMeta, error) {
+	m.calls++
+	if m.calls <= m.failures {
+		return DocumentMeta{}, errors.New("transient failure")
+	}
+	return DocumentMeta{}, nil
+}
+
+func (m *flakyModel) Log(ctx context.Context, pq *PriorityQueue, ops ...*Op) error {
+	_, err := m.Save(ctx, pq)
+	return err
+}
+
+func (m *flakyModel) Compact(ctx context.Context, queues func() []*PriorityQueue) error {
+	return nil
+}
+
+func TestRetryModel(t *testing.T) {
+	policy := RetryPolicy{Attempts: 3, Backoff: time.Millisecond, MaxBackoff: time.Millisecond}
+	inner := &flakyModel{failures: 2}
+	model := NewRetryModel(inner, policy)
+	if _, err := model.Save(context.Background(), NewPriorityQueue("retry")); err != nil {
+		t.Fatal(err)
+	}
+	if inner.calls != 3 {
+		t.Fatal("expected save to be retried until it succeeds")
+	}
+
+	inner = &flakyModel{failures: 3}
+	model = NewRetryModel(inner, policy)
+	if _, err := model.Save(context.Background(), NewPriorityQueue("retry")); err == nil {
+		t.Fatal("expected the last error once attempts are exhausted")
+	}
+	if inner.calls != 3 {
+		t.Fatal("expected save to be attempted 3 times")
+	}
+
+	inner = &flakyModel{failures: 1}
+	model = NewRetryModel(inner, policy)
+	l, ok := model.(OpLog)
+	if !ok {
+		t.Fatal("expected operation log of the wrapped model to be kept")
+	}
+	if err := l.Log(context.Background(), NewPriorityQueue("retry"), PushOp(&Task{Id: "a"})); err != nil {
+		t.Fatal(err)
+	}
+	if inner.calls != 2 {
+		t.Fatal("expected log to be retried")
+	}
+	if _, ok := NewRetryModel(MockModel{}, policy).(OpLog); ok {
+		t.Fatal("expected model without operation log to keep none")
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := RetryPolicy{Attempts: 4, Backoff: 10 * time.Millisecond, MaxBackoff: 15 * time.Millisecond}
+	start := time.Now()
+	policy.do(context.Background(), "test", func() error { return errors.New("failure") })
+	// waits of 10ms, 15ms, and 15ms once capped.
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond || elapsed > time.Second {
+		t.Fatalf("expected capped exponential backoff, took %v", elapsed)
+	}
+}
+
+// lostReplyModel is a revision model whose next save is stored but
+// fails as if its reply was lost.
+type lostReplyModel struct {
+	*revisionModel
+	lose atomic.Bool
+}
+
+func (m *lostReplyModel) Save(ctx context.Context, pq interface{}) (DocumentMeta, error) {
+	q := pq.(*PriorityQueue)
+	rev := q.rev
+	meta, err := m.revisionModel.Save(ctx, pq)
+	if err == nil && m.lose.CompareAndSwap(true, false) {
+		q.rev = rev
+		return DocumentMeta{}, errors.New("connection reset")
+	}
+	return meta, err
+}
+
+func TestRetryModelLostReply(t *testing.T) {
+	inner := &lostReplyModel{revisionModel: newRevisionModel()}
+	policy := RetryPolicy{Attempts: 3, Backoff: time.Millisecond, MaxBackoff: time.Millisecond}
+	api := NewApiV1(NewRetryModel(inner, policy), jrpc2.NewServer("", ""))
+	defer api.Close()
+	api.Push([]byte(`{"key": "lost", "id": "a", "priority": 1.5}`))
+	api.Push([]byte(`{"key": "lost", "id": "b", "priority": 2.5}`))
+
+	inner.lose.Store(true)
+	_, errObj := api.retryConflicts(api.Pop)([]byte(`{"key": "lost"}`))
+	if errObj == nil || errObj.Code != StorageErrorCode {
+		t.Fatal("expected the lost reply to be returned as a storage error")
+	}
+	v, _ := inner.Fetch(context.Background(), "lost")
+	if stored := v.(*PriorityQueue); !stored.Has("b") {
+		t.Fatal("expected the next task to not be popped by a retry")
+	}
+}
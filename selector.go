@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"time"
+)
+
+// Selector matches tasks whose labels contain all of its key value
+// pairs.  The empty selector matches every task.
+type Selector map[string]string
+
+// Matches reports whether the task carries every label of the selector.
+func (s Selector) Matches(t *Task) bool {
+	for k, v := range s {
+		if label, ok := t.Labels[k]; !ok || label != v {
+			return false
+		}
+	}
+	return true
+}
+
+// parseSelector parses a positional selector object.  A null selector is
+// treated as omitted.
+func parseSelector(arg interface{}) (Selector, error) {
+	if arg == nil {
+		return nil, nil
+	}
+	v, ok := arg.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("selector must be an object")
+	}
+	selector := make(Selector, len(v))
+	for k, label := range v {
+		s, ok := label.(string)
+		if !ok {
+			return nil, errors.New("selector values must be strings")
+		}
+		selector[k] = s
+	}
+	return selector, nil
+}
+
+// label is a single task label key value pair.
+type label struct {
+	key   string
+	value string
+}
+
+// indexLabels adds the queued task to the label index.
+func (pq *PriorityQueue) indexLabels(t *Task) {
+	if pq.labels == nil {
+		pq.labels = make(map[label]map[string]struct{})
+	}
+	for k, v := range t.Labels {
+		l := label{k, v}
+		ids, ok := pq.labels[l]
+		if !ok {
+			ids = make(map[string]struct{})
+			pq.labels[l] = ids
+		}
+		ids[t.Id] = struct{}{}
+	}
+}
+
+// unindexLabels removes the queued task from the label index.
+func (pq *PriorityQueue) unindexLabels(t *Task) {
+	for k, v := range t.Labels {
+		l := label{k, v}
+		if ids, ok := pq.labels[l]; ok {
+			delete(ids, t.Id)
+			if len(ids) == 0 {
+				delete(pq.labels, l)
+			}
+		}
+	}
+}
+
+// nextMatching returns the heap index of the min node that is eligible
+// at now and matches the selector, or -1 if no node matches.  The ids
+// carrying the least common label of the selector are scanned when there
+// are few enough of them, otherwise the heap is searched best first which
+// stops early when matching tasks are common.
+func (pq *PriorityQueue) nextMatching(now time.Time, selector Selector) int {
+	if len(selector) == 0 {
+		return pq.next(now)
+	}
+	var candidates map[string]struct{}
+	for k, v := range selector {
+		ids := pq.labels[label{k, v}]
+		if len(ids) == 0 {
+			return -1
+		}
+		if candidates == nil || len(ids) < len(candidates) {
+			candidates = ids
+		}
+	}
+	pq.age(now)
+	match := func(t *Task) bool {
+		return t.Eligible(now) && selector.Matches(t)
+	}
+	if len(candidates)*len(candidates) > pq.count {
+		return pq.find(match)
+	}
+	min := -1
+	for id := range candidates {
+		i := pq.index[id]
+		if match(pq.heap[i]) && (min == -1 || pq.less(i, min)) {
+			min = i
+		}
+	}
+	return min
+}
+
+// PeekMatching returns the min eligible heap node that matches the
+// selector without modifying the heap.
+func (pq *PriorityQueue) PeekMatching(selector Selector) *Task {
+	i := pq.nextMatching(time.Now(), selector)
+	if i == -1 {
+		return nil
+	}
+	return pq.heap[i]
+}
+
+// PopMatching removes and returns the min eligible heap node that
+// matches the selector.
+func (pq *PriorityQueue) PopMatching(selector Selector) *Task {
+	i := pq.nextMatching(time.Now(), selector)
+	if i == -1 {
+		return nil
+	}
+	min := pq.removeAt(i)
+	log.Printf("popped task [%s] from queue [%s]", min.Id, pq.Key)
+
+	return min
+}
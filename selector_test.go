@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// checkLabels verifies the label index holds exactly the queued tasks.
+func checkLabels(t *testing.T, pq *PriorityQueue) {
+	n := 0
+	for l, ids := range pq.labels {
+		for id := range ids {
+			i, ok := pq.index[id]
+			if !ok || pq.heap[i].Labels[l.key] != l.value {
+				t.Fatalf("expected indexed task [%s] to be queued with label %s=%s", id, l.key, l.value)
+			}
+			n++
+		}
+	}
+	expected := 0
+	for _, node := range pq.heap {
+		expected += len(node.Labels)
+	}
+	if n != expected {
+		t.Fatalf("expected %d indexed labels, got %d", expected, n)
+	}
+}
+
+func TestSelectorMatches(t *testing.T) {
+	task := &Task{Labels: map[string]string{"gpu": "false", "region": "eu"}}
+	var table = []struct {
+		Selector Selector
+		Match    bool
+	}{
+		{nil, true},
+		{Selector{"gpu": "false"}, true},
+		{Selector{"gpu": "false", "region": "eu"}, true},
+		{Selector{"gpu": "true"}, false},
+		{Selector{"zone": ""}, false},
+	}
+	for _, tt := range table {
+		if tt.Selector.Matches(task) != tt.Match {
+			t.Fatalf("expected selector %v match to be %v", tt.Selector, tt.Match)
+		}
+	}
+}
+
+func TestPriorityQueuePopMatching(t *testing.T) {
+	for _, n := range []int{4, 400} {
+		pq := NewPriorityQueue("selector")
+		for i := 0; i < n; i++ {
+			labels := map[string]string{"gpu": "false", "region": "us"}
+			if i%2 == 1 {
+				labels["gpu"] = "true"
+			}
+			if i%4 == 3 {
+				labels["region"] = "eu"
+			}
+			pq.Push(&Task{Id: fmt.Sprint(i), Priority: float64(n - i), Labels: labels})
+		}
+		checkLabels(t, pq)
+		if pq.PeekMatching(Selector{"region": "ap"}) != nil {
+			t.Fatal("expected no task to match an unknown label")
+		}
+		if task := pq.PeekMatching(Selector{"gpu": "false"}); task.Id != fmt.Sprint(n-2) {
+			t.Fatalf("expected min task without gpu, got [%s]", task.Id)
+		}
+		for i := n - 1; i >= 0; i -= 4 {
+			task := pq.PopMatching(Selector{"gpu": "true", "region": "eu"})
+			if task == nil || task.Id != fmt.Sprint(i) {
+				t.Fatalf("expected task [%d] to be popped", i)
+			}
+			checkHeap(t, pq)
+			checkLabels(t, pq)
+		}
+		if pq.PopMatching(Selector{"gpu": "true", "region": "eu"}) != nil {
+			t.Fatal("expected no more matching tasks")
+		}
+		notBefore := time.Now().Add(time.Hour)
+		pq.Push(&Task{Id: "later", Priority: 0, NotBefore: &notBefore, Labels: map[string]string{"gpu": "true", "region": "eu"}})
+		if pq.PeekMatching(Selector{"gpu": "true", "region": "eu"}) != nil {
+			t.Fatal("expected matching task that is not eligible to be skipped")
+		}
+	}
+}
+
+func TestPriorityQueueLabelsIndex(t *testing.T) {
+	pq := NewPriorityQueue("labels")
+	pq.Config.Duplicates = DuplicateReplace
+	pq.Push(&Task{Id: "a", Priority: 1, Labels: map[string]string{"kind": "x"}})
+	pq.Push(&Task{Id: "b", Priority: 2, Labels: map[string]string{"kind": "x"}})
+	pq.Push(&Task{Id: "a", Priority: 1, Labels: map[string]string{"kind": "y"}})
+	checkLabels(t, pq)
+	if task := pq.PeekMatching(Selector{"kind": "x"}); task.Id != "b" {
+		t.Fatal("expected replaced task labels to be reindexed")
+	}
+	lease := pq.Lease(time.Now().Add(time.Minute))
+	checkLabels(t, pq)
+	if pq.PeekMatching(Selector{"kind": "y"}) != nil {
+		t.Fatal("expected leased task to not match")
+	}
+	pq.Nack(lease.Task.Id)
+	checkLabels(t, pq)
+
+	data, _ := json.Marshal(pq)
+	restored := new(PriorityQueue)
+	json.Unmarshal(data, restored)
+	checkLabels(t, restored)
+	checkLabels(t, pq.Copy())
+	pq.Clear()
+	checkLabels(t, pq)
+}
@@ -0,0 +1,448 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	arango "github.com/arangodb/go-driver"
+)
+
+// The collection names are set from the configuration by InitDatabase.
+var (
+	CollectionTaskQueues = "task_queues" // the name of the queue documents collection of the task layout.
+	CollectionTasks      = "tasks"       // the name of the task documents collection of the task layout.
+)
+
+// taskQueueDocument is the stored queue document of the task layout.  It
+// holds the queue members other than its tasks.
+type taskQueueDocument struct {
+	Key     string      `json:"_key"`
+	Version int         `json:"version"`
+	Config  QueueConfig `json:"config"`
+	Seq     uint64      `json:"seq"`
+	Expired []string    `json:"expired"`
+}
+
+// taskDocument is the stored document of a queued or leased task.
+type taskDocument struct {
+	// Key is derived from the queue key and task id.
+	// Queue is the key of the queue of the task.
+	// Task is the task.
+	// Expires is the lease expiry time if the task is leased.
+	Key     string     `json:"_key"`
+	Queue   string     `json:"queue"`
+	Task    *Task      `json:"task"`
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+// taskDocumentKey returns the document key of the task with the provided
+// id in the queue with the provided key.  Queue keys and task ids may
+// contain characters that are not allowed in document keys, so the key
+// is a hash of both.
+func taskDocumentKey(queue, id string) string {
+	sum := sha256.Sum256([]byte(queue + "\x00" + id))
+	return hex.EncodeToString(sum[:])
+}
+
+// TaskModel is a priority queue model that stores each task as its own
+// document in the tasks collection, so the size of a queue is not bound
+// by the document size limit.  Logged operations write single task
+// documents, and saving a queue, which is left to configuration changes,
+// dead lettering, and migrations, only writes the task documents that
+// changed.
+type TaskModel struct {
+	// Quarantine is the handling of undecodable documents.  The empty
+	// mode behaves as QuarantineSkip.
+	Quarantine QuarantineMode
+}
+
+// Create creates the queue, task, and quarantine collections and the
+// index of tasks by queue.
+func (model *TaskModel) Create(ctx context.Context) error {
+	for _, name := range []string{CollectionTaskQueues, CollectionTasks, CollectionQuarantine} {
+		_, err := db.CreateCollection(ctx, name, nil)
+		if err != nil && !arango.IsConflict(err) {
+			return err
+		}
+	}
+	col, err := db.Collection(ctx, CollectionTasks)
+	if err != nil {
+		return err
+	}
+	_, _, err = col.EnsureHashIndex(ctx, []string{"queue"}, nil)
+	return err
+}
+
+// FetchAll rebuilds the queues from the queue and task documents.  Tasks
+// of a queue without a queue document are loaded into a queue with the
+// default config.
+func (model *TaskModel) FetchAll(ctx context.Context) ([]interface{}, error) {
+	docs := make(map[string]*queueDocument)
+	order := make([]string, 0)
+	get := func(key string) *queueDocument {
+		doc, ok := docs[key]
+		if !ok {
+			doc = &queueDocument{Key: key, Version: StorageVersion}
+			docs[key] = doc
+			order = append(order, key)
+		}
+		return doc
+	}
+
+	query := fmt.Sprintf("FOR d IN %s RETURN d", CollectionTaskQueues)
+	if err := model.read(ctx, CollectionTaskQueues, query, nil, addQueueDocument(get)); err != nil {
+		return nil, err
+	}
+	query = fmt.Sprintf("FOR d IN %s RETURN d", CollectionTasks)
+	if err := model.read(ctx, CollectionTasks, query, nil, addTaskDocument(get)); err != nil {
+		return nil, err
+	}
+
+	queues := make([]interface{}, 0, len(docs))
+	for _, key := range order {
+		q, err := model.build(ctx, docs[key])
+		if err != nil {
+			return nil, err
+		}
+		if q != nil {
+			queues = append(queues, q)
+		}
+	}
+	return queues, nil
+}
+
+// Fetch rebuilds the queue with the provided key from its queue and task
+// documents.  A queue that fails validation is treated as not stored
+// once it is moved to quarantine, otherwise an error is returned.
+func (model *TaskModel) Fetch(ctx context.Context, key string) (interface{}, error) {
+	var doc *queueDocument
+	get := func(string) *queueDocument {
+		if doc == nil {
+			doc = &queueDocument{Key: key, Version: StorageVersion}
+		}
+		return doc
+	}
+	query := fmt.Sprintf("FOR d IN %s FILTER d._key == @key RETURN d", CollectionTaskQueues)
+	vars := map[string]interface{}{"key": key}
+	if err := model.read(ctx, CollectionTaskQueues, query, vars, addQueueDocument(get)); err != nil {
+		return nil, err
+	}
+	query = fmt.Sprintf("FOR d IN %s FILTER d.queue == @key RETURN d", CollectionTasks)
+	if err := model.read(ctx, CollectionTasks, query, vars, addTaskDocument(get)); err != nil {
+		return nil, err
+	}
+	if doc == nil {
+		return nil, nil
+	}
+	q, err := model.build(ctx, doc)
+	if err != nil {
+		return nil, err
+	}
+	if q == nil && model.Quarantine != QuarantineMove {
+		// the documents stay stored, so the queue must not be recreated
+		// over them.
+		return nil, fmt.Errorf("%s document [%s] failed validation", CollectionTaskQueues, key)
+	}
+	return q, nil
+}
+
+// Keys returns the keys of the queues with a queue document or tasks.
+func (model *TaskModel) Keys(ctx context.Context) ([]string, error) {
+	query := fmt.Sprintf(
+		"FOR key IN UNION_DISTINCT((FOR q IN %s RETURN q._key), (FOR t IN %s RETURN DISTINCT t.queue)) RETURN key",
+		CollectionTaskQueues, CollectionTasks,
+	)
+	return queryStrings(ctx, query, nil)
+}
+
+// addQueueDocument returns a decoder of queue documents that copies them
+// into the queue documents returned by get.
+func addQueueDocument(get func(string) *queueDocument) func(string, json.RawMessage) error {
+	return func(key string, raw json.RawMessage) error {
+		var meta taskQueueDocument
+		if err := json.Unmarshal(raw, &meta); err != nil {
+			return err
+		}
+		doc := get(meta.Key)
+		doc.Version = meta.Version
+		doc.Config = meta.Config
+		doc.Seq = meta.Seq
+		doc.Expired = meta.Expired
+		return nil
+	}
+}
+
+// addTaskDocument returns a decoder of task documents that adds their
+// tasks to the queue documents returned by get.
+func addTaskDocument(get func(string) *queueDocument) func(string, json.RawMessage) error {
+	return func(key string, raw json.RawMessage) error {
+		var task taskDocument
+		if err := json.Unmarshal(raw, &task); err != nil {
+			return err
+		}
+		if task.Task == nil {
+			return errors.New("task document has no task")
+		}
+		doc := get(task.Queue)
+		if task.Expires != nil {
+			doc.Inflight = append(doc.Inflight, &Lease{Task: task.Task, Expires: *task.Expires})
+		} else {
+			doc.Heap = append(doc.Heap, task.Task)
+		}
+		return nil
+	}
+}
+
+// build decodes the queue from the assembled queue document.  A queue
+// that fails validation is quarantined and nil is returned.
+func (model *TaskModel) build(ctx context.Context, doc *queueDocument) (*PriorityQueue, error) {
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	q := new(PriorityQueue)
+	if err := json.Unmarshal(data, q); err != nil {
+		return nil, model.quarantineQueue(ctx, doc.Key, data, err)
+	}
+	return q, nil
+}
+
+// read decodes every document of the collection returned by the query
+// with decode.  Documents that cannot be decoded are handled by the
+// quarantine mode.
+func (model *TaskModel) read(ctx context.Context, collection, query string, bindVars map[string]interface{}, decode func(string, json.RawMessage) error) error {
+	cursor, err := db.Query(ctx, query, bindVars)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close()
+	for {
+		var raw json.RawMessage
+		meta, err := cursor.ReadDocument(ctx, &raw)
+		if arango.IsNoMoreDocuments(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := decode(meta.Key, raw); err != nil {
+			if err := quarantineDocument(ctx, model.Quarantine, collection, meta.Key, raw, err); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// quarantineQueue handles the queue that failed validation.  Its queue
+// document is quarantined, and in move mode its task documents are moved
+// with it so that they are not loaded into a new queue with the default
+// config on the next fetch.
+func (model *TaskModel) quarantineQueue(ctx context.Context, key string, data []byte, cause error) error {
+	if err := quarantineDocument(ctx, model.Quarantine, CollectionTaskQueues, key, data, cause); err != nil {
+		return err
+	}
+	if model.Quarantine != QuarantineMove {
+		return nil
+	}
+	docs := make(map[string]json.RawMessage)
+	query := fmt.Sprintf("FOR t IN %s FILTER t.queue == @queue RETURN t", CollectionTasks)
+	collect := func(key string, raw json.RawMessage) error {
+		docs[key] = raw
+		return nil
+	}
+	if err := model.read(ctx, CollectionTasks, query, map[string]interface{}{"queue": key}, collect); err != nil {
+		return err
+	}
+	for taskKey, raw := range docs {
+		if err := quarantineDocument(ctx, QuarantineMove, CollectionTasks, taskKey, raw, cause); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Save writes the task documents of the queue that changed, removes the
+// task documents of tasks that are no longer queued or leased, and then
+// writes the queue document.  The queue document is written last so
+// that a failed save never stores a queue document, such as a config or
+// sequence, ahead of the tasks it describes.
+func (model *TaskModel) Save(ctx context.Context, pq interface{}) (DocumentMeta, error) {
+	q, ok := pq.(*PriorityQueue)
+	if !ok {
+		return DocumentMeta{}, errors.New("task model can only save priority queues")
+	}
+	doc := q.document()
+
+	wanted := make(map[string][]byte)
+	add := func(task *Task, expires *time.Time) error {
+		key := taskDocumentKey(doc.Key, task.Id)
+		data, err := json.Marshal(&taskDocument{Key: key, Queue: doc.Key, Task: task, Expires: expires})
+		wanted[key] = data
+		return err
+	}
+	for _, task := range doc.Heap {
+		if err := add(task, nil); err != nil {
+			return DocumentMeta{}, err
+		}
+	}
+	for _, lease := range doc.Inflight {
+		expires := lease.Expires
+		if err := add(lease.Task, &expires); err != nil {
+			return DocumentMeta{}, err
+		}
+	}
+
+	tasks, err := db.Collection(ctx, CollectionTasks)
+	if err != nil {
+		return DocumentMeta{}, err
+	}
+	query := fmt.Sprintf("FOR t IN %s FILTER t.queue == @queue RETURN t", CollectionTasks)
+	cursor, err := db.Query(ctx, query, map[string]interface{}{"queue": doc.Key})
+	if err != nil {
+		return DocumentMeta{}, err
+	}
+	defer cursor.Close()
+	for {
+		var stored taskDocument
+		_, err := cursor.ReadDocument(ctx, &stored)
+		if arango.IsNoMoreDocuments(err) {
+			break
+		} else if err != nil {
+			return DocumentMeta{}, err
+		}
+		data, ok := wanted[stored.Key]
+		if !ok {
+			if _, err := tasks.RemoveDocument(ctx, stored.Key); err != nil && !arango.IsNotFound(err) {
+				return DocumentMeta{}, err
+			}
+			continue
+		}
+		if current, err := json.Marshal(&stored); err == nil && string(current) == string(data) {
+			delete(wanted, stored.Key)
+		}
+	}
+	for key, data := range wanted {
+		if _, err := putDocument(ctx, tasks, key, json.RawMessage(data)); err != nil {
+			return DocumentMeta{}, err
+		}
+	}
+
+	meta, err := putQueueDocument(ctx, doc)
+	if err != nil {
+		return DocumentMeta{}, err
+	}
+	return DocumentMeta{Id: meta.ID}, nil
+}
+
+// putQueueDocument writes the queue members other than its tasks to the
+// queue document.
+func putQueueDocument(ctx context.Context, doc *queueDocument) (arango.DocumentMeta, error) {
+	queues, err := db.Collection(ctx, CollectionTaskQueues)
+	if err != nil {
+		return arango.DocumentMeta{}, err
+	}
+	return putDocument(ctx, queues, doc.Key, &taskQueueDocument{
+		Key:     doc.Key,
+		Version: doc.Version,
+		Config:  doc.Config,
+		Seq:     doc.Seq,
+		Expired: doc.Expired,
+	})
+}
+
+// removeTasks removes the task documents of the queue with the provided
+// key.
+func removeTasks(ctx context.Context, key string) error {
+	query := fmt.Sprintf("FOR t IN %s FILTER t.queue == @queue REMOVE t IN %s", CollectionTasks, CollectionTasks)
+	cursor, err := db.Query(ctx, query, map[string]interface{}{"queue": key})
+	if err != nil {
+		return err
+	}
+	return cursor.Close()
+}
+
+// Delete removes the task documents and the queue document of the queue.
+func (model *TaskModel) Delete(ctx context.Context, pq interface{}) error {
+	q, ok := pq.(*PriorityQueue)
+	if !ok {
+		return errors.New("task model can only delete priority queues")
+	}
+	if err := removeTasks(ctx, q.Key); err != nil {
+		return err
+	}
+	queues, err := db.Collection(ctx, CollectionTaskQueues)
+	if err != nil {
+		return err
+	}
+	if _, err := queues.RemoveDocument(ctx, q.Key); err != nil && !arango.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// Log writes the task documents changed by the operations of the queue.
+// Pushes, leases, and nacks insert or replace a single task document,
+// pops, removals, acks, and expiries delete one, and updates patch its
+// priority.  A clear deletes the task documents of the queue, and the
+// queue document is written once if expired tasks are recorded.
+func (model *TaskModel) Log(ctx context.Context, pq *PriorityQueue, ops ...*Op) error {
+	tasks, err := db.Collection(ctx, CollectionTasks)
+	if err != nil {
+		return err
+	}
+	expired := false
+	for _, op := range ops {
+		switch op.Type {
+		case OpPush:
+			key := taskDocumentKey(pq.Key, op.Task.Id)
+			doc := &taskDocument{Key: key, Queue: pq.Key, Task: op.Task}
+			if lease, ok := pq.inflight[op.Task.Id]; ok {
+				doc.Expires = &lease.Expires
+			}
+			_, err = putDocument(ctx, tasks, key, doc)
+		case OpLease, OpNack:
+			key := taskDocumentKey(pq.Key, op.Task.Id)
+			doc := &taskDocument{Key: key, Queue: pq.Key, Task: op.Task, Expires: op.Expires}
+			_, err = putDocument(ctx, tasks, key, doc)
+		case OpPop, OpRemove, OpAck, OpExpire:
+			_, err = tasks.RemoveDocument(ctx, taskDocumentKey(pq.Key, op.Id))
+			if arango.IsNotFound(err) {
+				err = nil
+			}
+			expired = expired || op.Type == OpExpire
+		case OpUpdate:
+			patch := map[string]interface{}{
+				"task": map[string]interface{}{"priority": op.Priority},
+			}
+			_, err = tasks.UpdateDocument(ctx, taskDocumentKey(pq.Key, op.Id), patch)
+		case OpClear:
+			err = removeTasks(ctx, pq.Key)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if expired && pq.Config.RecordExpired {
+		_, err = putQueueDocument(ctx, pq.document())
+	}
+	return err
+}
+
+// Compact does nothing as the task layout keeps no operation log.
+func (model *TaskModel) Compact(ctx context.Context, queues func() []*PriorityQueue) error {
+	return nil
+}
+
+// putDocument creates the document with the provided key in the
+// collection or replaces it if it exists.
+func putDocument(ctx context.Context, col arango.Collection, key string, doc interface{}) (arango.DocumentMeta, error) {
+	meta, err := col.CreateDocument(ctx, doc)
+	if arango.IsConflict(err) {
+		return col.ReplaceDocument(ctx, key, doc)
+	}
+	return meta, err
+}
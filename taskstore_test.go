@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestTaskDocumentKey(t *testing.T) {
+	var table = [][2]string{
+		{"queue", "id"},
+		{"queue/", "id"},
+		{"queue", "/id"},
+		{"que", "ue\x00id"},
+	}
+	keys := make(map[string]bool)
+	for _, pair := range table {
+		key := taskDocumentKey(pair[0], pair[1])
+		if keys[key] {
+			t.Fatalf("expected distinct document key for %q", pair)
+		}
+		keys[key] = true
+		if key != taskDocumentKey(pair[0], pair[1]) {
+			t.Fatal("expected document key to be stable")
+		}
+	}
+}
+
+func TestTaskModelSuite(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+	testModel(t, new(TaskModel), "suite:key")
+}
+
+func TestTaskModelQuarantine(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+	model := &TaskModel{Quarantine: QuarantineMove}
+	if err := model.Create(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	pq := NewPriorityQueue("task-bad")
+	pq.Push(&Task{Id: "a", Priority: 1})
+	if _, err := model.Save(context.Background(), pq); err != nil {
+		t.Fatal(err)
+	}
+	queues, err := db.Collection(nil, CollectionTaskQueues)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad := map[string]interface{}{"_key": pq.Key, "version": StorageVersion, "config": map[string]interface{}{"duplicates": "bogus"}}
+	if _, err := queues.ReplaceDocument(nil, pq.Key, bad); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		fetched, err := model.FetchAll(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, q := range fetched {
+			if q.(*PriorityQueue).Key == pq.Key {
+				t.Fatal("expected quarantined queue to not be fetched")
+			}
+		}
+	}
+	tasks, err := db.Collection(nil, CollectionTasks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exists, _ := tasks.DocumentExists(nil, taskDocumentKey(pq.Key, "a")); exists {
+		t.Fatal("expected task documents to be moved with the queue")
+	}
+}
+
+func TestTaskModelLog(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+	model := new(TaskModel)
+	if err := model.Create(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	pq := NewPriorityQueue("task-log")
+	a, b := &Task{Id: "a", Priority: 2}, &Task{Id: "b", Priority: 3}
+	pq.Push(a)
+	pq.Push(b)
+	if err := model.Log(context.Background(), pq, PushOp(a), PushOp(b)); err != nil {
+		t.Fatal(err)
+	}
+	pq.Update("b", 1)
+	pq.Pop()
+	ops := []*Op{{Type: OpUpdate, Id: "b", Priority: 1}, {Type: OpPop, Id: "b"}}
+	if err := model.Log(context.Background(), pq, ops...); err != nil {
+		t.Fatal(err)
+	}
+	lease := pq.Lease(time.Now().Add(time.Minute))
+	if err := model.Log(context.Background(), pq, LeaseOp(lease)); err != nil {
+		t.Fatal(err)
+	}
+
+	queues, err := model.FetchAll(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, q := range queues {
+		if q := q.(*PriorityQueue); q.Key == pq.Key {
+			if q.count != 0 || q.inflight["a"] == nil {
+				t.Fatal("expected only the leased task to be stored")
+			}
+			return
+		}
+	}
+	t.Fatal("expected queue to be fetched")
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// Waiter is a consumer blocked waiting for the next eligible task of a
+// queue.
+type Waiter struct {
+	// C receives the handed off task.  It is unbuffered, so a task is
+	// only handed to a consumer that is receiving and a consumer that
+	// stopped waiting is never handed a task.
+	// Wake is signalled when a task could not be handed to the waiter,
+	// or when the waiter was released without a task, so that the
+	// consumer takes the task itself or stops waiting.
+	C    chan *Task
+	Wake chan struct{}
+}
+
+// NewWaiter returns a waiter instance.
+func NewWaiter() *Waiter {
+	return &Waiter{C: make(chan *Task), Wake: make(chan struct{}, 1)}
+}
+
+// wake signals the waiter without blocking.
+func (w *Waiter) wake() {
+	select {
+	case w.Wake <- struct{}{}:
+	default:
+	}
+}
+
+// Wait registers the waiter for the next eligible task of the queue.
+// Waiters are served in the order they were registered.
+func (pq *PriorityQueue) Wait(w *Waiter) {
+	pq.waiters = append(pq.waiters, w)
+}
+
+// CancelWait unregisters the waiter.  False is returned if the waiter
+// is not registered.
+func (pq *PriorityQueue) CancelWait(w *Waiter) bool {
+	for i, waiter := range pq.waiters {
+		if waiter == w {
+			pq.waiters = append(pq.waiters[:i], pq.waiters[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Handoff pops eligible tasks and delivers them to the waiters in the
+// order they were registered.  If the first waiter is not receiving it
+// is woken to take the task itself and the task stays queued.  The
+// delivered tasks are returned.
+func (pq *PriorityQueue) Handoff() []*Task {
+	var tasks []*Task
+	for len(pq.waiters) > 0 {
+		i := pq.next(time.Now())
+		if i == -1 {
+			break
+		}
+		select {
+		case pq.waiters[0].C <- pq.view(pq.heap[i]):
+		default:
+			pq.waiters[0].wake()
+			return tasks
+		}
+		task := pq.removeAt(i)
+		pq.waiters = pq.waiters[1:]
+		log.Printf("handed off task [%s] from queue [%s]", task.Id, pq.Key)
+		tasks = append(tasks, task)
+	}
+	return tasks
+}
+
+// Take pops the next eligible task for the waiter if it is the first
+// registered waiter, and unregisters it.  Nil is returned if the waiter
+// is not first or no task is eligible.
+func (pq *PriorityQueue) Take(w *Waiter) *Task {
+	if len(pq.waiters) == 0 || pq.waiters[0] != w {
+		return nil
+	}
+	i := pq.next(time.Now())
+	if i == -1 {
+		return nil
+	}
+	pq.waiters = pq.waiters[1:]
+	return pq.removeAt(i)
+}
+
+// release wakes and unregisters all waiters of the queue without a task.
+func (pq *PriorityQueue) release() {
+	for _, w := range pq.waiters {
+		w.wake()
+	}
+	pq.waiters = nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// receive waits for the waiter to receive a task handed off from the
+// queue, retrying the handoff until the waiter is receiving.
+func receive(t *testing.T, pq *PriorityQueue, w *Waiter) *Task {
+	ch := make(chan *Task, 1)
+	go func() { ch <- <-w.C }()
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		pq.Handoff()
+		select {
+		case task := <-ch:
+			return task
+		case <-time.After(time.Millisecond):
+		}
+	}
+	t.Fatal("expected waiter to receive a task")
+	return nil
+}
+
+func TestPriorityQueueHandoff(t *testing.T) {
+	pq := NewPriorityQueue("test")
+	first := NewWaiter()
+	second := NewWaiter()
+	pq.Wait(first)
+	pq.Wait(second)
+	if len(pq.Handoff()) != 0 {
+		t.Fatal("expected no handoff from an empty queue")
+	}
+	pq.Push(&Task{Id: "a", Priority: 2.5})
+	pq.Push(&Task{Id: "b", Priority: 1.5})
+	if len(pq.Handoff()) != 0 {
+		t.Fatal("expected no handoff to a waiter that is not receiving")
+	}
+	select {
+	case <-first.Wake:
+	default:
+		t.Fatal("expected first waiter to be woken")
+	}
+	if pq.count != 2 {
+		t.Fatal("expected tasks to stay queued")
+	}
+	if task := receive(t, pq, first); task.Id != "b" {
+		t.Fatal("expected first waiter to receive task 'b'")
+	}
+	if task := receive(t, pq, second); task.Id != "a" {
+		t.Fatal("expected second waiter to receive task 'a'")
+	}
+	checkHeap(t, pq)
+	if pq.count != 0 || len(pq.waiters) != 0 {
+		t.Fatal("expected queue and waiters to be empty")
+	}
+}
+
+func TestPriorityQueueTake(t *testing.T) {
+	pq := NewPriorityQueue("test")
+	first := NewWaiter()
+	second := NewWaiter()
+	pq.Wait(first)
+	pq.Wait(second)
+	if pq.Take(first) != nil {
+		t.Fatal("expected no task from an empty queue")
+	}
+	pq.Push(&Task{Id: "a", Priority: 1.5})
+	if pq.Take(second) != nil {
+		t.Fatal("expected second waiter to wait for the first")
+	}
+	if task := pq.Take(first); task == nil || task.Id != "a" {
+		t.Fatal("expected first waiter to take task 'a'")
+	}
+	if len(pq.waiters) != 1 || pq.waiters[0] != second {
+		t.Fatal("expected first waiter to be unregistered")
+	}
+	pq.release()
+	select {
+	case <-second.Wake:
+	default:
+		t.Fatal("expected released waiter to be woken")
+	}
+	if len(pq.waiters) != 0 {
+		t.Fatal("expected waiters to be released")
+	}
+}
+
+func TestPriorityQueueCancelWait(t *testing.T) {
+	pq := NewPriorityQueue("test")
+	first := NewWaiter()
+	second := NewWaiter()
+	pq.Wait(first)
+	pq.Wait(second)
+	if !pq.CancelWait(first) {
+		t.Fatal("expected waiter to be cancelled")
+	}
+	pq.Push(&Task{Id: "a", Priority: 1.5})
+	if task := receive(t, pq, second); task.Id != "a" {
+		t.Fatal("expected remaining waiter to receive task 'a'")
+	}
+	if pq.CancelWait(second) {
+		t.Fatal("expected cancel of a served waiter to fail")
+	}
+}
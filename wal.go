@@ -0,0 +1,603 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultCompactRecords = 10000 // the default number of logged operations between snapshots.
+)
+
+// OpType is the kind of a logged queue operation.
+type OpType string
+
+const (
+	OpPush   OpType = "push"   // a task was inserted or replaced.
+	OpPop    OpType = "pop"    // a task was popped or handed off.
+	OpRemove OpType = "remove" // a task was removed.
+	OpUpdate OpType = "update" // the priority of a task was changed.
+	OpDelete OpType = "delete" // the queue was deleted.
+	OpLease  OpType = "lease"  // a task was leased.
+	OpAck    OpType = "ack"    // a lease was completed or its task dead lettered.
+	OpNack   OpType = "nack"   // a lease was released and its task requeued.
+	OpExpire OpType = "expire" // an expired task was purged.
+	OpClear  OpType = "clear"  // every queued and leased task was removed.
+)
+
+// Op is a logged queue operation.  Operations record their outcome
+// rather than their request so that replay does not depend on the time
+// or on the duplicate policy.
+type Op struct {
+	// Lsn is the log sequence number of the operation.
+	// Type is the kind of the operation.
+	// Key is the key of the queue.
+	// Task is the pushed, leased, or requeued task as queued.
+	// Id is the id of the popped, removed, updated, acked, or expired
+	// task.
+	// Priority is the updated priority.
+	// Expires is the expiry time of the lease of the leased task.
+	Lsn      uint64     `json:"lsn"`
+	Type     OpType     `json:"op"`
+	Key      string     `json:"key"`
+	Task     *Task      `json:"task,omitempty"`
+	Id       string     `json:"id,omitempty"`
+	Priority float64    `json:"priority,omitempty"`
+	Expires  *time.Time `json:"expires,omitempty"`
+}
+
+// PushOp returns the operation recording the push of the task.
+func PushOp(task *Task) *Op {
+	return &Op{Type: OpPush, Task: task}
+}
+
+// PopOps returns the operations recording the pop of the tasks.
+func PopOps(tasks ...*Task) []*Op {
+	ops := make([]*Op, len(tasks))
+	for i, task := range tasks {
+		ops[i] = &Op{Type: OpPop, Id: task.Id}
+	}
+	return ops
+}
+
+// LeaseOp returns the operation recording the lease.
+func LeaseOp(lease *Lease) *Op {
+	expires := lease.Expires
+	return &Op{Type: OpLease, Task: lease.Task, Expires: &expires}
+}
+
+// NackOp returns the operation recording the requeue of the leased task.
+func NackOp(task *Task) *Op {
+	return &Op{Type: OpNack, Task: task}
+}
+
+// ExpireOps returns the operations recording the purge of the expired
+// tasks with the provided ids.
+func ExpireOps(ids ...string) []*Op {
+	ops := make([]*Op, len(ids))
+	for i, id := range ids {
+		ops[i] = &Op{Type: OpExpire, Id: id}
+	}
+	return ops
+}
+
+// OpLog is implemented by models that persist queue operations to a log
+// instead of saving the whole queue on every change.
+type OpLog interface {
+	// Log durably appends the operations of the queue.
+	// Compact saves the queues returned by the queues function and
+	// discards the logged operations once enough operations have been
+	// logged.
+	Log(ctx context.Context, pq *PriorityQueue, ops ...*Op) error
+	Compact(ctx context.Context, queues func() []*PriorityQueue) error
+}
+
+// apply replays the operation on the queue.  Operations at or below the
+// log sequence number of the queue are already contained in the queue
+// and are skipped.
+func (pq *PriorityQueue) apply(op *Op) error {
+	if op.Lsn <= pq.lsn {
+		return nil
+	}
+	switch op.Type {
+	case OpPush:
+		if op.Task == nil {
+			return fmt.Errorf("push operation %d has no task", op.Lsn)
+		}
+		pq.put(op.Task)
+	case OpPop, OpRemove:
+		if i, ok := pq.index[op.Id]; ok {
+			pq.removeAt(i)
+		}
+	case OpUpdate:
+		pq.Update(op.Id, op.Priority)
+	case OpLease:
+		if op.Task == nil || op.Expires == nil {
+			return fmt.Errorf("lease operation %d has no task or expiry", op.Lsn)
+		}
+		if i, ok := pq.index[op.Task.Id]; ok {
+			pq.removeAt(i)
+		}
+		pq.inflight[op.Task.Id] = &Lease{Task: op.Task, Expires: *op.Expires}
+	case OpAck:
+		delete(pq.inflight, op.Id)
+	case OpNack:
+		if op.Task == nil {
+			return fmt.Errorf("nack operation %d has no task", op.Lsn)
+		}
+		delete(pq.inflight, op.Task.Id)
+		pq.put(op.Task)
+	case OpExpire:
+		if i, ok := pq.index[op.Id]; ok {
+			pq.removeAt(i)
+			pq.recordExpired([]string{op.Id})
+		}
+	case OpClear:
+		pq.Clear()
+	default:
+		return fmt.Errorf("operation %d has unknown type %q", op.Lsn, op.Type)
+	}
+	pq.lsn = op.Lsn
+	return nil
+}
+
+// WALSync determines when appended operations are synced to disk.
+type WALSync string
+
+const (
+	WALSyncAlways WALSync = "always" // each append syncs the log.
+	WALSyncGroup  WALSync = "group"  // concurrent appends share one sync.
+)
+
+// logFile is the log file of a WALModel.
+type logFile interface {
+	io.Writer
+	io.ReaderAt
+	io.Seeker
+	io.Closer
+	Sync() error
+	Truncate(size int64) error
+}
+
+// WALModel wraps a model with a write-ahead log of queue operations.  The
+// wrapped model stores queue snapshots.  Fetched snapshots are brought up
+// to date by replaying the log, and the log is compacted by saving fresh
+// snapshots.  Task changes and deletes are logged; configuration changes
+// and dead lettering save a snapshot through the embedded Save, which
+// records the log sequence number it contains.
+type WALModel struct {
+	Model
+	// Path is the path of the log file.
+	// Sync is the sync mode of appends.  The empty mode behaves as
+	// WALSyncGroup.
+	// CompactRecords is the number of logged operations after which
+	// Compact saves snapshots.  Zero uses DefaultCompactRecords.
+	Path           string
+	Sync           WALSync
+	CompactRecords int
+
+	// mu guards the log file, size, lsn, records, deletes, and failed.
+	// syncMu serializes syncs and log replacements and guards synced and
+	// syncedSize.
+	// deleteMu is held for writing while a pending delete is applied
+	// and for reading while a snapshot is saved.
+	// file is the log file opened for appending.
+	// size is the length of the log file.
+	// lsn is the last assigned log sequence number.
+	// synced is the last log sequence number synced to disk.
+	// syncedSize is the length of the log file synced to disk.
+	// records is the number of operations in the log file.
+	// deletes is the logged deletes by key whose snapshots are still
+	// stored.
+	// failed is the error that failed the log, after which appends are
+	// refused.
+	mu         sync.Mutex
+	syncMu     sync.Mutex
+	deleteMu   sync.RWMutex
+	file       logFile
+	size       int64
+	lsn        uint64
+	synced     uint64
+	syncedSize int64
+	records    int
+	deletes    map[string]*PriorityQueue
+	failed     error
+}
+
+// FetchAll fetches the queue snapshots from the wrapped model and
+// replays the log on top of them.  A partially written last operation is
+// discarded.  The log is opened for appending afterwards, so the queues
+// can only be fetched once.
+func (model *WALModel) FetchAll(ctx context.Context) ([]interface{}, error) {
+	model.mu.Lock()
+	open := model.file != nil
+	model.mu.Unlock()
+	if open {
+		return nil, errors.New("operation log is already open")
+	}
+	snapshots, err := model.Model.FetchAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+	queues := make(map[string]*PriorityQueue)
+	for _, v := range snapshots {
+		pq := v.(*PriorityQueue)
+		queues[pq.Key] = pq
+		if pq.lsn > model.lsn {
+			model.lsn = pq.lsn
+		}
+	}
+
+	f, err := os.OpenFile(model.Path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	var size int64
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				log.Printf("discarded partial operation at the end of log [%s]", model.Path)
+			}
+			break
+		} else if err != nil {
+			f.Close()
+			return nil, err
+		}
+		op := new(Op)
+		if err := json.Unmarshal(line, op); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("log [%s] offset %d: %w", model.Path, size, err)
+		}
+		pq, ok := queues[op.Key]
+		if op.Type == OpDelete {
+			// a snapshot saved after the delete holds a recreated queue.
+			if ok && op.Lsn > pq.lsn {
+				delete(queues, op.Key)
+				model.pendDelete(pq)
+			}
+		} else {
+			if !ok {
+				pq = NewPriorityQueue(op.Key)
+				queues[op.Key] = pq
+				snapshots = append(snapshots, pq)
+			}
+			if err := pq.apply(op); err != nil {
+				f.Close()
+				return nil, err
+			}
+		}
+		if op.Lsn > model.lsn {
+			model.lsn = op.Lsn
+		}
+		size += int64(len(line))
+		model.records++
+	}
+	if err := f.Truncate(size); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(size, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	model.file = f
+	model.size = size
+	model.synced = model.lsn
+	model.syncedSize = size
+	log.Printf("replayed %d operations from log [%s]", model.records, model.Path)
+
+	replayed := make([]interface{}, 0, len(queues))
+	for _, v := range snapshots {
+		if pq := v.(*PriorityQueue); queues[pq.Key] == pq {
+			replayed = append(replayed, pq)
+		}
+	}
+	return replayed, nil
+}
+
+// errLazyWAL is returned by the per key reads of a write-ahead logged
+// model.
+var errLazyWAL = errors.New("queues of a write-ahead logged model can only be fetched all at once")
+
+// Fetch fails as a single stored queue may be outdated by the log.
+func (model *WALModel) Fetch(ctx context.Context, key string) (interface{}, error) {
+	return nil, errLazyWAL
+}
+
+// Keys fails as queues may exist only in the log.
+func (model *WALModel) Keys(ctx context.Context) ([]string, error) {
+	return nil, errLazyWAL
+}
+
+// Log assigns log sequence numbers to the operations of the queue,
+// appends them to the log, and syncs the log.  The caller must hold the
+// queue lock so that operations of a queue are logged in order.  The
+// context is checked before the operations are appended, as an append
+// cannot be cancelled.  An append that fails to be written or synced is
+// truncated from the log, so that it is not replayed.
+func (model *WALModel) Log(ctx context.Context, pq *PriorityQueue, ops ...*Op) error {
+	if len(ops) == 0 {
+		return nil
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	model.mu.Lock()
+	if model.file == nil {
+		model.mu.Unlock()
+		return errors.New("operation log is not open")
+	}
+	if model.failed != nil {
+		model.mu.Unlock()
+		return model.failed
+	}
+	start, offset := model.lsn, model.size
+	for _, op := range ops {
+		model.lsn++
+		op.Lsn = model.lsn
+		op.Key = pq.Key
+		data, err := json.Marshal(op)
+		if err != nil {
+			model.lsn = start
+			model.mu.Unlock()
+			return err
+		}
+		buf.Write(data)
+		buf.WriteByte('\n')
+	}
+	if _, err := model.file.Write(buf.Bytes()); err != nil {
+		model.rollback(start, offset)
+		model.mu.Unlock()
+		return err
+	}
+	if model.Sync == WALSyncAlways {
+		if err := model.file.Sync(); err != nil {
+			model.rollback(start, offset)
+			model.mu.Unlock()
+			return err
+		}
+	}
+	model.size += int64(buf.Len())
+	model.records += len(ops)
+	for _, op := range ops {
+		if op.Type == OpDelete {
+			model.pendDelete(pq)
+		}
+	}
+	lsn := model.lsn
+	pq.lsn = lsn
+	model.mu.Unlock()
+	if model.Sync == WALSyncAlways {
+		return nil
+	}
+	return model.sync(lsn)
+}
+
+// rollback truncates the log file to the offset and resets the last
+// assigned log sequence number.  If the log file cannot be truncated the
+// log is failed, as it may hold a partial operation.  The caller must
+// hold mu.
+func (model *WALModel) rollback(lsn uint64, offset int64) {
+	model.lsn = lsn
+	model.size = offset
+	err := model.file.Truncate(offset)
+	if err == nil {
+		_, err = model.file.Seek(offset, io.SeekStart)
+	}
+	if err != nil {
+		model.failed = fmt.Errorf("failed to roll back log [%s]: %w", model.Path, err)
+	}
+}
+
+// Delete logs the deletion of the queue, so that replaying the log does
+// not recreate it.  The queue is deleted once the deletion is durable,
+// and its snapshot is deleted from the wrapped model by the next
+// compaction, before the deletion is discarded from the log.
+func (model *WALModel) Delete(ctx context.Context, pq interface{}) error {
+	q, ok := pq.(*PriorityQueue)
+	if !ok {
+		return errors.New("write-ahead logged model can only delete priority queues")
+	}
+	if err := model.Log(ctx, q, &Op{Type: OpDelete}); err != nil {
+		model.mu.Lock()
+		if model.deletes[q.Key] == q {
+			delete(model.deletes, q.Key)
+		}
+		model.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// pendDelete records the deleted queue, whose snapshot is deleted by the
+// next compaction.  The caller must hold mu once the log is open.
+func (model *WALModel) pendDelete(pq *PriorityQueue) {
+	if model.deletes == nil {
+		model.deletes = make(map[string]*PriorityQueue)
+	}
+	model.deletes[pq.Key] = pq
+}
+
+// Save saves a snapshot of the queue to the wrapped model.  Operations
+// of a queue are logged while its lock is held, so the snapshot contains
+// every logged operation of the queue and is stamped with the last log
+// sequence number.  A pending delete of a queue with the same key is
+// dropped, as the snapshot replaces the deleted one.
+func (model *WALModel) Save(ctx context.Context, pq interface{}) (DocumentMeta, error) {
+	q, ok := pq.(*PriorityQueue)
+	if !ok {
+		return DocumentMeta{}, errors.New("write-ahead logged model can only save priority queues")
+	}
+	model.deleteMu.RLock()
+	defer model.deleteMu.RUnlock()
+	model.mu.Lock()
+	q.lsn = model.lsn
+	model.mu.Unlock()
+	meta, err := model.Model.Save(ctx, q)
+	if err != nil {
+		return meta, err
+	}
+	model.mu.Lock()
+	delete(model.deletes, q.Key)
+	model.mu.Unlock()
+	return meta, nil
+}
+
+// sync makes the log durable up to the log sequence number.  Appends
+// that arrive while a sync is in progress are made durable together by
+// the next sync.  If the sync fails the unsynced appends of every
+// appender are truncated from the log, and the log is failed, as the
+// appenders waiting for the next sync cannot be told apart.
+func (model *WALModel) sync(lsn uint64) error {
+	model.syncMu.Lock()
+	defer model.syncMu.Unlock()
+	if model.synced >= lsn {
+		return nil
+	}
+	model.mu.Lock()
+	if model.failed != nil {
+		err := model.failed
+		model.mu.Unlock()
+		return err
+	}
+	last, size, file := model.lsn, model.size, model.file
+	model.mu.Unlock()
+	if err := file.Sync(); err != nil {
+		model.mu.Lock()
+		model.rollback(model.synced, model.syncedSize)
+		if model.failed == nil {
+			model.failed = fmt.Errorf("failed to sync log [%s]: %w", model.Path, err)
+		}
+		model.mu.Unlock()
+		return err
+	}
+	model.synced = last
+	model.syncedSize = size
+	return nil
+}
+
+// Compact deletes the snapshots of deleted queues, saves a snapshot of
+// each queue to the wrapped model, and discards the logged operations
+// contained in the snapshots, if at least CompactRecords operations have
+// been logged.  The queues are listed after the end of the discarded
+// operations is marked, so a queue created meanwhile is either saved or
+// kept in the log.  Operations logged while the snapshots are saved are
+// kept, and queues deleted meanwhile are skipped.  If a snapshot cannot
+// be deleted or saved the log is kept.
+func (model *WALModel) Compact(ctx context.Context, queues func() []*PriorityQueue) error {
+	threshold := model.CompactRecords
+	if threshold <= 0 {
+		threshold = DefaultCompactRecords
+	}
+	model.mu.Lock()
+	if model.failed != nil {
+		err := model.failed
+		model.mu.Unlock()
+		return err
+	}
+	if model.file == nil || model.records < threshold {
+		model.mu.Unlock()
+		return nil
+	}
+	mark := model.size
+	deletes := make([]*PriorityQueue, 0, len(model.deletes))
+	for _, pq := range model.deletes {
+		deletes = append(deletes, pq)
+	}
+	model.mu.Unlock()
+
+	for _, pq := range deletes {
+		if err := model.deleteSnapshot(ctx, pq); err != nil {
+			return err
+		}
+	}
+
+	for _, pq := range queues() {
+		pq.Lock()
+		var err error
+		if !pq.evicted {
+			_, err = pq.Save(ctx, model.Model)
+		}
+		pq.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return model.truncate(mark)
+}
+
+// deleteSnapshot deletes the snapshot of the deleted queue from the
+// wrapped model unless a snapshot of a queue with the same key was saved
+// since.
+func (model *WALModel) deleteSnapshot(ctx context.Context, pq *PriorityQueue) error {
+	model.deleteMu.Lock()
+	defer model.deleteMu.Unlock()
+	model.mu.Lock()
+	pending := model.deletes[pq.Key] == pq
+	model.mu.Unlock()
+	if !pending {
+		return nil
+	}
+	if err := model.Model.Delete(ctx, pq); err != nil {
+		return err
+	}
+	model.mu.Lock()
+	if model.deletes[pq.Key] == pq {
+		delete(model.deletes, pq.Key)
+	}
+	model.mu.Unlock()
+	return nil
+}
+
+// truncate discards the log up to the offset by copying the rest of the
+// log to a new file that replaces it.
+func (model *WALModel) truncate(offset int64) error {
+	model.syncMu.Lock()
+	defer model.syncMu.Unlock()
+	model.mu.Lock()
+	defer model.mu.Unlock()
+	tail := make([]byte, model.size-offset)
+	if _, err := model.file.ReadAt(tail, offset); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(model.Path, tail); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(model.Path, os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	model.file.Close()
+	model.file = f
+	model.size = int64(len(tail))
+	// the replacing log is synced by writeFileAtomic.
+	model.synced = model.lsn
+	model.syncedSize = model.size
+	model.records = bytes.Count(tail, []byte{'\n'})
+	log.Printf("compacted log [%s] to %d operations", model.Path, model.records)
+	return nil
+}
+
+// Close closes the log file.
+func (model *WALModel) Close() error {
+	model.mu.Lock()
+	defer model.mu.Unlock()
+	if model.file == nil {
+		return nil
+	}
+	err := model.file.Close()
+	model.file = nil
+	return err
+}
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bitwurx/jrpc2"
+)
+
+// restartWAL closes the api and log and returns a new api that loads the
+// queues from the snapshots and log.  The tamper function, if any, runs
+// while the log is closed.
+func restartWAL(api *ApiV1, model *WALModel, tamper func()) (*ApiV1, *WALModel) {
+	api.Close()
+	model.Close()
+	if tamper != nil {
+		tamper()
+	}
+	model = &WALModel{Model: model.Model, Path: model.Path, CompactRecords: model.CompactRecords}
+	return NewApiV1(model, jrpc2.NewServer("", "")), model
+}
+
+// hookedModel runs its hook once before the next save of the queue with
+// the hooked key to the wrapped model.
+type hookedModel struct {
+	Model
+	mu   sync.Mutex
+	key  string
+	hook func()
+}
+
+func (m *hookedModel) setHook(key string, hook func()) {
+	m.mu.Lock()
+	m.key, m.hook = key, hook
+	m.mu.Unlock()
+}
+
+func (m *hookedModel) Save(ctx context.Context, pq interface{}) (DocumentMeta, error) {
+	m.mu.Lock()
+	hook := m.hook
+	if hook != nil && pq.(*PriorityQueue).Key == m.key {
+		m.hook = nil
+	} else {
+		hook = nil
+	}
+	m.mu.Unlock()
+	if hook != nil {
+		hook()
+	}
+	return m.Model.Save(ctx, pq)
+}
+
+func TestWALModelReplay(t *testing.T) {
+	snapshots := NewMemoryModel()
+	model := &WALModel{Model: snapshots, Path: filepath.Join(t.TempDir(), "queues.wal")}
+	api := NewApiV1(model, jrpc2.NewServer("", ""))
+	api.Push([]byte(`{"key": "wal", "id": "a", "priority": 3}`))
+	api.PushMany([]byte(`{"key": "wal", "tasks": [{"id": "b", "priority": 2}, {"id": "c", "priority": 1}, {"id": "d", "priority": 4}]}`))
+	api.Update([]byte(`{"key": "wal", "id": "a", "priority": 0.5}`))
+	api.Remove([]byte(`{"key": "wal", "id": "b"}`))
+	api.Pop([]byte(`["wal"]`))
+	if queues, _ := snapshots.FetchAll(context.Background()); len(queues) != 0 {
+		t.Fatal("expected logged operations to not save snapshots")
+	}
+
+	api, model = restartWAL(api, model, nil)
+	defer model.Close()
+	defer api.Close()
+	queue, ok := api.queues.Get("wal")
+	if !ok {
+		t.Fatal("expected queue to be replayed from the log")
+	}
+	checkHeap(t, queue)
+	sorted := queue.Sorted()
+	if len(sorted) != 2 || sorted[0].Id != "c" || sorted[1].Id != "d" {
+		t.Fatal("expected replayed queue to hold tasks [c] and [d]")
+	}
+	if queue.seq != 4 {
+		t.Fatal("expected replayed queue to continue the sequence")
+	}
+}
+
+func TestWALModelDelete(t *testing.T) {
+	model := &WALModel{Model: NewMemoryModel(), Path: filepath.Join(t.TempDir(), "queues.wal")}
+	api := NewApiV1(model, jrpc2.NewServer("", ""))
+	api.Push([]byte(`{"key": "gone", "id": "a", "priority": 1}`))
+	api.Push([]byte(`{"key": "back", "id": "a", "priority": 1}`))
+	api.Delete([]byte(`["gone"]`))
+	api.Delete([]byte(`["back"]`))
+	api.Push([]byte(`{"key": "back", "id": "b", "priority": 1}`))
+
+	api, model = restartWAL(api, model, nil)
+	defer model.Close()
+	defer api.Close()
+	if _, ok := api.queues.Get("gone"); ok {
+		t.Fatal("expected deleted queue to not be replayed")
+	}
+	queue, ok := api.queues.Get("back")
+	if !ok || queue.count != 1 || !queue.Has("b") {
+		t.Fatal("expected queue recreated after delete to hold task [b]")
+	}
+}
+
+// deleteFailingModel is a model whose deletes fail while fail is set.
+type deleteFailingModel struct {
+	Model
+	fail atomic.Bool
+}
+
+func (m *deleteFailingModel) Delete(ctx context.Context, pq interface{}) error {
+	if m.fail.Load() {
+		return errors.New("storage unavailable")
+	}
+	return m.Model.Delete(ctx, pq)
+}
+
+func TestWALModelPendingDelete(t *testing.T) {
+	snapshots := &deleteFailingModel{Model: NewMemoryModel()}
+	model := &WALModel{Model: snapshots, Path: filepath.Join(t.TempDir(), "queues.wal"), CompactRecords: 2}
+	api := NewApiV1(model, jrpc2.NewServer("", ""))
+	api.Configure([]byte(`{"key": "gone", "config": {"maxAttempts": 2}}`))
+	api.Push([]byte(`{"key": "gone", "id": "a", "priority": 1}`))
+	api.Configure([]byte(`{"key": "back", "config": {"maxAttempts": 2}}`))
+	snapshots.fail.Store(true)
+	if _, errObj := api.Delete([]byte(`["gone"]`)); errObj != nil {
+		t.Fatal("expected delete to succeed once it is logged")
+	}
+	// a snapshot saved after the delete replaces the deleted one.
+	api.Delete([]byte(`["back"]`))
+	api.Configure([]byte(`{"key": "back", "config": {"maxAttempts": 3}}`))
+	api.Sweep(time.Now())
+	if model.records == 0 {
+		t.Fatal("expected log to be kept while a snapshot cannot be deleted")
+	}
+
+	api, model = restartWAL(api, model, nil)
+	if _, ok := api.queues.Get("gone"); ok {
+		t.Fatal("expected pending delete to be replayed")
+	}
+	if queue, ok := api.queues.Get("back"); !ok || queue.Config.MaxAttempts != 3 {
+		t.Fatal("expected queue saved after its delete to be kept")
+	}
+	snapshots.fail.Store(false)
+	api.Sweep(time.Now())
+	defer model.Close()
+	defer api.Close()
+	if model.records != 0 {
+		t.Fatal("expected log to be compacted once the snapshot is deleted")
+	}
+	if v, _ := snapshots.Fetch(context.Background(), "gone"); v != nil {
+		t.Fatal("expected snapshot of the deleted queue to be deleted")
+	}
+	if v, _ := snapshots.Fetch(context.Background(), "back"); v == nil {
+		t.Fatal("expected snapshot of the recreated queue to be kept")
+	}
+}
+
+func TestWALModelPartialTail(t *testing.T) {
+	model := &WALModel{Model: NewMemoryModel(), Path: filepath.Join(t.TempDir(), "queues.wal")}
+	api := NewApiV1(model, jrpc2.NewServer("", ""))
+	api.Push([]byte(`{"key": "tail", "id": "a", "priority": 1}`))
+	api, model = restartWAL(api, model, func() {
+		f, _ := os.OpenFile(model.Path, os.O_WRONLY|os.O_APPEND, 0644)
+		f.WriteString(`{"lsn": 2, "op": "push", "key": "tail", "task": {"_key": "b"`)
+		f.Close()
+	})
+	if queue, _ := api.queues.Get("tail"); queue.count != 1 {
+		t.Fatal("expected partial operation to be discarded")
+	}
+	api.Push([]byte(`{"key": "tail", "id": "c", "priority": 1}`))
+	api, model = restartWAL(api, model, nil)
+	defer model.Close()
+	defer api.Close()
+	if queue, _ := api.queues.Get("tail"); queue.count != 2 {
+		t.Fatal("expected operations after a discarded tail to be replayed")
+	}
+}
+
+func TestWALModelCompact(t *testing.T) {
+	snapshots := &hookedModel{Model: NewMemoryModel()}
+	model := &WALModel{Model: snapshots, Path: filepath.Join(t.TempDir(), "queues.wal"), CompactRecords: 3}
+	api := NewApiV1(model, jrpc2.NewServer("", ""))
+	api.Push([]byte(`{"key": "compact", "id": "a", "priority": 1}`))
+	api.Push([]byte(`{"key": "compact", "id": "b", "priority": 2}`))
+	api.Sweep(time.Now())
+	if model.records != 2 {
+		t.Fatal("expected log below the threshold to not be compacted")
+	}
+	api.Push([]byte(`{"key": "compact", "id": "c", "priority": 3}`))
+	before, _ := os.ReadFile(model.Path)
+	api.Sweep(time.Now())
+	if info, _ := os.Stat(model.Path); info.Size() != 0 || model.records != 0 {
+		t.Fatal("expected compaction to empty the log")
+	}
+	api.Pop([]byte(`["compact"]`))
+
+	api, model = restartWAL(api, model, nil)
+	if queue, _ := api.queues.Get("compact"); queue.count != 2 || queue.Peek().Id != "b" {
+		t.Fatal("expected queue to be restored from the snapshot and log")
+	}
+	api.Pop([]byte(`["compact"]`))
+
+	// a crash between saving the snapshots and truncating the log leaves
+	// operations that are already contained in the snapshot.
+	api, model = restartWAL(api, model, func() {
+		after, _ := os.ReadFile(model.Path)
+		os.WriteFile(model.Path, append(before, after...), 0644)
+	})
+	if queue, _ := api.queues.Get("compact"); queue.count != 1 || queue.Peek().Id != "c" {
+		t.Fatal("expected operations contained in the snapshot to be skipped")
+	}
+
+	// operations logged while the snapshots are saved are kept, and the
+	// replaced log can be compacted again.
+	snapshots.setHook("compact", func() {
+		api.Push([]byte(`{"key": "other", "id": "x", "priority": 1}`))
+	})
+	api.Sweep(time.Now())
+	if model.records != 1 {
+		t.Fatal("expected operation logged during compaction to be kept")
+	}
+	api.Push([]byte(`{"key": "other", "id": "y", "priority": 2}`))
+	api.Push([]byte(`{"key": "other", "id": "z", "priority": 3}`))
+	snapshots.setHook("compact", func() {
+		api.Pop([]byte(`["other"]`))
+	})
+	api.Sweep(time.Now())
+	if model.records != 1 {
+		t.Fatal("expected second compaction to keep the operation logged during it")
+	}
+
+	api, model = restartWAL(api, model, nil)
+	defer model.Close()
+	defer api.Close()
+	if queue, _ := api.queues.Get("other"); queue == nil || queue.count != 2 || queue.Peek().Id != "y" {
+		t.Fatal("expected queue to be restored after two compactions")
+	}
+	if queue, _ := api.queues.Get("compact"); queue.count != 1 || queue.Peek().Id != "c" {
+		t.Fatal("expected compacted queue to be restored after two compactions")
+	}
+}
+
+func TestWALModelCompactNewQueue(t *testing.T) {
+	model := &WALModel{Model: NewMemoryModel(), Path: filepath.Join(t.TempDir(), "queues.wal"), CompactRecords: 1}
+	api := NewApiV1(model, jrpc2.NewServer("", ""))
+	api.Push([]byte(`{"key": "listed", "id": "a", "priority": 1}`))
+	// a queue created right after the queues are listed is not saved, so
+	// its push must be kept in the log.
+	err := model.Compact(context.Background(), func() []*PriorityQueue {
+		queues := api.queues.List()
+		api.Push([]byte(`{"key": "late", "id": "b", "priority": 1}`))
+		return queues
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if model.records != 1 {
+		t.Fatal("expected push to the queue created during compaction to be kept")
+	}
+
+	api, model = restartWAL(api, model, nil)
+	defer model.Close()
+	defer api.Close()
+	if queue, _ := api.queues.Get("late"); queue == nil || !queue.Has("b") {
+		t.Fatal("expected queue created during compaction to be restored")
+	}
+	if queue, _ := api.queues.Get("listed"); queue == nil || !queue.Has("a") {
+		t.Fatal("expected listed queue to be restored from its snapshot")
+	}
+}
+
+func TestWALModelSkipsSavedOperations(t *testing.T) {
+	model := &WALModel{Model: NewMemoryModel(), Path: filepath.Join(t.TempDir(), "queues.wal")}
+	api := NewApiV1(model, jrpc2.NewServer("", ""))
+	api.Push([]byte(`{"key": "acked", "id": "a", "priority": 1}`))
+	api.Lease([]byte(`{"key": "acked", "ttl": 60}`))
+	api.Ack([]byte(`{"key": "acked", "id": "a"}`))
+
+	api, model = restartWAL(api, model, nil)
+	defer model.Close()
+	defer api.Close()
+	if queue, _ := api.queues.Get("acked"); queue.count != 0 || len(queue.inflight) != 0 {
+		t.Fatal("expected logged push of the acked task to be skipped")
+	}
+}
+
+func TestWALModelLeaseOps(t *testing.T) {
+	snapshots := NewMemoryModel()
+	model := &WALModel{Model: snapshots, Path: filepath.Join(t.TempDir(), "queues.wal")}
+	api := NewApiV1(model, jrpc2.NewServer("", ""))
+	for _, id := range []string{"a", "b", "c", "d"} {
+		api.Push([]byte(fmt.Sprintf(`{"key": "leased", "id": "%s", "priority": 1}`, id)))
+	}
+	api.Push([]byte(`{"key": "leased", "id": "e", "priority": 2, "ttl": 30}`))
+	api.Lease([]byte(`{"key": "leased", "ttl": 60}`))
+	api.Ack([]byte(`{"key": "leased", "id": "a"}`))
+	api.Lease([]byte(`{"key": "leased", "ttl": 60}`))
+	api.Nack([]byte(`{"key": "leased", "id": "b"}`))
+	api.Lease([]byte(`{"key": "leased", "ttl": 60}`))
+	api.Lease([]byte(`{"key": "leased", "ttl": 600}`))
+	api.Sweep(time.Now().Add(2 * time.Minute))
+	if v, _ := snapshots.Fetch(context.Background(), "leased"); v != nil {
+		t.Fatal("expected lease operations to be logged instead of saved")
+	}
+
+	api, model = restartWAL(api, model, nil)
+	queue, _ := api.queues.Get("leased")
+	if queue.count != 2 || queue.Has("a") || queue.Has("e") {
+		t.Fatal("expected acked and expired tasks to stay removed")
+	}
+	if i, ok := queue.index["b"]; !ok || queue.heap[i].Attempts != 2 {
+		t.Fatal("expected nacked and expired lease to be requeued")
+	}
+	if !queue.Has("d") {
+		t.Fatal("expected task that was never leased to stay queued")
+	}
+	if lease, ok := queue.inflight["c"]; !ok || lease.Task.Attempts != 1 {
+		t.Fatal("expected unexpired lease to be replayed")
+	}
+
+	api.Clear([]byte(`{"key": "leased"}`))
+	api, model = restartWAL(api, model, nil)
+	defer model.Close()
+	defer api.Close()
+	if queue, _ := api.queues.Get("leased"); queue.count != 0 || len(queue.inflight) != 0 {
+		t.Fatal("expected clear to be replayed")
+	}
+}
+
+func TestWALModelGroupCommit(t *testing.T) {
+	model := &WALModel{Model: NewMemoryModel(), Path: filepath.Join(t.TempDir(), "queues.wal")}
+	api := NewApiV1(model, jrpc2.NewServer("", ""))
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 25; j++ {
+				api.Push([]byte(fmt.Sprintf(`{"key": "group-%d", "id": "%d", "priority": %d}`, i%4, i*100+j, j)))
+			}
+		}(i)
+	}
+	wg.Wait()
+	if model.synced != model.lsn {
+		t.Fatal("expected every logged operation to be synced")
+	}
+
+	api, model = restartWAL(api, model, nil)
+	defer model.Close()
+	defer api.Close()
+	for i := 0; i < 4; i++ {
+		queue, _ := api.queues.Get(fmt.Sprintf("group-%d", i))
+		if queue.count != 50 {
+			t.Fatalf("expected 50 replayed tasks, got %d", queue.count)
+		}
+		checkHeap(t, queue)
+	}
+}
+
+// faultyFile is a log file whose writes are cut short and whose syncs
+// fail while the respective flag is set.
+type faultyFile struct {
+	*os.File
+	shortWrite atomic.Bool
+	failSync   atomic.Bool
+}
+
+func (f *faultyFile) Write(p []byte) (int, error) {
+	if f.shortWrite.Load() {
+		n, _ := f.File.Write(p[:len(p)/2])
+		return n, errors.New("no space left on device")
+	}
+	return f.File.Write(p)
+}
+
+func (f *faultyFile) Sync() error {
+	if f.failSync.Load() {
+		return errors.New("input/output error")
+	}
+	return f.File.Sync()
+}
+
+// injectFaults replaces the open log file of the model with a faulty
+// file.
+func injectFaults(model *WALModel) *faultyFile {
+	model.mu.Lock()
+	defer model.mu.Unlock()
+	f := &faultyFile{File: model.file.(*os.File)}
+	model.file = f
+	return f
+}
+
+func TestWALModelFailedAppend(t *testing.T) {
+	model := &WALModel{Model: NewMemoryModel(), Path: filepath.Join(t.TempDir(), "queues.wal"), Sync: WALSyncAlways}
+	api := NewApiV1(model, jrpc2.NewServer("", ""))
+	api.Push([]byte(`{"key": "append", "id": "a", "priority": 1}`))
+	f := injectFaults(model)
+
+	f.shortWrite.Store(true)
+	if _, errObj := api.Push([]byte(`{"key": "append", "id": "b", "priority": 2}`)); errObj == nil {
+		t.Fatal("expected push with a short write to fail")
+	}
+	f.shortWrite.Store(false)
+	f.failSync.Store(true)
+	if _, errObj := api.Push([]byte(`{"key": "append", "id": "c", "priority": 3}`)); errObj == nil {
+		t.Fatal("expected push with a failed sync to fail")
+	}
+	f.failSync.Store(false)
+	if _, errObj := api.Push([]byte(`{"key": "append", "id": "d", "priority": 4}`)); errObj != nil {
+		t.Fatal(errObj.Message)
+	}
+
+	api, model = restartWAL(api, model, nil)
+	defer model.Close()
+	defer api.Close()
+	queue, _ := api.queues.Get("append")
+	if queue.count != 2 || !queue.Has("a") || !queue.Has("d") {
+		t.Fatal("expected failed appends to be truncated from the log")
+	}
+}
+
+func TestWALModelFailedGroupSync(t *testing.T) {
+	model := &WALModel{Model: NewMemoryModel(), Path: filepath.Join(t.TempDir(), "queues.wal")}
+	api := NewApiV1(model, jrpc2.NewServer("", ""))
+	api.Push([]byte(`{"key": "group", "id": "a", "priority": 1}`))
+	f := injectFaults(model)
+
+	f.failSync.Store(true)
+	if _, errObj := api.Push([]byte(`{"key": "group", "id": "b", "priority": 2}`)); errObj == nil {
+		t.Fatal("expected push with a failed sync to fail")
+	}
+	f.failSync.Store(false)
+	if _, errObj := api.Push([]byte(`{"key": "group", "id": "c", "priority": 3}`)); errObj == nil {
+		t.Fatal("expected appends to a failed log to be refused")
+	}
+
+	api, model = restartWAL(api, model, nil)
+	defer model.Close()
+	defer api.Close()
+	if queue, _ := api.queues.Get("group"); queue.count != 1 || !queue.Has("a") {
+		t.Fatal("expected unsynced appends to be truncated from the log")
+	}
+}